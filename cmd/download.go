@@ -3,7 +3,12 @@ package cmd
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/azhovan/durable-resume/pkg/download"
 	"github.com/spf13/cobra"
@@ -11,12 +16,60 @@ import (
 
 type downloadOptions struct {
 	remoteURL string
+	mirrors   []string
+	inputFile string
+	metalink  string
 
 	segSize  int64
 	segCount int
+	hedge    float64
+
+	multiRange int
+
+	headers    []string
+	userAgent  string
+	cookieFile string
+
+	connectTimeout time.Duration
+	tlsTimeout     time.Duration
+	headerTimeout  time.Duration
+	idleTimeout    time.Duration
+	readTimeout    time.Duration
+	stallTimeout   time.Duration
+	minSpeed       int64
+
+	oauthTokenURL     string
+	oauthClientID     string
+	oauthClientSecret string
+	oauthScopes       []string
+	oauthRefreshToken string
+	digestAuth        string
+	sigV4             bool
+	s3Endpoint        string
+	s3Region          string
+
+	maxRedirects      int
+	sameHostRedirects bool
+	noDowngrade       bool
+	pinRedirects      bool
+
+	proxy       string
+	noProxy     []string
+	caCert      string
+	cert        string
+	key         string
+	httpVersion string
 
 	dstDIR   string
 	filename string
+
+	extract    bool
+	extractDIR string
+
+	execCmd      string
+	onFailureCmd string
+
+	concurrency int
 }
 
 func newDownloadCmd(output io.Writer) *cobra.Command {
@@ -27,38 +80,384 @@ func newDownloadCmd(output io.Writer) *cobra.Command {
 		Short: "download remote file and store it in a local directory",
 		Args:  cobra.MaximumNArgs(4),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.inputFile != "" {
+				return runBatch(cmd, output, opts)
+			}
+			if opts.metalink != "" {
+				return runMetalink(cmd, output, opts)
+			}
+
 			src, err := url.ParseRequestURI(opts.remoteURL)
 			if err != nil {
 				return fmt.Errorf("invalid remote url: %v", err)
 			}
 
-			downloader, err := download.NewDownloader(
-				opts.dstDIR,
-				src.String(),
+			dlOpts, err := opts.downloaderOptions()
+			if err != nil {
+				return err
+			}
+			dlOpts = append([]download.DownloaderOption{
 				download.WithFileName(opts.filename),
-			)
+				download.WithMirrors(opts.mirrors...),
+			}, dlOpts...)
+			downloader, err := download.NewDownloader(opts.dstDIR, src.String(), dlOpts...)
 			if err != nil {
 				return err
 			}
 
-			dm := download.NewDownloadManager(downloader, download.DefaultRetryPolicy())
+			dm := download.NewDownloadManager(downloader, download.DefaultRetryPolicy(), opts.managerOptions()...)
 
 			fmt.Println("Downloading ...")
-			err = dm.Download(cmd.Context(), download.WithSegmentSize(opts.segSize), download.WithNumberOfSegments(opts.segCount))
+			result, err := dm.Download(cmd.Context(), opts.segmentOptions()...)
 			if err != nil {
 				return err
 			}
-			fmt.Println("Download completed.")
+			fmt.Printf("Download completed: %s (%d bytes in %s)\n", result.Path, result.Size, result.Duration.Round(time.Millisecond))
+			if len(result.Redirects) > 0 {
+				fmt.Printf("Redirected to: %s\n", result.ResolvedURL)
+			}
 
 			return nil
 		},
 	}
 
 	cmd.Flags().StringVarP(&opts.remoteURL, "url", "u", "", "The remote file address to download.")
+	cmd.Flags().StringArrayVar(&opts.mirrors, "mirror", nil, "An additional address of the same file, segments are spread across the mirrors. Can be repeated.")
+	cmd.Flags().StringVarP(&opts.inputFile, "input-file", "i", "", "A file listing the files to download: one URL per line, or a .json/.yaml list of entries.")
+	cmd.Flags().StringVar(&opts.metalink, "metalink", "", "A Metalink (.meta4 or .metalink) file describing the files to download, their mirrors and hashes.")
 	cmd.Flags().StringVarP(&opts.dstDIR, "out", "o", "", "The local file target directory to save file.")
 	cmd.Flags().Int64VarP(&opts.segSize, "segment-size", "s", 0, "The size of each segment for download a file.")
 	cmd.Flags().IntVarP(&opts.segCount, "segment-count", "n", download.DefaultNumberOfSegments, "The number of segments for download a file.")
+	cmd.Flags().Float64Var(&opts.hedge, "hedge", 0, "Once this fraction of the segments is done, e.g. 0.8, also request the remaining ones on a second connection, the first to finish wins.")
+	cmd.Flags().IntVar(&opts.multiRange, "multi-range", 0, "Request up to this number of segments in a single request, for servers limiting the connections per client.")
+	cmd.Flags().StringArrayVarP(&opts.headers, "header", "H", nil, `An additional request header, e.g. "Authorization: Bearer TOKEN". Can be repeated.`)
+	cmd.Flags().StringVar(&opts.userAgent, "user-agent", "", "The User-Agent header of the requests.")
+	cmd.Flags().StringVar(&opts.cookieFile, "cookie-file", "", "A Netscape format cookies.txt file, its cookies are sent with the requests.")
+	cmd.Flags().StringVar(&opts.oauthTokenURL, "oauth-token-url", "", "Authenticate with an OAuth 2.0 access token requested from this token endpoint.")
+	cmd.Flags().StringVar(&opts.oauthClientID, "oauth-client-id", "", "The OAuth 2.0 client ID.")
+	cmd.Flags().StringVar(&opts.oauthClientSecret, "oauth-client-secret", "", "The OAuth 2.0 client secret, defaults to the DR_OAUTH_CLIENT_SECRET environment variable.")
+	cmd.Flags().StringSliceVar(&opts.oauthScopes, "oauth-scope", nil, "The comma separated OAuth 2.0 scopes to request.")
+	cmd.Flags().StringVar(&opts.oauthRefreshToken, "oauth-refresh-token", "", "An OAuth 2.0 refresh token, exchanged for the access tokens instead of the client credentials.")
+	cmd.Flags().StringVar(&opts.digestAuth, "digest-auth", "", `Authenticate with HTTP Digest authentication, "user:password".`)
+	cmd.Flags().BoolVar(&opts.sigV4, "sigv4", false, "Sign the requests with AWS Signature V4 and the AWS_* or ~/.aws credentials, implied by s3:// addresses.")
+	cmd.Flags().StringVar(&opts.s3Endpoint, "s3-endpoint", "", "The endpoint of an S3-compatible store the s3://bucket/key addresses are requested from, AWS S3 by default.")
+	cmd.Flags().StringVar(&opts.s3Region, "s3-region", "", "The region of the requests signed with --sigv4, defaults to AWS_REGION or ~/.aws/config, then us-east-1.")
+	cmd.Flags().IntVar(&opts.maxRedirects, "max-redirects", 0, "The maximum number of redirects followed by a request, 10 by default, -1 to follow none.")
+	cmd.Flags().BoolVar(&opts.sameHostRedirects, "same-host-redirects", false, "Reject the redirects to another host.")
+	cmd.Flags().BoolVar(&opts.noDowngrade, "no-redirect-downgrade", false, "Reject the redirects from https to http.")
+	cmd.Flags().BoolVar(&opts.pinRedirects, "pin-redirects", false, "Request the segments from the URL the address redirects to, resolved again when it expires.")
+	cmd.Flags().DurationVar(&opts.connectTimeout, "connect-timeout", 0, "The maximum time to establish a connection, e.g. 10s.")
+	cmd.Flags().DurationVar(&opts.tlsTimeout, "tls-timeout", 0, "The maximum time of the TLS handshake.")
+	cmd.Flags().DurationVar(&opts.headerTimeout, "header-timeout", 0, "The maximum time to wait for the response headers once a request is sent.")
+	cmd.Flags().DurationVar(&opts.idleTimeout, "idle-timeout", 0, "How long an idle connection is kept open for reuse.")
+	cmd.Flags().DurationVar(&opts.readTimeout, "read-timeout", 0, "Abort and retry a request when no data is received for this long, e.g. 30s.")
+	cmd.Flags().DurationVar(&opts.stallTimeout, "stall-timeout", 0, "Retry a request from where it stopped when it receives less than --min-speed during this period, e.g. 1m.")
+	cmd.Flags().Int64Var(&opts.minSpeed, "min-speed", 0, "The minimum speed of a request in bytes per second, measured over --stall-timeout (30s by default).")
+	cmd.Flags().StringVar(&opts.proxy, "proxy", "", "The http, https, socks5 or socks5h proxy URL, instead of the HTTP(S)_PROXY environment variables.")
+	cmd.Flags().StringSliceVar(&opts.noProxy, "no-proxy", nil, "The comma separated hosts not requested through --proxy or HTTP(S)_PROXY, instead of the NO_PROXY environment variable.")
+	cmd.Flags().StringVar(&opts.caCert, "cacert", "", "A PEM bundle of CA certificates trusted in addition to the system ones.")
+	cmd.Flags().StringVar(&opts.cert, "cert", "", "A PEM client certificate, for servers requiring mutual TLS.")
+	cmd.Flags().StringVar(&opts.key, "key", "", "The PEM private key of --cert.")
+	cmd.Flags().StringVar(&opts.httpVersion, "http-version", "", `The HTTP version of the requests, "1.1" or "2", negotiated by default.`)
 	cmd.Flags().StringVarP(&opts.filename, "file", "f", "", "The downloaded file name")
+	cmd.Flags().BoolVar(&opts.extract, "extract", false, "Decompress and unpack the downloaded file (gzip, bzip2, xz, zstd, tar, zip).")
+	cmd.Flags().StringVar(&opts.extractDIR, "extract-dir", "", "The directory to extract the downloaded file into, defaults to the output directory.")
+	cmd.Flags().StringVar(&opts.execCmd, "exec", "", "A shell command to run after a successful download, see DR_* environment variables.")
+	cmd.Flags().StringVar(&opts.onFailureCmd, "on-failure", "", "A shell command to run after a failed download, see DR_* environment variables.")
+	cmd.Flags().IntVarP(&opts.concurrency, "concurrency", "c", download.DefaultBatchConcurrency, "The maximum number of files downloaded at the same time with --input-file or --metalink.")
+
+	cmd.MarkFlagsMutuallyExclusive("url", "input-file", "metalink")
+	cmd.MarkFlagsMutuallyExclusive("oauth-token-url", "digest-auth", "sigv4")
 
 	return cmd
 }
+
+// segmentOptions returns the segment options, the segment size takes precedence over the segment count.
+func (opts *downloadOptions) segmentOptions() []download.SegmentManagerOption {
+	if opts.segSize > 0 {
+		return []download.SegmentManagerOption{download.WithSegmentSize(opts.segSize)}
+	}
+
+	return []download.SegmentManagerOption{download.WithNumberOfSegments(opts.segCount)}
+}
+
+// transportOptions returns the options configuring the transport of the http client.
+func (opts *downloadOptions) transportOptions() []download.ClientOption {
+	var clientOpts []download.ClientOption
+	for _, timeout := range []struct {
+		value  time.Duration
+		option func(time.Duration) download.ClientOption
+	}{
+		{opts.connectTimeout, download.WithConnectTimeout},
+		{opts.tlsTimeout, download.WithTLSHandshakeTimeout},
+		{opts.headerTimeout, download.WithResponseHeaderTimeout},
+		{opts.idleTimeout, download.WithIdleConnTimeout},
+		{opts.readTimeout, download.WithReadTimeout},
+	} {
+		if timeout.value > 0 {
+			clientOpts = append(clientOpts, timeout.option(timeout.value))
+		}
+	}
+
+	if opts.proxy != "" {
+		clientOpts = append(clientOpts, download.WithProxy(opts.proxy))
+	}
+	if len(opts.noProxy) > 0 {
+		clientOpts = append(clientOpts, download.WithNoProxy(opts.noProxy...))
+	}
+	if opts.caCert != "" {
+		clientOpts = append(clientOpts, download.WithCACertFile(opts.caCert))
+	}
+	if opts.cert != "" || opts.key != "" {
+		clientOpts = append(clientOpts, download.WithClientCertificate(opts.cert, opts.key))
+	}
+	if opts.httpVersion != "" {
+		clientOpts = append(clientOpts, download.WithHTTPVersion(download.HTTPVersion(opts.httpVersion)))
+	}
+
+	return clientOpts
+}
+
+// auth returns the authentication of the requests, if any. The OAuth 2.0 token requests are sent
+// with the given http client, the one of the downloads. The given batch entries are downloaded too.
+func (opts *downloadOptions) auth(httpClient *http.Client, entries []download.BatchEntry) (download.AuthStrategy, error) {
+	if opts.signsV4(entries) {
+		if opts.oauthTokenURL != "" || opts.digestAuth != "" {
+			return nil, fmt.Errorf("s3:// addresses are signed with AWS Signature V4, they can't be combined with --oauth-token-url or --digest-auth")
+		}
+		creds, err := download.LoadAWSCredentials()
+		if err != nil {
+			return nil, err
+		}
+		region := opts.s3Region
+		if region == "" {
+			region = download.AWSRegion()
+		}
+		return &download.SigV4{Credentials: creds, Region: region}, nil
+	}
+	if opts.oauthTokenURL != "" {
+		secret := opts.oauthClientSecret
+		if secret == "" {
+			secret = os.Getenv("DR_OAUTH_CLIENT_SECRET")
+		}
+		return &download.OAuth2{
+			TokenURL:     opts.oauthTokenURL,
+			ClientID:     opts.oauthClientID,
+			ClientSecret: secret,
+			Scopes:       opts.oauthScopes,
+			RefreshToken: opts.oauthRefreshToken,
+			HTTPClient:   httpClient,
+		}, nil
+	}
+	if opts.digestAuth != "" {
+		username, password, ok := strings.Cut(opts.digestAuth, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid --digest-auth %q, expected \"user:password\"", opts.digestAuth)
+		}
+		return &download.DigestAuth{Username: username, Password: password}, nil
+	}
+
+	return nil, nil
+}
+
+// signsV4 reports whether the requests are signed with AWS Signature V4, i.e. with --sigv4 or when
+// the address, a mirror, or the URL or a mirror of one of the given batch entries is an s3:// URL.
+// The requests of all the downloads are then signed, like with --sigv4.
+func (opts *downloadOptions) signsV4(entries []download.BatchEntry) bool {
+	addresses := append([]string{opts.remoteURL}, opts.mirrors...)
+	for _, entry := range entries {
+		addresses = append(addresses, entry.URL)
+		addresses = append(addresses, entry.Mirrors...)
+	}
+
+	for _, address := range addresses {
+		if strings.HasPrefix(address, "s3://") {
+			return true
+		}
+	}
+
+	return opts.sigV4
+}
+
+// downloaderOptions returns the options of the downloads, the given batch entries are downloaded too.
+func (opts *downloadOptions) downloaderOptions(entries ...download.BatchEntry) ([]download.DownloaderOption, error) {
+	var dlOpts []download.DownloaderOption
+	httpClient := http.DefaultClient
+	if transportOpts := opts.transportOptions(); len(transportOpts) > 0 {
+		var err error
+		if httpClient, err = download.NewHTTPClient(transportOpts...); err != nil {
+			return nil, err
+		}
+	}
+	auth, err := opts.auth(httpClient, entries)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != http.DefaultClient || auth != nil {
+		client, err := download.NewClient(download.WithHTTPClient(httpClient), download.WithAuth(auth))
+		if err != nil {
+			return nil, err
+		}
+		dlOpts = append(dlOpts, download.WithClient(client))
+	}
+	if opts.multiRange > 1 {
+		dlOpts = append(dlOpts, download.WithMultiRange(opts.multiRange))
+	}
+	policy := download.RedirectPolicy{
+		MaxRedirects: opts.maxRedirects,
+		SameHost:     opts.sameHostRedirects,
+		NoDowngrade:  opts.noDowngrade,
+		Pin:          opts.pinRedirects,
+	}
+	if policy != (download.RedirectPolicy{}) {
+		dlOpts = append(dlOpts, download.WithRedirectPolicy(policy))
+	}
+	if opts.s3Endpoint != "" || opts.s3Region != "" {
+		dlOpts = append(dlOpts, download.WithS3Endpoint(opts.s3Endpoint, opts.s3Region))
+	}
+	if opts.stallTimeout > 0 || opts.minSpeed > 0 {
+		dlOpts = append(dlOpts, download.WithStallDetection(opts.stallTimeout, opts.minSpeed))
+	}
+
+	for _, header := range opts.headers {
+		name, value, ok := strings.Cut(header, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", header)
+		}
+		if download.IsManagedHeader(name) {
+			return nil, fmt.Errorf("invalid header %q, %s is set by the downloader", header, name)
+		}
+		dlOpts = append(dlOpts, download.WithHeader(name, strings.TrimSpace(value)))
+	}
+	if opts.userAgent != "" {
+		dlOpts = append(dlOpts, download.WithUserAgent(opts.userAgent))
+	}
+	if opts.cookieFile != "" {
+		jar, err := download.LoadCookieFile(opts.cookieFile)
+		if err != nil {
+			return nil, err
+		}
+		dlOpts = append(dlOpts, download.WithCookieJar(jar))
+	}
+
+	return dlOpts, nil
+}
+
+func (opts *downloadOptions) managerOptions() []download.DownloadManagerOption {
+	var dmOpts []download.DownloadManagerOption
+	if opts.hedge > 0 {
+		dmOpts = append(dmOpts, download.WithHedging(opts.hedge))
+	}
+	if opts.extract {
+		extractDIR := opts.extractDIR
+		if extractDIR == "" {
+			extractDIR = opts.dstDIR
+		}
+		dmOpts = append(dmOpts, download.WithPostProcessor(download.NewExtractor(extractDIR)))
+	}
+	if opts.execCmd != "" {
+		dmOpts = append(dmOpts, download.WithOnComplete(download.CommandHook(opts.execCmd)))
+	}
+	if opts.onFailureCmd != "" {
+		dmOpts = append(dmOpts, download.WithOnFailure(download.CommandHook(opts.onFailureCmd)))
+	}
+
+	return dmOpts
+}
+
+// runBatch downloads all the files listed in the input file and prints a summary table.
+func runBatch(cmd *cobra.Command, output io.Writer, opts *downloadOptions) error {
+	entries, err := download.ParseBatchFile(opts.inputFile)
+	if err != nil {
+		return err
+	}
+	dlOpts, err := opts.downloaderOptions(entries...)
+	if err != nil {
+		return err
+	}
+
+	batch, err := download.NewBatch(entries,
+		download.WithConcurrency(opts.concurrency),
+		download.WithOutputDir(opts.dstDIR),
+		download.WithDownloaderOptions(dlOpts...),
+		download.WithManagerOptions(opts.managerOptions()...),
+		download.WithSegmentOptions(opts.segmentOptions()...),
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Downloading %d files ...\n", len(entries))
+	results := batch.Run(cmd.Context())
+
+	return printBatchSummary(output, results)
+}
+
+// runMetalink downloads the files described by the metalink file from their mirrors, verifies
+// them against their hashes and prints a summary table.
+func runMetalink(cmd *cobra.Command, output io.Writer, opts *downloadOptions) error {
+	ml, err := download.ParseMetalinkFile(opts.metalink)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]download.BatchEntry, len(ml.Files))
+	for i, file := range ml.Files {
+		entries[i] = file.BatchEntry()
+	}
+
+	dlOpts, err := opts.downloaderOptions(entries...)
+	if err != nil {
+		return err
+	}
+
+	batch, err := download.NewBatch(entries,
+		download.WithConcurrency(opts.concurrency),
+		download.WithOutputDir(opts.dstDIR),
+		download.WithDownloaderOptions(dlOpts...),
+		download.WithManagerOptions(opts.managerOptions()...),
+		download.WithSegmentOptions(opts.segmentOptions()...),
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Downloading %d files ...\n", len(entries))
+	results := batch.Run(cmd.Context())
+
+	return printBatchSummary(output, results)
+}
+
+// printBatchSummary prints a table of the batch results, it returns an error if any download failed.
+func printBatchSummary(output io.Writer, results []download.BatchResult) error {
+	var succeeded, failed, skipped int
+
+	tw := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tURL\tFILE\tDURATION\tERROR")
+	for _, r := range results {
+		switch r.Status {
+		case download.BatchSucceeded:
+			succeeded++
+		case download.BatchFailed:
+			failed++
+		case download.BatchSkipped:
+			skipped++
+		}
+
+		var errMsg string
+		if r.Err != nil {
+			errMsg = strings.ReplaceAll(r.Err.Error(), "\n", "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Status, r.Entry.URL, r.Path, r.Duration.Round(time.Millisecond), errMsg)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "\n%d succeeded, %d failed, %d skipped\n", succeeded, failed, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(results))
+	}
+
+	return nil
+}
@@ -0,0 +1,430 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/azhovan/durable-resume/pkg/daemon"
+	"github.com/azhovan/durable-resume/pkg/queue"
+	"github.com/spf13/cobra"
+)
+
+// jobService manages the jobs of the queue, either through a running daemon or in-process.
+type jobService interface {
+	Add(ctx context.Context, req daemon.JobRequest) (daemon.JobView, error)
+	Jobs(ctx context.Context, statuses ...queue.Status) ([]daemon.JobView, error)
+	Pause(ctx context.Context, id string) (daemon.JobView, error)
+	Cancel(ctx context.Context, id string) (daemon.JobView, error)
+	Watch(ctx context.Context, id string, fn func(daemon.JobView) error) error
+}
+
+// clientOptions locate the daemon, and the queue used when no daemon is running.
+type clientOptions struct {
+	addr      string
+	tokenFile string
+	queueFile string
+}
+
+func (opts *clientOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&opts.addr, "addr", "", "The Unix socket path or loopback TCP address of the daemon, defaults to the socket used by dr serve.")
+	cmd.Flags().StringVar(&opts.tokenFile, "token-file", "", "The file holding the token of a daemon listening on a TCP address, defaults to the one written by dr serve.")
+	cmd.Flags().StringVar(&opts.queueFile, "queue-file", "", "The queue state file used when no daemon is running, defaults to the one used by dr serve.")
+}
+
+// service returns a client of the daemon when it's running, and an in-process service otherwise.
+// The in-process service reports false.
+func (opts *clientOptions) service(ctx context.Context) (jobService, bool, error) {
+	addr := opts.addr
+	if addr == "" {
+		var err error
+		if addr, err = daemon.DefaultSocketPath(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var clientOpts []daemon.ClientOption
+	if !daemon.IsSocketPath(addr) {
+		token, err := opts.token()
+		if err != nil {
+			return nil, false, err
+		}
+		clientOpts = append(clientOpts, daemon.WithClientToken(token))
+	}
+
+	client := daemon.NewClient(addr, clientOpts...)
+	pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err := client.Ping(pingCtx)
+	if err == nil {
+		return client, true, nil
+	}
+	if !errors.Is(err, daemon.ErrDaemonUnavailable) || opts.addr != "" {
+		// a daemon was explicitly asked for
+		return nil, false, err
+	}
+
+	path := opts.queueFile
+	if path == "" {
+		if path, err = queue.DefaultPath(); err != nil {
+			return nil, false, err
+		}
+	}
+	q, err := queue.New(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &localService{queue: q}, false, nil
+}
+
+// token reads the token of the daemon from the token file. A missing file isn't an error,
+// the daemon then rejects the requests with daemon.ErrUnauthorized.
+func (opts *clientOptions) token() (string, error) {
+	path := opts.tokenFile
+	if path == "" {
+		var err error
+		if path, err = daemon.DefaultTokenPath(); err != nil {
+			return "", err
+		}
+	}
+
+	token, err := daemon.ReadToken(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	return token, err
+}
+
+// localService runs the queue in-process when no daemon is running.
+// The queue only runs while jobs are watched.
+type localService struct {
+	queue *queue.Queue
+}
+
+func (s *localService) Add(_ context.Context, req daemon.JobRequest) (daemon.JobView, error) {
+	if err := req.Validate(); err != nil {
+		return daemon.JobView{}, err
+	}
+
+	job, err := s.queue.Enqueue(req.BatchEntry, req.Priority)
+	if err != nil {
+		return daemon.JobView{}, err
+	}
+
+	return daemon.NewJobView(s.queue, job), nil
+}
+
+func (s *localService) Jobs(_ context.Context, statuses ...queue.Status) ([]daemon.JobView, error) {
+	var views []daemon.JobView
+	for _, job := range s.queue.Jobs(statuses...) {
+		views = append(views, daemon.NewJobView(s.queue, job))
+	}
+
+	return views, nil
+}
+
+func (s *localService) Pause(_ context.Context, id string) (daemon.JobView, error) {
+	return s.apply(id, s.queue.Pause)
+}
+
+func (s *localService) Cancel(_ context.Context, id string) (daemon.JobView, error) {
+	return s.apply(id, s.queue.Cancel)
+}
+
+func (s *localService) apply(id string, op func(id string) error) (daemon.JobView, error) {
+	err := op(id)
+	if errors.Is(err, queue.ErrRunningElsewhere) {
+		// without a daemon, the process running the job is out of reach
+		return daemon.JobView{}, fmt.Errorf("%w, no daemon is running: stop the dr watch running it, or run the jobs with dr serve", err)
+	}
+	if err != nil {
+		return daemon.JobView{}, err
+	}
+
+	job, err := s.queue.Job(id)
+	if err != nil {
+		return daemon.JobView{}, err
+	}
+
+	return daemon.NewJobView(s.queue, job), nil
+}
+
+// Watch runs the watched job, or the whole queue when id is empty, and calls fn with every change of
+// the watched jobs, until none of them is queued or running anymore. Jobs still running when the
+// context is done are queued again.
+func (s *localService) Watch(ctx context.Context, id string, fn func(daemon.JobView) error) error {
+	if id != "" {
+		if _, err := s.queue.Job(id); err != nil {
+			return err
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		if id != "" {
+			// the other queued jobs are left for the daemon or a later run
+			done <- s.queue.RunJob(runCtx, id)
+			return
+		}
+		done <- s.queue.Run(runCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	ticker := time.NewTicker(daemon.DefaultEventInterval)
+	defer ticker.Stop()
+
+	sent := make(map[string]daemon.JobView)
+	for {
+		active := false
+		for _, job := range s.queue.Jobs() {
+			if id != "" && job.ID != id {
+				continue
+			}
+			if job.Status == queue.Queued || job.Status == queue.Running {
+				active = true
+			}
+
+			view := daemon.NewJobView(s.queue, job)
+			if prev, ok := sent[job.ID]; ok && sameView(prev, view) {
+				continue
+			}
+			sent[job.ID] = view
+
+			if err := fn(view); err != nil {
+				return err
+			}
+		}
+		if !active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func sameView(a, b daemon.JobView) bool {
+	if a.Status != b.Status || a.UpdatedAt != b.UpdatedAt || (a.Progress == nil) != (b.Progress == nil) {
+		return false
+	}
+
+	return a.Progress == nil || a.Progress.Downloaded == b.Progress.Downloaded
+}
+
+// errWatchDone stops watching a job once it's settled.
+var errWatchDone = errors.New("watch done")
+
+// watchJobs prints the changes of the jobs, or of the job with the given ID, until the
+// watched job is settled or the command is interrupted.
+func watchJobs(ctx context.Context, output io.Writer, svc jobService, id string) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var failed error
+	err := svc.Watch(ctx, id, func(view daemon.JobView) error {
+		fmt.Fprintln(output, formatJobLine(view))
+		if id == "" || view.Status == queue.Queued || view.Status == queue.Running {
+			return nil
+		}
+		if view.Status == queue.Failed {
+			failed = fmt.Errorf("job %s failed: %s", view.ID, view.Error)
+		}
+		return errWatchDone
+	})
+	if errors.Is(err, errWatchDone) || errors.Is(err, context.Canceled) {
+		err = nil
+	}
+
+	return errors.Join(err, failed)
+}
+
+func formatJobLine(view daemon.JobView) string {
+	line := fmt.Sprintf("%s  %-9s  %s", view.ID, view.Status, view.Entry.URL)
+	switch {
+	case view.Progress != nil:
+		line += "  " + view.Progress.String()
+	case view.Path != "":
+		line += "  " + view.Path
+	case view.Error != "":
+		line += "  " + strings.ReplaceAll(view.Error, "\n", "; ")
+	}
+
+	return line
+}
+
+func newAddCmd(output io.Writer) *cobra.Command {
+	var opts = &clientOptions{}
+	var req daemon.JobRequest
+	var watch bool
+
+	var cmd = &cobra.Command{
+		Use:   "add --url [ADDRESS]",
+		Short: "add a download to the queue of the daemon, or download it in-process when no daemon is running",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, remote, err := opts.service(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			// the daemon doesn't share the working directory of the command
+			if req.OutputDir != "" {
+				if req.OutputDir, err = filepath.Abs(req.OutputDir); err != nil {
+					return err
+				}
+			}
+
+			view, err := svc.Add(cmd.Context(), req)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(output, view.ID)
+			if remote && !watch {
+				return nil
+			}
+
+			return watchJobs(cmd.Context(), output, svc, view.ID)
+		},
+	}
+
+	cmd.Flags().StringVarP(&req.URL, "url", "u", "", "The remote file address to download.")
+	cmd.Flags().StringVarP(&req.OutputDir, "out", "o", "", "The local directory to save the file in.")
+	cmd.Flags().StringVarP(&req.Filename, "file", "f", "", "The downloaded file name.")
+	cmd.Flags().StringVar(&req.Checksum, "checksum", "", "The expected checksum of the file, e.g. sha256:<hex digest>.")
+	cmd.Flags().IntVarP(&req.Priority, "priority", "p", 0, "The priority of the download, higher priorities run first.")
+	cmd.Flags().BoolVarP(&watch, "watch", "w", false, "Follow the download until it's done, always the case when no daemon is running.")
+	opts.addFlags(cmd)
+
+	return cmd
+}
+
+func newListCmd(output io.Writer) *cobra.Command {
+	var opts = &clientOptions{}
+	var statuses []string
+
+	var cmd = &cobra.Command{
+		Use:   "ls",
+		Short: "list the downloads of the queue",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, _, err := opts.service(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			var filter []queue.Status
+			for _, status := range statuses {
+				filter = append(filter, queue.Status(status))
+			}
+			views, err := svc.Jobs(cmd.Context(), filter...)
+			if err != nil {
+				return err
+			}
+
+			return printJobs(output, views)
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&statuses, "status", nil, "Only list the downloads with the given statuses: queued, running, paused, completed, failed or canceled.")
+	opts.addFlags(cmd)
+
+	return cmd
+}
+
+func printJobs(output io.Writer, views []daemon.JobView) error {
+	tw := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tPRIORITY\tPROGRESS\tURL\tFILE\tERROR")
+	for _, view := range views {
+		var progress string
+		if view.Progress != nil {
+			progress = view.Progress.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", view.ID, view.Status, view.Priority, progress,
+			view.Entry.URL, view.Path, strings.ReplaceAll(view.Error, "\n", "; "))
+	}
+
+	return tw.Flush()
+}
+
+// newJobActionCmd returns a command applying the given operation to the jobs given as arguments.
+func newJobActionCmd(output io.Writer, name, short string, op func(jobService, context.Context, string) (daemon.JobView, error)) *cobra.Command {
+	var opts = &clientOptions{}
+
+	var cmd = &cobra.Command{
+		Use:   name + " [ID]...",
+		Short: short,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, _, err := opts.service(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			var errs []error
+			for _, id := range args {
+				view, err := op(svc, cmd.Context(), id)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				fmt.Fprintln(output, formatJobLine(view))
+			}
+
+			return errors.Join(errs...)
+		},
+	}
+	opts.addFlags(cmd)
+
+	return cmd
+}
+
+func newPauseCmd(output io.Writer) *cobra.Command {
+	return newJobActionCmd(output, "pause", "pause downloads of the queue", jobService.Pause)
+}
+
+func newCancelCmd(output io.Writer) *cobra.Command {
+	return newJobActionCmd(output, "cancel", "cancel downloads of the queue", jobService.Cancel)
+}
+
+func newWatchCmd(output io.Writer) *cobra.Command {
+	var opts = &clientOptions{}
+
+	var cmd = &cobra.Command{
+		Use:   "watch [ID]",
+		Short: "follow the progress of the downloads, or of a single one, running them in-process when no daemon is running",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			svc, _, err := opts.service(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			var id string
+			if len(args) > 0 {
+				id = args[0]
+			}
+
+			return watchJobs(cmd.Context(), output, svc, id)
+		},
+	}
+	opts.addFlags(cmd)
+
+	return cmd
+}
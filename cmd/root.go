@@ -13,6 +13,12 @@ func newRoot() *cobra.Command {
 	}
 
 	rootCmd.AddCommand(newDownloadCmd(os.Stdout))
+	rootCmd.AddCommand(newServeCmd(os.Stdout))
+	rootCmd.AddCommand(newAddCmd(os.Stdout))
+	rootCmd.AddCommand(newListCmd(os.Stdout))
+	rootCmd.AddCommand(newPauseCmd(os.Stdout))
+	rootCmd.AddCommand(newCancelCmd(os.Stdout))
+	rootCmd.AddCommand(newWatchCmd(os.Stdout))
 
 	return rootCmd
 }
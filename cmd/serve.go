@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/azhovan/durable-resume/pkg/daemon"
+	"github.com/azhovan/durable-resume/pkg/download"
+	"github.com/azhovan/durable-resume/pkg/queue"
+	"github.com/spf13/cobra"
+)
+
+type serveOptions struct {
+	addr      string
+	tokenFile string
+	queueFile string
+	dstDIR    string
+
+	concurrency int
+}
+
+func newServeCmd(output io.Writer) *cobra.Command {
+	var opts = &serveOptions{}
+
+	var cmd = &cobra.Command{
+		Use:   "serve",
+		Short: "run the downloader as a background service with a local HTTP API",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServe(cmd.Context(), output, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.addr, "addr", "", "The Unix socket path or loopback TCP address to listen on, defaults to a socket in the user config directory.")
+	cmd.Flags().StringVar(&opts.tokenFile, "token-file", "", "The file the token of the API is written to when listening on a TCP address, defaults to one in the user config directory.")
+	cmd.Flags().StringVar(&opts.queueFile, "queue-file", "", "The file the queue state is persisted to, defaults to the one used by the CLI.")
+	cmd.Flags().StringVarP(&opts.dstDIR, "out", "o", "", "The default local directory to save files in.")
+	cmd.Flags().IntVarP(&opts.concurrency, "concurrency", "c", queue.DefaultConcurrency, "The maximum number of files downloaded at the same time.")
+
+	return cmd
+}
+
+func runServe(ctx context.Context, output io.Writer, opts *serveOptions) error {
+	var err error
+	if opts.addr == "" {
+		if opts.addr, err = daemon.DefaultSocketPath(); err != nil {
+			return err
+		}
+	}
+	if opts.queueFile == "" {
+		if opts.queueFile, err = queue.DefaultPath(); err != nil {
+			return err
+		}
+	}
+
+	runner, err := download.NewBatch(nil, download.WithOutputDir(opts.dstDIR))
+	if err != nil {
+		return err
+	}
+	q, err := queue.New(opts.queueFile, queue.WithRunner(runner), queue.WithConcurrency(opts.concurrency))
+	if err != nil {
+		return err
+	}
+
+	l, err := daemon.Listen(opts.addr)
+	if err != nil {
+		return err
+	}
+
+	var serverOpts []daemon.Option
+	if !daemon.IsSocketPath(opts.addr) {
+		// unlike the socket, a TCP address is accessible to the other users and to the web pages
+		token, err := opts.token()
+		if err != nil {
+			l.Close() //nolint:errcheck
+			return err
+		}
+		serverOpts = append(serverOpts, daemon.WithToken(token))
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	queueDone := make(chan error, 1)
+	go func() {
+		queueDone <- q.Run(ctx)
+	}()
+
+	fmt.Fprintf(output, "Listening on %s\n", opts.addr)
+	err = daemon.NewServer(q, serverOpts...).Serve(ctx, l)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	stop()
+
+	return errors.Join(err, <-queueDone)
+}
+
+// token generates the token of the API and writes it to the token file, see daemon.NewToken.
+func (opts *serveOptions) token() (string, error) {
+	path := opts.tokenFile
+	if path == "" {
+		var err error
+		if path, err = daemon.DefaultTokenPath(); err != nil {
+			return "", err
+		}
+	}
+
+	return daemon.NewToken(path)
+}
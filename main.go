@@ -1,13 +1,20 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"os/exec"
 
 	"github.com/azhovan/durable-resume/cmd"
 )
 
 func main() {
 	if err := cmd.Execute(); err != nil {
+		// reflect the exit status of a failed hook command
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			os.Exit(exitErr.ExitCode())
+		}
 		os.Exit(1)
 	}
 }
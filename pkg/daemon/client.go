@@ -0,0 +1,281 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/azhovan/durable-resume/pkg/queue"
+)
+
+var ErrDaemonUnavailable = errors.New("daemon is not running")
+
+// APIError is an error returned by the daemon's API.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the queue error, or ErrUnauthorized, matching the status code, if any.
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return queue.ErrJobNotFound
+	case http.StatusConflict:
+		return queue.ErrInvalidTransition
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	default:
+		return nil
+	}
+}
+
+// Client talks to a daemon over its HTTP API.
+type Client struct {
+	// addr is the address the daemon listens on, see Listen.
+	addr string
+
+	baseURL    string
+	httpClient *http.Client
+
+	// token is sent with every request, see WithToken.
+	token string
+}
+
+// ClientOption defines a function type for configuring a Client instance.
+type ClientOption func(*Client)
+
+// WithClientToken is an option function that sets the token of the daemon, sent with every request.
+func WithClientToken(token string) ClientOption {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// NewClient creates a Client for the daemon listening on the given address, see Listen.
+func NewClient(addr string, options ...ClientOption) *Client {
+	c := &Client{addr: addr, baseURL: "http://" + addr}
+	for _, opt := range options {
+		opt(c)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return c.dial(ctx)
+	}
+	if IsSocketPath(addr) {
+		c.baseURL = "http://dr"
+	}
+	c.httpClient = &http.Client{Transport: transport}
+
+	return c
+}
+
+// Ping checks that the daemon is running, it returns ErrDaemonUnavailable otherwise.
+func (c *Client) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// Add submits a new job.
+func (c *Client) Add(ctx context.Context, req JobRequest) (JobView, error) {
+	var view JobView
+	err := c.do(ctx, http.MethodPost, "/jobs", req, &view)
+
+	return view, err
+}
+
+// Jobs returns the jobs with the given statuses, or all jobs when no status is given.
+func (c *Client) Jobs(ctx context.Context, statuses ...queue.Status) ([]JobView, error) {
+	query := url.Values{}
+	for _, status := range statuses {
+		query.Add("status", string(status))
+	}
+
+	var views []JobView
+	err := c.do(ctx, http.MethodGet, "/jobs?"+query.Encode(), nil, &views)
+
+	return views, err
+}
+
+// Job returns the job with the given ID.
+func (c *Client) Job(ctx context.Context, id string) (JobView, error) {
+	var view JobView
+	err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, &view)
+
+	return view, err
+}
+
+// Pause pauses a job.
+func (c *Client) Pause(ctx context.Context, id string) (JobView, error) {
+	return c.action(ctx, id, "pause")
+}
+
+// Resume resumes a paused job.
+func (c *Client) Resume(ctx context.Context, id string) (JobView, error) {
+	return c.action(ctx, id, "resume")
+}
+
+// Cancel cancels a job.
+func (c *Client) Cancel(ctx context.Context, id string) (JobView, error) {
+	return c.action(ctx, id, "cancel")
+}
+
+// Requeue queues a failed or canceled job again.
+func (c *Client) Requeue(ctx context.Context, id string) (JobView, error) {
+	return c.action(ctx, id, "requeue")
+}
+
+// Remove removes a job that is not running.
+func (c *Client) Remove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, nil)
+}
+
+// Watch calls fn with every change of the jobs, or of the job with the given ID when not empty,
+// until the context is done or fn returns an error, which is returned. Watching a single job
+// stops without error once the job is removed.
+func (c *Client) Watch(ctx context.Context, id string, fn func(JobView) error) error {
+	path := "/events"
+	if id != "" {
+		path += "?id=" + url.QueryEscape(id)
+	}
+
+	resp, err := c.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+
+		switch event {
+		case "job":
+			var view JobView
+			if err = json.Unmarshal([]byte(data), &view); err != nil {
+				return err
+			}
+			if err = fn(view); err != nil {
+				return err
+			}
+		case "removed":
+			if id != "" {
+				return nil
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+func (c *Client) action(ctx context.Context, id, action string) (JobView, error) {
+	var view JobView
+	err := c.do(ctx, http.MethodPost, "/jobs/"+url.PathEscape(id)+"/"+action, nil, &view)
+
+	return view, err
+}
+
+// do sends a request with the given body encoded as JSON, and decodes the response into out if not nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	resp, err := c.request(ctx, method, path, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// request sends a request to the daemon, a response with an error status is returned as an APIError.
+func (c *Client) request(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: resp.Status}
+	var msg struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&msg) == nil && msg.Error != "" {
+		apiErr.Message = msg.Error
+	}
+
+	return nil, apiErr
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	network := "tcp"
+	if IsSocketPath(c.addr) {
+		network = "unix"
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDaemonUnavailable, err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/azhovan/durable-resume/pkg/download"
+	"github.com/azhovan/durable-resume/pkg/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	release := make(chan struct{})
+	api, files := newTestAPI(t, release)
+	client := NewClient(strings.TrimPrefix(api.URL, "http://"))
+	ctx := context.Background()
+
+	assert.NoError(t, client.Ping(ctx))
+
+	job, err := client.Add(ctx, JobRequest{BatchEntry: download.BatchEntry{URL: files.URL + "/slow"}, Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, job.Priority)
+
+	_, err = client.Add(ctx, JobRequest{BatchEntry: download.BatchEntry{URL: "not a url"}})
+	var apiErr *APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	}
+
+	_, err = client.Pause(ctx, "unknown")
+	assert.ErrorIs(t, err, queue.ErrJobNotFound)
+
+	jobs, err := client.Jobs(ctx, queue.Queued, queue.Running)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+
+	close(release)
+	errDone := errors.New("done")
+	err = client.Watch(ctx, job.ID, func(view JobView) error {
+		if view.Status == queue.Completed {
+			return errDone
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errDone)
+
+	_, err = client.Cancel(ctx, job.ID)
+	assert.ErrorIs(t, err, queue.ErrInvalidTransition)
+	assert.NoError(t, client.Remove(ctx, job.ID))
+	_, err = client.Job(ctx, job.ID)
+	assert.ErrorIs(t, err, queue.ErrJobNotFound)
+}
+
+func TestClient_Unavailable(t *testing.T) {
+	ctx := context.Background()
+
+	client := NewClient(filepath.Join(t.TempDir(), "dr.sock"))
+	assert.ErrorIs(t, client.Ping(ctx), ErrDaemonUnavailable)
+
+	_, err := client.Jobs(ctx)
+	assert.ErrorIs(t, err, ErrDaemonUnavailable)
+}
+
+func TestClient_UnixSocket(t *testing.T) {
+	q, err := queue.New(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dr.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(q, WithToken("s3cr3t")).Serve(ctx, l)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the socket is only accessible to the user, the token isn't required
+	_, err = NewClient(path).Jobs(ctx)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,399 @@
+// Package daemon exposes a download queue over a local HTTP API, so that other tools
+// can submit and manage downloads of a long-running process.
+//
+// The API has the following endpoints:
+//
+//	POST   /jobs               submit a job, the body is a JobRequest
+//	GET    /jobs               list the jobs, optionally filtered by ?status=
+//	GET    /jobs/{id}          get a job and its progress
+//	POST   /jobs/{id}/pause    pause a job
+//	POST   /jobs/{id}/resume   resume a paused job
+//	POST   /jobs/{id}/cancel   cancel a job
+//	POST   /jobs/{id}/requeue  queue a failed or canceled job again
+//	DELETE /jobs/{id}          remove a job that is not running
+//	GET    /events             stream the changes of the jobs as server-sent events, optionally filtered by ?id=
+//
+// The request bodies are JSON and must be sent with Content-Type: application/json. On a TCP address, the
+// Host header must be a loopback one, and the requests must carry the token of the daemon, if any, in an
+// Authorization: Bearer header, see WithToken. This prevents web pages from submitting downloads.
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/azhovan/durable-resume/pkg/download"
+	"github.com/azhovan/durable-resume/pkg/queue"
+)
+
+var (
+	ErrNonLocalAddress = errors.New("the daemon only listens on loopback addresses")
+	ErrUnauthorized    = errors.New("missing or invalid token")
+)
+
+// DefaultEventInterval is the default interval the jobs are checked for changes at, for the event stream.
+const DefaultEventInterval = 500 * time.Millisecond
+
+// JobRequest is the body of a job submission.
+type JobRequest struct {
+	download.BatchEntry
+
+	// Priority determines the order jobs are run in, higher priorities run first.
+	Priority int `json:"priority"`
+}
+
+// JobView is a job as returned by the API.
+type JobView struct {
+	queue.Job
+
+	// Progress is the progress of the download, only set for running jobs.
+	Progress *download.ProgressSnapshot `json:"progress,omitempty"`
+}
+
+// NewJobView returns the view of a job of the given queue, with its progress when running.
+func NewJobView(q *queue.Queue, job queue.Job) JobView {
+	view := JobView{Job: job}
+	if progress, ok := q.Progress(job.ID); ok {
+		view.Progress = &progress
+	}
+
+	return view
+}
+
+// Server serves the HTTP API of a Queue.
+type Server struct {
+	queue *queue.Queue
+	mux   *http.ServeMux
+
+	// eventInterval is the interval the jobs are checked for changes at, for the event stream.
+	eventInterval time.Duration
+
+	// token is the token the requests must carry, see WithToken.
+	token string
+}
+
+// Option defines a function type for configuring a Server instance.
+type Option func(*Server)
+
+// WithEventInterval is an option function that sets the interval the jobs are checked for changes at, for the event stream.
+func WithEventInterval(d time.Duration) Option {
+	return func(s *Server) {
+		if d > 0 {
+			s.eventInterval = d
+		}
+	}
+}
+
+// WithToken is an option function that requires the requests sent over TCP to carry the given token,
+// in an Authorization: Bearer header. The requests sent over a Unix socket are not checked, the socket
+// is only accessible to the user.
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// NewServer creates a Server for the given queue. The queue is expected to be run by the caller.
+func NewServer(q *queue.Queue, options ...Option) *Server {
+	s := &Server{
+		queue:         q,
+		mux:           http.NewServeMux(),
+		eventInterval: DefaultEventInterval,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+
+	s.mux.HandleFunc("POST /jobs", s.submit)
+	s.mux.HandleFunc("GET /jobs", s.list)
+	s.mux.HandleFunc("GET /jobs/{id}", s.get)
+	s.mux.HandleFunc("POST /jobs/{id}/pause", s.action(q.Pause))
+	s.mux.HandleFunc("POST /jobs/{id}/resume", s.action(q.Resume))
+	s.mux.HandleFunc("POST /jobs/{id}/cancel", s.action(q.Cancel))
+	s.mux.HandleFunc("POST /jobs/{id}/requeue", s.action(q.Requeue))
+	s.mux.HandleFunc("DELETE /jobs/{id}", s.remove)
+	s.mux.HandleFunc("GET /events", s.events)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); !ok || addr.Network() != "unix" {
+		// a web page may reach the API through DNS rebinding, or send a request to it
+		if host, _, err := net.SplitHostPort(req.Host); err != nil || !isLoopback(host) {
+			writeError(wr, http.StatusForbidden, fmt.Errorf("%w: Host %q", ErrNonLocalAddress, req.Host))
+			return
+		}
+		auth, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte(s.token)) != 1 {
+			writeError(wr, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+	}
+
+	s.mux.ServeHTTP(wr, req)
+}
+
+// Serve serves the API on the given listener until the context is done.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		// the event streams are bound to the context, hence they're already closing
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+func (s *Server) submit(wr http.ResponseWriter, req *http.Request) {
+	// unlike a JSON one, a text/plain body can be sent by a web page without the consent of the server
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(wr, http.StatusUnsupportedMediaType, errors.New("the request body must be sent with Content-Type: application/json"))
+		return
+	}
+
+	var body JobRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(wr, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if err := body.Validate(); err != nil {
+		writeError(wr, http.StatusBadRequest, err)
+		return
+	}
+
+	job, err := s.queue.Enqueue(body.BatchEntry, body.Priority)
+	if err != nil {
+		writeError(wr, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(wr, http.StatusCreated, s.view(job))
+}
+
+func (s *Server) list(wr http.ResponseWriter, req *http.Request) {
+	var statuses []queue.Status
+	for _, status := range req.URL.Query()["status"] {
+		statuses = append(statuses, queue.Status(status))
+	}
+
+	views := []JobView{}
+	for _, job := range s.queue.Jobs(statuses...) {
+		views = append(views, s.view(job))
+	}
+
+	writeJSON(wr, http.StatusOK, views)
+}
+
+func (s *Server) get(wr http.ResponseWriter, req *http.Request) {
+	job, err := s.queue.Job(req.PathValue("id"))
+	if err != nil {
+		writeQueueError(wr, err)
+		return
+	}
+
+	writeJSON(wr, http.StatusOK, s.view(job))
+}
+
+// action returns a handler applying the given queue operation to the job, and returning the updated job.
+func (s *Server) action(op func(id string) error) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		id := req.PathValue("id")
+		if err := op(id); err != nil {
+			writeQueueError(wr, err)
+			return
+		}
+
+		s.get(wr, req)
+	}
+}
+
+func (s *Server) remove(wr http.ResponseWriter, req *http.Request) {
+	if err := s.queue.Remove(req.PathValue("id")); err != nil {
+		writeQueueError(wr, err)
+		return
+	}
+
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+// events streams the jobs as server-sent events. Every job is sent once when the stream starts,
+// then again every time its status or progress changes, as a "job" event. Removed jobs are sent
+// as a "removed" event.
+func (s *Server) events(wr http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	if id != "" {
+		if _, err := s.queue.Job(id); err != nil {
+			writeQueueError(wr, err)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(wr)
+	wr.Header().Set("Content-Type", "text/event-stream")
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(s.eventInterval)
+	defer ticker.Stop()
+
+	sent := make(map[string][]byte)
+	for {
+		seen := make(map[string]bool)
+		for _, job := range s.queue.Jobs() {
+			if id != "" && job.ID != id {
+				continue
+			}
+			seen[job.ID] = true
+
+			data, err := json.Marshal(s.view(job))
+			if err != nil {
+				return
+			}
+			if string(data) == string(sent[job.ID]) {
+				continue
+			}
+			sent[job.ID] = data
+
+			if _, err = fmt.Fprintf(wr, "event: job\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+
+		for jobID := range sent {
+			if seen[jobID] {
+				continue
+			}
+			delete(sent, jobID)
+
+			if _, err := fmt.Fprintf(wr, "event: removed\ndata: {\"id\":%q}\n\n", jobID); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) view(job queue.Job) JobView {
+	return NewJobView(s.queue, job)
+}
+
+func writeJSON(wr http.ResponseWriter, status int, v any) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	_ = json.NewEncoder(wr).Encode(v)
+}
+
+func writeError(wr http.ResponseWriter, status int, err error) {
+	writeJSON(wr, status, map[string]string{"error": err.Error()})
+}
+
+// writeQueueError writes an error returned by the queue with the matching status code.
+func writeQueueError(wr http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, queue.ErrJobNotFound):
+		writeError(wr, http.StatusNotFound, err)
+	case errors.Is(err, queue.ErrInvalidTransition):
+		writeError(wr, http.StatusConflict, err)
+	default:
+		writeError(wr, http.StatusInternalServerError, err)
+	}
+}
+
+// DefaultSocketPath returns the default location of the daemon's Unix socket.
+func DefaultSocketPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "durable-resume", "dr.sock"), nil
+}
+
+// Listen listens on the given address, a path is a Unix socket and anything else a TCP address,
+// e.g. localhost:7070. TCP addresses must be loopback ones, the API is authenticated with a token at most,
+// see WithToken.
+// A stale socket file left by a daemon that didn't exit cleanly is removed.
+func Listen(addr string) (net.Listener, error) {
+	if !IsSocketPath(addr) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !isLoopback(host) {
+			return nil, fmt.Errorf("%w: %s", ErrNonLocalAddress, addr)
+		}
+
+		return net.Listen("tcp", addr)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(addr), 0o700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(addr); err == nil {
+		if conn, err := net.Dial("unix", addr); err == nil {
+			conn.Close() //nolint:errcheck
+			return nil, fmt.Errorf("a daemon is already listening on %s", addr)
+		}
+		if err = os.Remove(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(addr, 0o600); err != nil {
+		l.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// IsSocketPath reports whether the address is the path of a Unix socket rather than a TCP address.
+func IsSocketPath(addr string) bool {
+	return strings.ContainsRune(addr, filepath.Separator) || strings.HasSuffix(addr, ".sock")
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
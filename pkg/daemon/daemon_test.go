@@ -0,0 +1,269 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azhovan/durable-resume/pkg/download"
+	"github.com/azhovan/durable-resume/pkg/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAPI runs a queue downloading from a local file server, and serves its API.
+// Requests to /slow block until release is closed.
+func newTestAPI(t *testing.T, release chan struct{}, options ...Option) (api *httptest.Server, files *httptest.Server) {
+	files = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" && req.Method == http.MethodGet {
+			select {
+			case <-release:
+			case <-req.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(wr, req, "hello.txt", time.Time{}, strings.NewReader("hello world"))
+	}))
+	t.Cleanup(files.Close)
+
+	runner, err := download.NewBatch(nil,
+		download.WithOutputDir(t.TempDir()),
+		download.WithBatchRetryPolicy(func() *download.RetryPolicy { return download.NewRetryPolicy(1) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := queue.New(filepath.Join(t.TempDir(), "queue.json"), queue.WithRunner(runner))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = q.Run(ctx)
+		close(done)
+	}()
+
+	api = httptest.NewServer(NewServer(q, append([]Option{WithEventInterval(10 * time.Millisecond)}, options...)...))
+	t.Cleanup(func() {
+		api.Close()
+		cancel()
+		<-done
+	})
+
+	return api, files
+}
+
+func do(t *testing.T, method, url, body string, v any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	return resp.StatusCode
+}
+
+// waitFor polls the job until it has the given status.
+func waitFor(t *testing.T, api *httptest.Server, id string, status queue.Status) JobView {
+	t.Helper()
+
+	var view JobView
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		view = JobView{}
+		if do(t, http.MethodGet, api.URL+"/jobs/"+id, "", &view) == http.StatusOK && view.Status == status {
+			return view
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s is %s, want %s", id, view.Status, status)
+	return view
+}
+
+func TestServer_Jobs(t *testing.T) {
+	release := make(chan struct{})
+	api, files := newTestAPI(t, release)
+
+	var job JobView
+	status := do(t, http.MethodPost, api.URL+"/jobs", `{"url":"`+files.URL+`/slow","priority":3}`, &job)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, 3, job.Priority)
+
+	job = waitFor(t, api, job.ID, queue.Running)
+	assert.NotNil(t, job.Progress)
+
+	var jobs []JobView
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, api.URL+"/jobs?status=running", "", &jobs))
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, api.URL+"/jobs?status=failed", "", &jobs))
+	assert.Empty(t, jobs)
+
+	assert.Equal(t, http.StatusConflict, do(t, http.MethodDelete, api.URL+"/jobs/"+job.ID, "", nil))
+
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, api.URL+"/jobs/"+job.ID+"/pause", "", nil))
+	waitFor(t, api, job.ID, queue.Paused)
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, api.URL+"/jobs/"+job.ID+"/resume", "", nil))
+	waitFor(t, api, job.ID, queue.Running)
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, api.URL+"/jobs/"+job.ID+"/cancel", "", nil))
+	waitFor(t, api, job.ID, queue.Canceled)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, api.URL+"/jobs/"+job.ID+"/requeue", "", nil))
+	job = waitFor(t, api, job.ID, queue.Completed)
+	assert.NotEmpty(t, job.Path)
+	assert.Nil(t, job.Progress)
+
+	assert.Equal(t, http.StatusNoContent, do(t, http.MethodDelete, api.URL+"/jobs/"+job.ID, "", nil))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, api.URL+"/jobs/"+job.ID, "", nil))
+}
+
+func TestServer_InvalidRequests(t *testing.T) {
+	api, _ := newTestAPI(t, nil)
+
+	var body map[string]string
+	assert.Equal(t, http.StatusBadRequest, do(t, http.MethodPost, api.URL+"/jobs", `{"url":"not a url"}`, &body))
+	assert.Contains(t, body["error"], "invalid url")
+	assert.Equal(t, http.StatusBadRequest, do(t, http.MethodPost, api.URL+"/jobs", `{"url":"http://example.com","checksum":"md5:xyz"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, do(t, http.MethodPost, api.URL+"/jobs", `{`, nil))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodPost, api.URL+"/jobs/unknown/pause", "", nil))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, api.URL+"/events?id=unknown", "", nil))
+}
+
+func TestServer_CrossOriginRequests(t *testing.T) {
+	api, files := newTestAPI(t, nil, WithToken("s3cr3t"))
+	submit := func(host, contentType, token string) int {
+		req, err := http.NewRequest(http.MethodPost, api.URL+"/jobs", strings.NewReader(`{"url":"`+files.URL+`/hello.txt"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() //nolint:errcheck
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, submit("attacker.example:7070", "application/json", "s3cr3t"), "DNS rebinding")
+	assert.Equal(t, http.StatusUnauthorized, submit("", "application/json", ""))
+	assert.Equal(t, http.StatusUnauthorized, submit("", "application/json", "guess"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, submit("", "text/plain", "s3cr3t"))
+	assert.Equal(t, http.StatusCreated, submit("localhost:7070", "application/json; charset=utf-8", "s3cr3t"))
+
+	client := NewClient(strings.TrimPrefix(api.URL, "http://"), WithClientToken("s3cr3t"))
+	jobs, err := client.Jobs(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1, "only the authorized submission is queued")
+
+	_, err = NewClient(strings.TrimPrefix(api.URL, "http://")).Jobs(context.Background())
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestServer_Events(t *testing.T) {
+	release := make(chan struct{})
+	api, files := newTestAPI(t, release)
+
+	var job JobView
+	do(t, http.MethodPost, api.URL+"/jobs", `{"url":"`+files.URL+`/slow"}`, &job)
+
+	resp, err := http.Get(api.URL + "/events?id=" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	close(release)
+
+	var statuses []queue.Status
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event JobView
+		assert.NoError(t, json.Unmarshal([]byte(data), &event))
+		assert.Equal(t, job.ID, event.ID)
+		if len(statuses) == 0 || statuses[len(statuses)-1] != event.Status {
+			statuses = append(statuses, event.Status)
+		}
+		if event.Status == queue.Completed {
+			break
+		}
+	}
+
+	assert.Contains(t, statuses, queue.Completed)
+}
+
+func TestListen(t *testing.T) {
+	_, err := Listen("0.0.0.0:0")
+	assert.ErrorIs(t, err, ErrNonLocalAddress)
+
+	l, err := Listen("127.0.0.1:0")
+	if assert.NoError(t, err) {
+		l.Close() //nolint:errcheck
+	}
+
+	path := filepath.Join(t.TempDir(), "dr.sock")
+	l, err = Listen(path)
+	if assert.NoError(t, err) {
+		_, err = Listen(path)
+		assert.Error(t, err)
+		l.Close() //nolint:errcheck
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "durable-resume", "token")
+
+	token, err := NewToken(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, token, 64)
+
+	fi, err := os.Stat(path)
+	if assert.NoError(t, err) && runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+
+	got, err := ReadToken(path)
+	assert.NoError(t, err)
+	assert.Equal(t, token, got)
+
+	other, err := NewToken(path)
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, other, "a new token replaces the previous one")
+}
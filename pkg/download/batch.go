@@ -0,0 +1,372 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BatchEntry describes a single download of a batch.
+type BatchEntry struct {
+	// URL is the address of the file to download.
+	URL string `json:"url" yaml:"url"`
+
+	// Filename is the name of the downloaded file, resolved from the server response when empty.
+	Filename string `json:"filename,omitempty" yaml:"filename,omitempty"`
+
+	// Checksum is the expected digest of the downloaded file, in the <algorithm>:<hex digest> form.
+	Checksum string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+
+	// Headers are additional HTTP headers sent with every request of this download.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+
+	// OutputDir is the directory the file is saved in, it defaults to the batch output directory.
+	OutputDir string `json:"output_dir,omitempty" yaml:"output_dir,omitempty"`
+
+	// Mirrors are additional URLs of the same file, see WithMirrors.
+	Mirrors []string `json:"mirrors,omitempty" yaml:"mirrors,omitempty"`
+
+	// DownloaderOptions are applied to the Downloader of this download, after the ones of the batch.
+	// Like ManagerOptions, they're set by code, e.g. for the files of a metalink document, see MetalinkFile.BatchEntry.
+	DownloaderOptions []DownloaderOption `json:"-" yaml:"-"`
+
+	// ManagerOptions are applied to the DownloadManager of this download, after the ones of the batch.
+	ManagerOptions []DownloadManagerOption `json:"-" yaml:"-"`
+}
+
+// ParseBatchFile reads the batch entries from the file at the given path.
+// Files with the .json, .yaml or .yml extension contain a list of BatchEntry objects,
+// any other file is read as a plain list of URLs, one per line, where blank lines
+// and lines starting with # are ignored.
+func ParseBatchFile(path string) ([]BatchEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var entries []BatchEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.NewDecoder(f).Decode(&entries)
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(f).Decode(&entries)
+		if err == io.EOF {
+			err = nil
+		}
+	default:
+		entries, err = parseURLList(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for i, entry := range entries {
+		if err = entry.Validate(); err != nil {
+			return nil, fmt.Errorf("parsing %s: entry %d: %w", path, i+1, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// Validate checks the URLs and the checksum of the entry.
+func (e BatchEntry) Validate() error {
+	if _, err := url.ParseRequestURI(e.URL); err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	for _, mirror := range e.Mirrors {
+		if _, err := url.ParseRequestURI(mirror); err != nil {
+			return fmt.Errorf("invalid mirror: %w", err)
+		}
+	}
+	if e.Checksum != "" {
+		if _, err := ParseChecksum(e.Checksum); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseURLList(r io.Reader) ([]BatchEntry, error) {
+	var entries []BatchEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, BatchEntry{URL: line})
+	}
+
+	return entries, scanner.Err()
+}
+
+// BatchStatus is the outcome of a single download of a batch.
+type BatchStatus string
+
+const (
+	BatchSucceeded BatchStatus = "succeeded"
+	BatchFailed    BatchStatus = "failed"
+	BatchSkipped   BatchStatus = "skipped"
+)
+
+// BatchResult is the result of a single download of a batch.
+type BatchResult struct {
+	// Entry is the batch entry the result belongs to.
+	Entry BatchEntry
+
+	// Status is the outcome of the download.
+	Status BatchStatus
+
+	// Path is the final path of the downloaded file, it's empty for failed downloads.
+	Path string
+
+	// Duration is the time spent on the download.
+	Duration time.Duration
+
+	// Err is the error a failed download ended with.
+	Err error
+}
+
+// DefaultBatchConcurrency is the default number of downloads of a batch that run at the same time.
+const DefaultBatchConcurrency = 4
+
+// Batch runs many downloads, each with its own DownloadManager, under a global concurrency limit.
+// All the downloads share a single Client, hence a single connection pool.
+type Batch struct {
+	// Entries are the downloads of the batch.
+	Entries []BatchEntry
+
+	// Concurrency is the maximum number of downloads running at the same time.
+	Concurrency int
+
+	// OutputDir is the directory files are saved in, unless an entry specifies its own.
+	OutputDir string
+
+	// Client is shared by all downloads of the batch.
+	Client *Client
+
+	// NewRetryPolicy creates the retry policy of each download.
+	NewRetryPolicy func() *RetryPolicy
+
+	// DownloaderOptions are applied to the Downloader of every entry.
+	DownloaderOptions []DownloaderOption
+
+	// ManagerOptions are applied to the DownloadManager of every entry.
+	ManagerOptions []DownloadManagerOption
+
+	// SegmentOptions are used for the download of every entry.
+	SegmentOptions []SegmentManagerOption
+}
+
+// BatchOption defines a function type for configuring a Batch instance.
+type BatchOption func(*Batch)
+
+// NewBatch creates a new Batch for the given entries.
+// Additional configuration options can be provided to customize the Batch's behavior.
+func NewBatch(entries []BatchEntry, options ...BatchOption) (*Batch, error) {
+	client, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Batch{
+		Entries:        entries,
+		Concurrency:    DefaultBatchConcurrency,
+		Client:         client,
+		NewRetryPolicy: DefaultRetryPolicy,
+	}
+	for _, opt := range options {
+		opt(b)
+	}
+
+	return b, nil
+}
+
+// WithConcurrency is an option function that sets the maximum number of downloads running at the same time.
+func WithConcurrency(n int) BatchOption {
+	return func(b *Batch) {
+		if n > 0 {
+			b.Concurrency = n
+		}
+	}
+}
+
+// WithOutputDir is an option function that sets the default output directory of the batch.
+func WithOutputDir(dir string) BatchOption {
+	return func(b *Batch) {
+		b.OutputDir = dir
+	}
+}
+
+// WithBatchClient is an option function that sets the Client shared by all downloads of the batch.
+func WithBatchClient(client *Client) BatchOption {
+	return func(b *Batch) {
+		b.Client = client
+	}
+}
+
+// WithBatchRetryPolicy is an option function that sets the function creating the retry policy of each download.
+func WithBatchRetryPolicy(newRetryPolicy func() *RetryPolicy) BatchOption {
+	return func(b *Batch) {
+		b.NewRetryPolicy = newRetryPolicy
+	}
+}
+
+// WithDownloaderOptions is an option function that adds options applied to the Downloader of every entry.
+func WithDownloaderOptions(options ...DownloaderOption) BatchOption {
+	return func(b *Batch) {
+		b.DownloaderOptions = append(b.DownloaderOptions, options...)
+	}
+}
+
+// WithManagerOptions is an option function that adds options applied to the DownloadManager of every entry.
+func WithManagerOptions(options ...DownloadManagerOption) BatchOption {
+	return func(b *Batch) {
+		b.ManagerOptions = append(b.ManagerOptions, options...)
+	}
+}
+
+// WithSegmentOptions is an option function that adds options used for the download of every entry.
+func WithSegmentOptions(options ...SegmentManagerOption) BatchOption {
+	return func(b *Batch) {
+		b.SegmentOptions = append(b.SegmentOptions, options...)
+	}
+}
+
+// Run downloads all the entries of the batch and returns a result per entry, in the order of the entries.
+// A download that fails doesn't stop the others.
+func (b *Batch) Run(ctx context.Context) []BatchResult {
+	results := make([]BatchResult, len(b.Entries))
+
+	sem := make(chan struct{}, max(b.Concurrency, 1))
+	wg := &sync.WaitGroup{}
+	for i, entry := range b.Entries {
+		wg.Add(1)
+		go func(i int, entry BatchEntry) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = BatchResult{Entry: entry, Status: BatchFailed, Err: ctx.Err()}
+				return
+			}
+
+			results[i] = b.Download(ctx, entry)
+		}(i, entry)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Download downloads a single entry with the settings of the batch, the entry doesn't need to be part of it.
+// The given options are applied to the DownloadManager of the entry, after the ones of the batch and the entry.
+// The entry is skipped when its file already exists, see existing.
+func (b *Batch) Download(ctx context.Context, entry BatchEntry, options ...DownloadManagerOption) BatchResult {
+	start := time.Now()
+	result := BatchResult{Entry: entry, Status: BatchFailed}
+
+	dir := entry.OutputDir
+	if dir == "" {
+		dir = b.OutputDir
+	}
+
+	var checksum Checksum
+	if entry.Checksum != "" {
+		var err error
+		if checksum, err = ParseChecksum(entry.Checksum); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	if path, ok := b.existing(dir, entry, checksum); ok {
+		result.Status, result.Path = BatchSkipped, path
+		return result
+	}
+
+	dlOpts := append([]DownloaderOption{
+		WithClient(b.Client),
+		WithFileName(entry.Filename),
+		WithMirrors(entry.Mirrors...),
+	}, b.DownloaderOptions...)
+	dlOpts = append(dlOpts, entry.DownloaderOptions...)
+	// the headers of the entry take precedence over the ones of the batch
+	for name, value := range entry.Headers {
+		dlOpts = append(dlOpts, WithHeader(name, value))
+	}
+
+	downloader, err := NewDownloader(dir, entry.URL, dlOpts...)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// the checksum is verified before the downloaded file is post-processed, e.g. extracted
+	var dmOpts []DownloadManagerOption
+	if entry.Checksum != "" {
+		dmOpts = append(dmOpts, WithVerifier(VerifyChecksum(checksum)))
+	}
+	dmOpts = append(dmOpts, b.ManagerOptions...)
+	dmOpts = append(dmOpts, entry.ManagerOptions...)
+	dmOpts = append(dmOpts, options...)
+
+	dm := NewDownloadManager(downloader, b.NewRetryPolicy(), dmOpts...)
+	res, err := dm.Download(ctx, b.SegmentOptions...)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Status, result.Path = BatchSucceeded, res.Path
+
+	return result
+}
+
+// existing returns the path of the entry's file when it has already been downloaded, in which case the
+// entry is skipped. Only names known upfront are considered, i.e. the entry's file name or the last
+// element of the URL path. When the entry has a checksum, the existing file must match it.
+func (b *Batch) existing(dir string, entry BatchEntry, checksum Checksum) (string, bool) {
+	name := entry.Filename
+	if name == "" {
+		if u, err := url.Parse(entry.URL); err == nil {
+			name = filenameFromURL(u)
+		}
+	}
+	if name == "" {
+		return "", false
+	}
+
+	path, err := SafeJoin(defaultDir(dir), name)
+	if err != nil {
+		return "", false
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+
+	if checksum.Algorithm != "" {
+		_, hashes, err := hashFile(path)
+		if err != nil || checksum.Verify(hashes) != nil {
+			return "", false
+		}
+	}
+
+	return path, true
+}
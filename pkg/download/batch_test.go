@@ -0,0 +1,220 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBatchFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"urls.txt": "# nightly exports\nhttps://example.com/a.csv\n\nhttps://example.com/b.csv\n",
+		"urls.json": `[
+			{"url": "https://example.com/a.csv", "filename": "first.csv", "headers": {"X-Token": "secret"}},
+			{"url": "https://example.com/b.csv", "output_dir": "/data"}
+		]`,
+		"urls.yaml": `
+- url: https://example.com/a.csv
+  filename: first.csv
+  headers:
+    X-Token: secret
+- url: https://example.com/b.csv
+  output_dir: /data
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+			entries, err := ParseBatchFile(path)
+			if assert.NoError(t, err) && assert.Len(t, entries, 2) {
+				assert.Equal(t, "https://example.com/a.csv", entries[0].URL)
+				assert.Equal(t, "https://example.com/b.csv", entries[1].URL)
+				if name != "urls.txt" {
+					assert.Equal(t, "first.csv", entries[0].Filename)
+					assert.Equal(t, "secret", entries[0].Headers["X-Token"])
+					assert.Equal(t, "/data", entries[1].OutputDir)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid entry", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`[{"url": "https://example.com/a.csv", "checksum": "crc:1"}]`), 0o644))
+
+		_, err := ParseBatchFile(path)
+		assert.Error(t, err)
+	})
+}
+
+func TestBatch_Run(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		switch req.URL.Path {
+		case "/missing.txt":
+			http.NotFound(wr, req)
+		case "/private.txt":
+			if req.Header.Get("X-Token") != "secret" {
+				wr.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fallthrough
+		default:
+			http.ServeContent(wr, req, "hello.txt", time.Time{}, strings.NewReader("hello world"))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("already here"), 0o644))
+
+	entries := []BatchEntry{
+		{URL: server.URL + "/hello.txt", Checksum: "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+		{URL: server.URL + "/missing.txt"},
+		{URL: server.URL + "/existing.txt"},
+		{URL: server.URL + "/private.txt", Headers: map[string]string{"X-Token": "secret"}},
+		{URL: server.URL + "/corrupted.txt", Checksum: "md5:00000000000000000000000000000000"},
+		{URL: server.URL + "/other.txt", OutputDir: filepath.Join(dir, "other")},
+	}
+
+	batch, err := NewBatch(entries,
+		WithOutputDir(dir),
+		WithConcurrency(2),
+		WithBatchRetryPolicy(func() *RetryPolicy { return NewRetryPolicy(1) }),
+	)
+	if assert.NoError(t, err) {
+		results := batch.Run(context.Background())
+		if assert.Len(t, results, len(entries)) {
+			assert.Equal(t, BatchSucceeded, results[0].Status)
+			assert.Equal(t, filepath.Join(dir, "hello.txt"), results[0].Path)
+
+			assert.Equal(t, BatchFailed, results[1].Status)
+			assert.Error(t, results[1].Err)
+
+			assert.Equal(t, BatchSkipped, results[2].Status)
+
+			assert.Equal(t, BatchSucceeded, results[3].Status, results[3].Err)
+
+			assert.Equal(t, BatchFailed, results[4].Status)
+			assert.ErrorIs(t, results[4].Err, ErrChecksumMismatch)
+
+			assert.Equal(t, BatchSucceeded, results[5].Status)
+			assert.FileExists(t, filepath.Join(dir, "other", "other.txt"))
+		}
+		assert.LessOrEqual(t, maxRunning.Load(), int32(2))
+	}
+}
+
+func TestBatch_DefaultOutputDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the default directory is /tmp")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader("hello world"))
+	}))
+	defer server.Close()
+
+	// the files are written to /tmp, their names are unique to this run
+	prefix := fmt.Sprintf("dr-default-dir-%d-", time.Now().UnixNano())
+	existing, created := filepath.Join("/tmp", prefix+"existing.txt"), filepath.Join("/tmp", prefix+"new.txt")
+	t.Cleanup(func() {
+		_ = os.Remove(existing)
+		_ = os.Remove(created)
+	})
+	assert.NoError(t, os.WriteFile(existing, []byte("already here"), 0o644))
+
+	batch, err := NewBatch([]BatchEntry{
+		{URL: server.URL + "/" + filepath.Base(existing)},
+		{URL: server.URL + "/" + filepath.Base(created)},
+	}, WithBatchRetryPolicy(func() *RetryPolicy { return NewRetryPolicy(1) }))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	results := batch.Run(context.Background())
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, BatchSkipped, results[0].Status)
+		assert.Equal(t, existing, results[0].Path)
+
+		assert.Equal(t, BatchSucceeded, results[1].Status, results[1].Err)
+		assert.Equal(t, created, results[1].Path, "the file is written where existing looks for it")
+	}
+}
+
+func TestBatch_VerifiedBeforeExtraction(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "release.tar.gz")
+	writeTarGz(t, archive, []archiveEntry{{name: "bin/app", body: "#!/bin/sh"}})
+	content, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hashes, err := hashFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		http.ServeContent(wr, req, "release.tar.gz", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		checksum string
+		valid    bool
+	}{
+		{name: "matching checksum", checksum: "sha256:" + hashes["sha256"], valid: true},
+		{name: "mismatching checksum", checksum: "sha256:" + strings.Repeat("0", 64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, target := t.TempDir(), t.TempDir()
+			batch, err := NewBatch(nil,
+				WithOutputDir(out),
+				WithManagerOptions(WithPostProcessor(NewExtractor(target))),
+				WithBatchRetryPolicy(func() *RetryPolicy { return NewRetryPolicy(1) }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := batch.Download(context.Background(), BatchEntry{URL: server.URL + "/release.tar.gz", Checksum: tt.checksum})
+			if tt.valid {
+				assert.Equal(t, BatchSucceeded, result.Status, result.Err)
+				assert.FileExists(t, filepath.Join(target, "bin", "app"))
+				return
+			}
+
+			assert.ErrorIs(t, result.Err, ErrChecksumMismatch)
+			assert.NoFileExists(t, filepath.Join(target, "bin", "app"), "a mismatching archive is not extracted")
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// supportedChecksums lists the hash algorithms computed for every downloaded file, see hashFile.
+var supportedChecksums = map[string]int{
+	"md5":    32,
+	"sha256": 64,
+}
+
+// Checksum is an expected digest of a downloaded file.
+type Checksum struct {
+	// Algorithm is the name of the hash algorithm, md5 or sha256.
+	Algorithm string
+
+	// Value is the hex encoded digest.
+	Value string
+}
+
+// ParseChecksum parses a checksum given in the <algorithm>:<hex digest> form, e.g. sha256:2c26b4...
+// When the algorithm is omitted, it is inferred from the length of the digest.
+func ParseChecksum(s string) (Checksum, error) {
+	algorithm, value, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		algorithm, value = "", algorithm
+	}
+	algorithm, value = strings.ToLower(algorithm), strings.ToLower(value)
+
+	if algorithm == "" {
+		for name, size := range supportedChecksums {
+			if len(value) == size {
+				algorithm = name
+			}
+		}
+	}
+
+	size, ok := supportedChecksums[algorithm]
+	if !ok {
+		return Checksum{}, &InvalidParamError{param: "checksum", message: fmt.Sprintf("unsupported algorithm in %q", s)}
+	}
+	if len(value) != size || strings.Trim(value, "0123456789abcdef") != "" {
+		return Checksum{}, &InvalidParamError{param: "checksum", message: fmt.Sprintf("malformed %s digest %q", algorithm, value)}
+	}
+
+	return Checksum{Algorithm: algorithm, Value: value}, nil
+}
+
+func (c Checksum) String() string {
+	return c.Algorithm + ":" + c.Value
+}
+
+// Verify compares the checksum with the given hashes, as computed for a downloaded file.
+func (c Checksum) Verify(hashes map[string]string) error {
+	if got := hashes[c.Algorithm]; got != c.Value {
+		return fmt.Errorf("%w: expected %s, got %s:%s", ErrChecksumMismatch, c, c.Algorithm, got)
+	}
+
+	return nil
+}
+
+// VerifyChecksum returns a Hook that fails the download with ErrChecksumMismatch
+// when the downloaded file doesn't match the given checksum, see WithVerifier.
+func VerifyChecksum(checksum Checksum) Hook {
+	return func(_ context.Context, info DownloadInfo) error {
+		return checksum.Verify(info.Hashes)
+	}
+}
@@ -0,0 +1,44 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksum(t *testing.T) {
+	const sha = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	tests := []struct {
+		given   string
+		want    Checksum
+		wantErr bool
+	}{
+		{given: "sha256:" + sha, want: Checksum{Algorithm: "sha256", Value: sha}},
+		{given: "SHA256:B94D27B9934D3E08A52E52D7DA7DABFAC484EFE37A5380EE9088F7ACE2EFCDE9", want: Checksum{Algorithm: "sha256", Value: sha}},
+		{given: sha, want: Checksum{Algorithm: "sha256", Value: sha}},
+		{given: "5eb63bbbe01eeed093cb22bb8f5acdc3", want: Checksum{Algorithm: "md5", Value: "5eb63bbbe01eeed093cb22bb8f5acdc3"}},
+		{given: "sha1:2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", wantErr: true},
+		{given: "sha256:xyz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.given, func(t *testing.T) {
+			got, err := ParseChecksum(tt.given)
+			if tt.wantErr {
+				var paramErr *InvalidParamError
+				assert.ErrorAs(t, err, &paramErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		checksum := Checksum{Algorithm: "sha256", Value: sha}
+		assert.NoError(t, checksum.Verify(map[string]string{"sha256": sha}))
+		assert.ErrorIs(t, checksum.Verify(map[string]string{"sha256": "abc"}), ErrChecksumMismatch)
+	})
+}
@@ -1,6 +1,7 @@
 package download
 
 import (
+	"context"
 	"errors"
 	"net/http"
 )
@@ -10,6 +11,9 @@ type Client struct {
 	httpClient *http.Client
 
 	auth AuthStrategy
+
+	// transport configures the transport of the http client when set, see transportConfig.
+	transport *transportConfig
 }
 
 var (
@@ -17,6 +21,8 @@ var (
 )
 
 // NewClient creates a new instance of the Client struct with the provided server URL and options.
+// Without any transport option, e.g. WithConnectTimeout or WithProxy, the http client is used as is,
+// http.DefaultClient by default. Otherwise, the client is copied with a configured clone of its transport.
 func NewClient(options ...ClientOption) (*Client, error) {
 	client := &Client{
 		httpClient: http.DefaultClient,
@@ -26,9 +32,28 @@ func NewClient(options ...ClientOption) (*Client, error) {
 		opt(client)
 	}
 
+	if client.transport != nil {
+		httpClient, err := client.transport.apply(client.httpClient)
+		if err != nil {
+			return nil, err
+		}
+		client.httpClient = httpClient
+	}
+
 	return client, nil
 }
 
+// NewHTTPClient returns the http client of a Client created with the given options, e.g. to send
+// the token requests of OAuth2 through the same proxy, with the same TLS configuration and timeouts.
+func NewHTTPClient(options ...ClientOption) (*http.Client, error) {
+	client, err := NewClient(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.httpClient, nil
+}
+
 // ClientOption represents a function that configures a Client.
 //
 // When creating a new Client using the NewClient function, you can
@@ -58,10 +83,22 @@ func WithAuth(auth AuthStrategy) ClientOption {
 
 // AuthStrategy represents an interface for applying authentication to an HTTP request.
 //
-// The Apply method takes a *http.Request argument and modifies it to include any necessary
-// authentication headers or other credentials.
+// The Apply method is called before every request is sent, including the retries, with the context of
+// the request. It modifies the request to include any necessary authentication headers or other
+// credentials, an error aborts the request.
 type AuthStrategy interface {
-	Apply(req *http.Request)
+	Apply(ctx context.Context, req *http.Request) error
+}
+
+// Reauthenticator is an AuthStrategy that can recover from a 401 Unauthorized response, e.g. by
+// refreshing an expired token.
+//
+// The Reauthenticate method is called with the 401 Unauthorized response to a request authenticated
+// by the strategy. It reports whether the request should be sent once more, authenticated by a new
+// call to Apply. The response body must not be read nor closed.
+type Reauthenticator interface {
+	AuthStrategy
+	Reauthenticate(ctx context.Context, resp *http.Response) (bool, error)
 }
 
 var _ AuthStrategy = (*BasicAuth)(nil)
@@ -73,8 +110,9 @@ type BasicAuth struct {
 	username, password string
 }
 
-func (b *BasicAuth) Apply(req *http.Request) {
+func (b *BasicAuth) Apply(_ context.Context, req *http.Request) error {
 	req.SetBasicAuth(b.username, b.password)
+	return nil
 }
 
 // BearerToken represents Bearer Token (like JWT) authentication credentials.
@@ -82,8 +120,9 @@ type BearerToken struct {
 	Token string
 }
 
-func (b *BearerToken) Apply(req *http.Request) {
+func (b *BearerToken) Apply(_ context.Context, req *http.Request) error {
 	req.Header.Set("Authorization", "Bearer "+b.Token)
+	return nil
 }
 
 // APIToken represents an API token that consists of an API key and an API token string.
@@ -91,6 +130,7 @@ type APIToken struct {
 	APIKey, APIToken string
 }
 
-func (a *APIToken) Apply(req *http.Request) {
+func (a *APIToken) Apply(_ context.Context, req *http.Request) error {
 	req.Header.Add(a.APIKey, a.APIToken)
+	return nil
 }
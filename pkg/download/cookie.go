@@ -0,0 +1,99 @@
+package download
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCookieFile = errors.New("invalid cookie file")
+
+// httpOnlyPrefix marks the HttpOnly cookies of a Netscape cookie file, which would be comments otherwise.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// LoadCookieFile reads the Netscape cookie file at the given path, see ParseCookieFile.
+func LoadCookieFile(path string) (http.CookieJar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	jar, err := ParseCookieFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return jar, nil
+}
+
+// ParseCookieFile reads a Netscape cookie file, i.e. the cookies.txt format of curl, wget and browser
+// extensions, into a cookie jar. Every line holds the tab separated domain, include subdomains flag,
+// path, secure flag, expiration as a Unix time (zero for session cookies), name and value of a cookie.
+// Expired cookies are ignored.
+func ParseCookieFile(r io.Reader) (http.CookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%w: line %d: expected 7 tab separated fields, got %d", ErrInvalidCookieFile, n, len(fields))
+		}
+		domain, subdomains, path, secure, expires, name, value := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: invalid expiration %q", ErrInvalidCookieFile, n, expires)
+		}
+
+		cookie := &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     path,
+			Secure:   strings.EqualFold(secure, "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if unix > 0 {
+			cookie.Expires = time.Unix(unix, 0)
+			if cookie.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+		// a host-only cookie has no domain attribute
+		host := strings.TrimPrefix(domain, ".")
+		if strings.EqualFold(subdomains, "TRUE") {
+			cookie.Domain = host
+		}
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: path}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return jar, nil
+}
@@ -0,0 +1,68 @@
+package download
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCookieFile(t *testing.T) {
+	file := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		"",
+		"example.com\tFALSE\t/\tFALSE\t0\tsession\tabc",
+		".example.com\tTRUE\t/\tTRUE\t4102444800\tsecure\tdef",
+		"#HttpOnly_example.com\tFALSE\t/private\tFALSE\t0\thidden\tghi",
+		"example.com\tFALSE\t/\tFALSE\t946684800\texpired\tjkl",
+	}, "\n")
+
+	jar, err := ParseCookieFile(strings.NewReader(file))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	names := func(raw string) []string {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, c := range jar.Cookies(u) {
+			names = append(names, c.Name+"="+c.Value)
+		}
+		return names
+	}
+
+	assert.ElementsMatch(t, []string{"session=abc"}, names("http://example.com/"))
+	assert.ElementsMatch(t, []string{"session=abc", "secure=def"}, names("https://example.com/"))
+	assert.ElementsMatch(t, []string{"secure=def"}, names("https://www.example.com/"), "only domain cookies apply to subdomains")
+	assert.ElementsMatch(t, []string{"session=abc", "hidden=ghi"}, names("http://example.com/private/file"))
+}
+
+func TestParseCookieFile_Invalid(t *testing.T) {
+	for _, file := range []string{
+		"example.com\tFALSE\t/\tFALSE\t0\tname",
+		"example.com\tFALSE\t/\tFALSE\tnever\tname\tvalue",
+	} {
+		_, err := ParseCookieFile(strings.NewReader(file))
+		assert.ErrorIs(t, err, ErrInvalidCookieFile)
+	}
+}
+
+func TestLoadCookieFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("127.0.0.1\tFALSE\t/\tFALSE\t0\tsession\tabc\n"), 0o600))
+
+	jar, err := LoadCookieFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*http.Cookie{{Name: "session", Value: "abc"}}, jar.Cookies(&url.URL{Scheme: "http", Host: "127.0.0.1", Path: "/"}))
+	}
+
+	_, err = LoadCookieFile(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
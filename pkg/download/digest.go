@@ -0,0 +1,304 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidChallenge is returned when the Digest challenge of a server can't be answered.
+var ErrInvalidChallenge = errors.New("invalid digest challenge")
+
+var _ Reauthenticator = (*DigestAuth)(nil)
+
+// digestAlgorithms are the supported Digest algorithms, by order of preference.
+var digestAlgorithms = []struct {
+	name string
+	hash func() hash.Hash
+}{
+	{"SHA-512-256", sha512.New512_256},
+	{"SHA-256", sha256.New},
+	{"MD5", md5.New},
+}
+
+// DigestAuth authenticates the requests with HTTP Digest authentication, see RFC 7616. The first request
+// is sent without credentials, the challenge of the server is answered from then on, with the MD5,
+// SHA-256 or SHA-512-256 algorithms and their session variants. The concurrent requests share the
+// nonce of the server, each one with its own nonce count, the nonce is renewed when the server
+// rejects it as stale. It must not be copied once used.
+type DigestAuth struct {
+	Username, Password string
+
+	mu        sync.Mutex
+	challenge *digestChallenge
+	// nc is the number of requests sent with the nonce of the challenge.
+	nc uint32
+}
+
+// digestChallenge is the Digest challenge of a server.
+type digestChallenge struct {
+	realm, nonce, opaque string
+	algorithm            string
+	hash                 func() hash.Hash
+	session              bool
+	qop                  string
+	userhash             bool
+	stale                bool
+}
+
+// Apply answers the challenge of the server, it leaves the request as is until the server sent one.
+func (d *DigestAuth) Apply(_ context.Context, req *http.Request) error {
+	d.mu.Lock()
+	c := d.challenge
+	if c == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	d.nc++
+	nc := d.nc
+	d.mu.Unlock()
+
+	cnonce := make([]byte, 16)
+	if _, err := rand.Read(cnonce); err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.authorization(d.Username, d.Password, req.Method, req.URL.RequestURI(), nc, hex.EncodeToString(cnonce)))
+
+	return nil
+}
+
+// Reauthenticate reads the Digest challenge of the response. The request is retried when it was sent
+// without credentials, or with a nonce the server no longer accepts. It's not when the credentials
+// were rejected, or the server doesn't offer Digest authentication.
+func (d *DigestAuth) Reauthenticate(_ context.Context, resp *http.Response) (bool, error) {
+	c, err := parseDigestChallenge(resp.Header.Values("WWW-Authenticate"))
+	if err != nil || c == nil {
+		return false, err
+	}
+
+	var used string
+	if resp.Request != nil {
+		if params := parseChallenges([]string{resp.Request.Header.Get("Authorization")}); len(params) > 0 && strings.EqualFold(params[0].scheme, "Digest") {
+			used = params[0].params["nonce"]
+		}
+	}
+	if used == c.nonce && !c.stale {
+		// the credentials were rejected
+		return false, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// the concurrent requests rejected with the same nonce renew it once
+	if d.challenge == nil || d.challenge.nonce != c.nonce {
+		d.challenge, d.nc = c, 0
+	}
+
+	return true, nil
+}
+
+// authorization returns the Authorization header value answering the challenge.
+func (c *digestChallenge) authorization(username, password, method, uri string, nc uint32, cnonce string) string {
+	h := func(s string) string {
+		digest := c.hash()
+		digest.Write([]byte(s)) //nolint:errcheck
+		return hex.EncodeToString(digest.Sum(nil))
+	}
+
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if c.session {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	if c.qop == "auth-int" {
+		// the requests have no body
+		ha2 = h(method + ":" + uri + ":" + h(""))
+	}
+
+	count := fmt.Sprintf("%08x", nc)
+	response := h(ha1 + ":" + c.nonce + ":" + ha2)
+	if c.qop != "" {
+		response = h(ha1 + ":" + c.nonce + ":" + count + ":" + cnonce + ":" + c.qop + ":" + ha2)
+	}
+
+	if c.userhash {
+		username = h(username + ":" + c.realm)
+	}
+
+	params := []string{
+		"username=" + quote(username),
+		"realm=" + quote(c.realm),
+		"nonce=" + quote(c.nonce),
+		"uri=" + quote(uri),
+		"algorithm=" + c.algorithm,
+		"response=" + quote(response),
+	}
+	if c.opaque != "" {
+		params = append(params, "opaque="+quote(c.opaque))
+	}
+	if c.qop != "" {
+		params = append(params, "qop="+c.qop, "nc="+count, "cnonce="+quote(cnonce))
+	}
+	if c.userhash {
+		params = append(params, "userhash=true")
+	}
+
+	return "Digest " + strings.Join(params, ", ")
+}
+
+// quote returns s as a quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// parseDigestChallenge returns the Digest challenge with the preferred algorithm among the challenges
+// of the WWW-Authenticate headers, or nil when there is none.
+func parseDigestChallenge(headers []string) (*digestChallenge, error) {
+	var digests []authChallenge
+	for _, ch := range parseChallenges(headers) {
+		if strings.EqualFold(ch.scheme, "Digest") {
+			digests = append(digests, ch)
+		}
+	}
+	if len(digests) == 0 {
+		return nil, nil
+	}
+
+	var offered []string
+	for _, ch := range digests {
+		if ch.params["algorithm"] == "" {
+			ch.params["algorithm"] = "MD5"
+		}
+		offered = append(offered, ch.params["algorithm"])
+	}
+	for _, algorithm := range digestAlgorithms {
+		for _, ch := range digests {
+			name := ch.params["algorithm"]
+			if base, session := strings.CutSuffix(strings.ToUpper(name), "-SESS"); base == algorithm.name {
+				return newDigestChallenge(ch, name, algorithm.hash, session)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidChallenge, strings.Join(offered, ", "))
+}
+
+// newDigestChallenge returns the challenge of the given Digest WWW-Authenticate parameters.
+func newDigestChallenge(ch authChallenge, algorithm string, hash func() hash.Hash, session bool) (*digestChallenge, error) {
+	if ch.params["nonce"] == "" {
+		return nil, fmt.Errorf("%w: no nonce", ErrInvalidChallenge)
+	}
+
+	c := &digestChallenge{
+		realm:     ch.params["realm"],
+		nonce:     ch.params["nonce"],
+		opaque:    ch.params["opaque"],
+		algorithm: algorithm,
+		hash:      hash,
+		session:   session,
+		userhash:  strings.EqualFold(ch.params["userhash"], "true"),
+		stale:     strings.EqualFold(ch.params["stale"], "true"),
+	}
+	if qop, ok := ch.params["qop"]; ok {
+		for _, value := range strings.Split(qop, ",") {
+			switch value = strings.TrimSpace(value); {
+			case value == "auth":
+				c.qop = value
+			case value == "auth-int" && c.qop == "":
+				c.qop = value
+			}
+		}
+		if c.qop == "" {
+			return nil, fmt.Errorf("%w: unsupported qop %q", ErrInvalidChallenge, qop)
+		}
+	}
+
+	return c, nil
+}
+
+// authChallenge is a challenge of a WWW-Authenticate header, or the credentials of an Authorization header.
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges parses the challenges of the given WWW-Authenticate header values, see RFC 9110
+// section 11.6.1. A value may hold several challenges, the parameter names are lower-cased.
+func parseChallenges(headers []string) []authChallenge {
+	var challenges []authChallenge
+	for _, s := range headers {
+		for s != "" {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+
+			var token string
+			token, s = cutToken(s)
+			rest := strings.TrimLeft(s, " \t")
+			if !strings.HasPrefix(rest, "=") || len(challenges) == 0 {
+				if token != "" {
+					challenges = append(challenges, authChallenge{scheme: token, params: map[string]string{}})
+					continue
+				}
+				// not a token, skip the character
+				s = s[1:]
+				continue
+			}
+
+			var value string
+			value, s = cutValue(strings.TrimLeft(rest[1:], " \t"))
+			challenges[len(challenges)-1].params[strings.ToLower(token)] = value
+		}
+	}
+
+	return challenges
+}
+
+// cutToken returns the token at the beginning of s and the rest of s.
+func cutToken(s string) (string, string) {
+	end := strings.IndexAny(s, " \t,=\"")
+	if end < 0 {
+		return s, ""
+	}
+
+	return s[:end], s[end:]
+}
+
+// cutValue returns the token or quoted string at the beginning of s, unquoted, and the rest of s.
+func cutValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		end := strings.IndexAny(s, " \t,")
+		if end < 0 {
+			return s, ""
+		}
+		return s[:end], s[end:]
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		case '"':
+			return value.String(), s[i+1:]
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+
+	return value.String(), ""
+}
@@ -0,0 +1,184 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestChallenge_Authorization(t *testing.T) {
+	// the examples of RFC 7616 section 3.9.1
+	header := `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=%s, ` +
+		`nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+
+	tests := map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	}
+	for algorithm, response := range tests {
+		t.Run(algorithm, func(t *testing.T) {
+			c, err := parseDigestChallenge([]string{fmt.Sprintf(header, algorithm)})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			authorization := c.authorization("Mufasa", "Circle of Life", http.MethodGet, "/dir/index.html", 1, "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+			params := parseChallenges([]string{authorization})[0].params
+			assert.Equal(t, response, params["response"])
+			assert.Equal(t, "auth", params["qop"])
+			assert.Equal(t, "00000001", params["nc"])
+			assert.Equal(t, "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS", params["opaque"])
+		})
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	c, err := parseDigestChallenge([]string{
+		`Basic realm="files", Digest realm="a, \"quoted\" realm", nonce="n1", algorithm=MD5, qop="auth"`,
+		`Digest realm="files", nonce="n2", algorithm=SHA-256-sess, stale=TRUE, userhash=true`,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "n2", c.nonce, "SHA-256 is preferred over MD5")
+		assert.Equal(t, "SHA-256-sess", c.algorithm)
+		assert.True(t, c.session)
+		assert.True(t, c.stale)
+		assert.True(t, c.userhash)
+		assert.Empty(t, c.qop)
+	}
+
+	c, err = parseDigestChallenge([]string{`Digest realm="a, \"quoted\" realm", nonce="n1"`})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `a, "quoted" realm`, c.realm)
+		assert.Equal(t, "MD5", c.algorithm)
+	}
+
+	c, err = parseDigestChallenge([]string{`Basic realm="files"`})
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	_, err = parseDigestChallenge([]string{`Digest realm="files", nonce="n1", algorithm=SHA-1`})
+	assert.ErrorIs(t, err, ErrInvalidChallenge)
+}
+
+// digestServer serves content behind Digest authentication, the nonce is renewed every rotateAfter requests,
+// the requests sent with the previous nonce are challenged again with stale=true.
+type digestServer struct {
+	content, password string
+	rotateAfter       int
+
+	mu       sync.Mutex
+	nonce    int
+	uses     int
+	seen     map[string]bool
+	stale    int
+	rejected int
+}
+
+func (s *digestServer) challenge(wr http.ResponseWriter, stale bool) {
+	for _, algorithm := range []string{"MD5", "SHA-256"} {
+		wr.Header().Add("WWW-Authenticate", fmt.Sprintf(`Digest realm="files", qop="auth", algorithm=%s, nonce="nonce-%d", opaque="op", stale=%t`, algorithm, s.nonce, stale))
+	}
+	wr.WriteHeader(http.StatusUnauthorized)
+}
+
+func (s *digestServer) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	challenges := parseChallenges([]string{req.Header.Get("Authorization")})
+	if len(challenges) == 0 {
+		s.challenge(wr, false)
+		s.mu.Unlock()
+		return
+	}
+
+	p := challenges[0].params
+	if p["nonce"] != fmt.Sprintf("nonce-%d", s.nonce) {
+		s.stale++
+		s.challenge(wr, true)
+		s.mu.Unlock()
+		return
+	}
+
+	h := func(v string) string {
+		sum := sha256.Sum256([]byte(v))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(p["username"] + ":files:" + s.password)
+	ha2 := h(req.Method + ":" + req.URL.RequestURI())
+	expected := h(strings.Join([]string{ha1, p["nonce"], p["nc"], p["cnonce"], p["qop"], ha2}, ":"))
+	if p["algorithm"] != "SHA-256" || p["uri"] != req.URL.RequestURI() || p["response"] != expected || s.seen[p["nonce"]+p["nc"]] {
+		s.rejected++
+		s.challenge(wr, false)
+		s.mu.Unlock()
+		return
+	}
+	s.seen[p["nonce"]+p["nc"]] = true
+
+	if s.uses++; s.uses%s.rotateAfter == 0 {
+		s.nonce++
+	}
+	s.mu.Unlock()
+
+	http.ServeContent(wr, req, "firmware.bin", time.Time{}, strings.NewReader(s.content))
+}
+
+func TestDownloadManager_DigestAuth(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+
+	tests := []struct {
+		name     string
+		password string
+		valid    bool
+	}{
+		{name: "valid credentials", password: "Circle of Life", valid: true},
+		{name: "invalid credentials", password: "wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &digestServer{content: content, password: "Circle of Life", rotateAfter: 6, seen: map[string]bool{}}
+			server := httptest.NewServer(ds)
+			defer server.Close()
+
+			client, err := NewClient(WithAuth(&DigestAuth{Username: "Mufasa", Password: tt.password}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			downloader, err := NewDownloader(t.TempDir(), server.URL+"/firmware.bin", WithClient(client))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+			result, err := dm.Download(context.Background(), WithNumberOfSegments(8))
+			if !tt.valid {
+				assert.Error(t, err)
+				ds.mu.Lock()
+				defer ds.mu.Unlock()
+				// the HEAD and GET probes
+				assert.Equal(t, 2, ds.rejected, "the rejected credentials are not retried")
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(result.Path)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got))
+
+			ds.mu.Lock()
+			defer ds.mu.Unlock()
+			assert.Positive(t, ds.stale, "the nonce was renewed")
+			assert.Zero(t, ds.rejected)
+		})
+	}
+}
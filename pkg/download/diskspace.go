@@ -0,0 +1,131 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+	// errDiskSpaceUnknown indicates the free space of the file system can't be determined on this platform.
+	errDiskSpaceUnknown = errors.New("free disk space can't be determined")
+)
+
+// defaultDiskSpacePollInterval is how often the free space is checked while a download is paused
+// because the destination file system is full.
+const defaultDiskSpacePollInterval = 5 * time.Second
+
+// DiskSpaceError is returned when the destination file system doesn't have enough free space
+// to store the downloaded file. It unwraps to ErrInsufficientDiskSpace.
+type DiskSpaceError struct {
+	// Dir is the destination directory that was checked.
+	Dir string
+
+	// Required is the number of bytes needed to complete the download.
+	Required int64
+
+	// Available is the number of bytes available to the current user on the file system.
+	Available int64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("%v in %s: required %s, available %s",
+		ErrInsufficientDiskSpace, e.Dir, formatBytes(e.Required), formatBytes(e.Available))
+}
+
+func (e *DiskSpaceError) Unwrap() error {
+	return ErrInsufficientDiskSpace
+}
+
+// RequiredSpace returns the peak disk space, in bytes, needed to download and merge the file.
+// Segments are stored in temporary files which are then appended to the first segment and removed
+// one by one, so at the peak the whole file and the largest remaining segment co-exist on disk.
+// Data already persisted in the segments is taken into account. It returns zero when the file size is unknown.
+func (sm *SegmentManager) RequiredSpace() int64 {
+	if sm.FileSize <= 0 {
+		return 0
+	}
+
+	var written, largest int64
+	for i, seg := range sm.Segments {
+		written += seg.CurrentOffset
+		if i == 0 {
+			continue
+		}
+		if size := seg.End - seg.Start + 1; size > largest {
+			largest = size
+		}
+	}
+
+	return sm.FileSize - written + largest
+}
+
+// checkDiskSpace verifies the destination file system can hold the required number of bytes.
+// The check is skipped when the free space can't be determined.
+func checkDiskSpace(dir string, required int64) error {
+	if required <= 0 {
+		return nil
+	}
+
+	available, err := freeDiskSpace(dir)
+	if errors.Is(err, errDiskSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking free disk space: %w", err)
+	}
+
+	if available < required {
+		return &DiskSpaceError{Dir: dir, Required: required, Available: available}
+	}
+
+	return nil
+}
+
+// isNoSpaceErr reports whether err is caused by the file system running out of space.
+func isNoSpaceErr(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// waitForDiskSpace blocks until the file system holding dir has at least the required number of
+// free bytes, or the context is done. It checks the free space every interval.
+func waitForDiskSpace(ctx context.Context, dir string, required int64, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		available, err := freeDiskSpace(dir)
+		if err != nil {
+			return err
+		}
+		if available >= required {
+			return nil
+		}
+	}
+}
+
+// formatBytes formats a number of bytes in a human-readable form, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
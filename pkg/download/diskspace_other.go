@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package download
+
+// freeDiskSpace is not supported on this platform.
+func freeDiskSpace(string) (int64, error) {
+	return 0, errDiskSpaceUnknown
+}
@@ -0,0 +1,113 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentManager_RequiredSpace(t *testing.T) {
+	sm, err := NewSegmentManager(t.TempDir(), 10, WithNumberOfSegments(3))
+	if assert.NoError(t, err) {
+		defer sm.RemoveFiles()
+
+		// segments are [0-2] [3-5] [6-9], the last one is the largest
+		assert.Equal(t, int64(10+4), sm.RequiredSpace())
+
+		sm.Segments[0].CurrentOffset = 3
+		assert.Equal(t, int64(10-3+4), sm.RequiredSpace())
+	}
+
+	sm, err = NewSegmentManager(t.TempDir(), -1)
+	if assert.NoError(t, err) {
+		defer sm.RemoveFiles()
+		assert.Equal(t, int64(0), sm.RequiredSpace())
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeDiskSpace(dir); errors.Is(err, errDiskSpaceUnknown) {
+		t.Skip("free disk space is not supported on this platform")
+	}
+
+	assert.NoError(t, checkDiskSpace(dir, 1))
+
+	err := checkDiskSpace(dir, math.MaxInt64)
+	assert.ErrorIs(t, err, ErrInsufficientDiskSpace)
+
+	var spaceErr *DiskSpaceError
+	if assert.ErrorAs(t, err, &spaceErr) {
+		assert.Equal(t, dir, spaceErr.Dir)
+		assert.Equal(t, int64(math.MaxInt64), spaceErr.Required)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "40.0 GiB", formatBytes(40<<30))
+}
+
+// fullDiskWriter fails with ENOSPC for the first writes, as if the disk was full.
+type fullDiskWriter struct {
+	strings.Builder
+	failures int
+}
+
+func (w *fullDiskWriter) Write(p []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures--
+		return 0, syscall.ENOSPC
+	}
+	return w.Builder.Write(p)
+}
+
+func (w *fullDiskWriter) Truncate(int64) error {
+	w.Reset()
+	return nil
+}
+
+func (w *fullDiskWriter) Close() error { return nil }
+
+func TestDownloadManager_PausesOnNoSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeDiskSpace(dir); errors.Is(err, errDiskSpaceUnknown) {
+		t.Skip("free disk space is not supported on this platform")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		_, _ = wr.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	downloader, err := NewDownloader(dir, server.URL)
+	if assert.NoError(t, err) {
+		writer := &fullDiskWriter{failures: 2}
+		seg, err := NewSegment(SegmentParams{Writer: writer})
+		assert.NoError(t, err)
+
+		dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+		dm.Segm = &SegmentManager{DestinationDir: dir, Segments: []*Segment{seg}}
+		dm.DiskSpacePollInterval = time.Millisecond
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// a single attempt is enough, waiting for disk space doesn't consume retries
+		err = dm.RetryPolicy.Retry(ctx, seg.ID, func() error {
+			return dm.downloadSegment(ctx, seg)
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello world", writer.String())
+		}
+	}
+}
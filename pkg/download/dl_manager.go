@@ -4,8 +4,40 @@ package download
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrCanceled     = errors.New("download canceled")
+	ErrInvalidState = errors.New("invalid download state")
+)
+
+// failureHookTimeout bounds the OnFailure hooks, which aren't canceled with the context of the
+// download since it may be the reason it failed, e.g. when it's interrupted.
+const failureHookTimeout = time.Minute
+
+// State represents the state of a DownloadManager.
+type State string
+
+const (
+	// StateIdle is the state of a download that hasn't started yet.
+	StateIdle State = "idle"
+	// StateDownloading is the state of a running download.
+	StateDownloading State = "downloading"
+	// StatePaused is the state of a download paused with Pause, until it's resumed or canceled.
+	StatePaused State = "paused"
+	// StateCompleted is the state of a download that finished successfully.
+	StateCompleted State = "completed"
+	// StateFailed is the state of a download that finished with an error.
+	StateFailed State = "failed"
+	// StateCanceled is the state of a download canceled with Cancel.
+	StateCanceled State = "canceled"
 )
 
 // DownloadManager coordinates the segmented downloading of a file.
@@ -17,27 +49,228 @@ type DownloadManager struct {
 
 	// RetryPolicy defines the strategy for retrying download attempts in case of failure.
 	RetryPolicy *RetryPolicy
-	// TODO(azhovan): ProgressTracker
+
+	// Progress tracks the number of bytes downloaded.
+	Progress *Progress
 
 	Segm *SegmentManager
+
+	// DiskSpacePollInterval is how often the free disk space is checked while a segment is paused
+	// because the destination file system is full. If zero, it defaults to 5 seconds.
+	DiskSpacePollInterval time.Duration
+
+	// Pieces holds the digests of the consecutive pieces of the file, the mismatching pieces are downloaded
+	// again before the file is verified, see WithPieceHashes.
+	Pieces *MetalinkPieces
+
+	// Verifiers are run in order on the downloaded file once it is merged, before the PostProcessors,
+	// a file failing a verifier is not post-processed, see WithVerifier.
+	Verifiers []Hook
+
+	// PostProcessors are run in order on the downloaded file once it is complete.
+	PostProcessors []PostProcessor
+
+	// OnComplete hooks are run in order after the download is successfully finalized.
+	OnComplete []Hook
+
+	// OnFailure hooks are run in order after the download failed.
+	OnFailure []Hook
+
+	// HedgeThreshold enables hedged requests when greater than zero: once this fraction of the
+	// segments is done, the segments still in flight are also requested on a second connection,
+	// and the first request to finish wins, see WithHedging.
+	HedgeThreshold float64
+
+	// mu guards the state of the download, see Pause, Resume and Cancel.
+	mu    sync.Mutex
+	state State
+
+	// cancelSegments stops the running segments, it's set while they're running.
+	cancelSegments context.CancelFunc
+
+	// cancelProbe stops the probing of the source and the mirrors, it's set while they're probed.
+	cancelProbe context.CancelFunc
+
+	// wake notifies a paused download that it's resumed or canceled.
+	wake chan struct{}
+
+	// mirrors are the sources the segments are downloaded from.
+	mirrors *mirrorPool
+
+	// rangesIgnored is set once the server ignored a range request, the rest of the download is streamed.
+	rangesIgnored atomic.Bool
+
+	// stopSegments stops the segments of downloadSegments, it's set before they start.
+	stopSegments context.CancelFunc
 }
 
 // NewDownloadManager creates a new instance of DownloadManager with the specified downloader
 // and retry policy. It returns a pointer to the DownloadManager.
-func NewDownloadManager(downloader *Downloader, retryPolicy *RetryPolicy) *DownloadManager {
-	return &DownloadManager{
+// Additional configuration options can be provided to customize the DownloadManager's behavior.
+func NewDownloadManager(downloader *Downloader, retryPolicy *RetryPolicy, options ...DownloadManagerOption) *DownloadManager {
+	dm := &DownloadManager{
 		Downloader:  downloader,
 		RetryPolicy: retryPolicy,
+		Progress:    &Progress{},
+	}
+	for _, opt := range options {
+		opt(dm)
+	}
+
+	return dm
+}
+
+// DownloadManagerOption defines a function type for configuring a DownloadManager instance.
+type DownloadManagerOption func(*DownloadManager)
+
+// WithVerifier is an option function that adds a Hook checking the downloaded file before it's post-processed,
+// e.g. VerifyChecksum, the download fails with the error of the first failing verifier.
+func WithVerifier(verifier Hook) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.Verifiers = append(dm.Verifiers, verifier)
+	}
+}
+
+// WithPostProcessor is an option function that adds a PostProcessor to be run on the downloaded file,
+// e.g. an Extractor to unpack a downloaded archive.
+func WithPostProcessor(processor PostProcessor) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.PostProcessors = append(dm.PostProcessors, processor)
+	}
+}
+
+// WithProgress is an option function that sets the Progress the download is reported to,
+// so that it can be observed from outside, e.g. by a queue running the download.
+func WithProgress(progress *Progress) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.Progress = progress
+	}
+}
+
+// WithManager is an option function that calls fn with the DownloadManager, so that the download can be
+// paused, resumed and canceled from outside while it runs, e.g. by a queue running the download of a Batch.
+func WithManager(fn func(dm *DownloadManager)) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		fn(dm)
+	}
+}
+
+// WithOnComplete is an option function that adds a Hook to be run after the download is successfully finalized.
+func WithOnComplete(hook Hook) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.OnComplete = append(dm.OnComplete, hook)
+	}
+}
+
+// WithOnFailure is an option function that adds a Hook to be run after the download failed.
+func WithOnFailure(hook Hook) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.OnFailure = append(dm.OnFailure, hook)
+	}
+}
+
+// WithHedging is an option function that enables hedged requests for the tail segments of a download.
+// Once the given fraction of the segments is done, e.g. 0.8, the range of every segment still in flight
+// is also requested from the next healthy mirror, or on a second connection to the source URL.
+// Whichever request finishes first wins, the other one is canceled and its data is discarded.
+func WithHedging(threshold float64) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.HedgeThreshold = threshold
 	}
 }
 
-// Download initiates the download process.
-// It returns nil if the download completes successfully or an error if issues occur.
+// Download initiates the download process and returns its Result.
+// It returns an error if issues occur, the Result is returned even then, e.g. to inspect
+// the retries of the segments. When segments failed, the error is a *DownloadError.
+// The download can be paused, resumed and canceled from other goroutines while it runs,
+// a canceled download returns ErrCanceled.
+// Once the download is finalized, the OnComplete or OnFailure hooks are run, and any error
+// returned by the hooks is reflected in the returned error.
 // TODO(azhovan): not override existing files
-func (dm *DownloadManager) Download(ctx context.Context, opts ...SegmentManagerOption) error {
-	err := dm.Downloader.ValidateRangeSupport(ctx, dm.Downloader.UpdateRangeSupportState)
+func (dm *DownloadManager) Download(ctx context.Context, opts ...SegmentManagerOption) (*Result, error) {
+	start := time.Now()
+	result := &Result{}
+
+	dm.mu.Lock()
+	if dm.state == StateDownloading || dm.state == StatePaused {
+		dm.mu.Unlock()
+		return result, fmt.Errorf("%w: the download is already running", ErrInvalidState)
+	}
+	dm.state = StateDownloading
+	dm.mu.Unlock()
+
+	info, err := dm.download(ctx, opts...)
+	switch {
+	case errors.Is(err, ErrCanceled):
+		dm.setState(StateCanceled)
+	case err != nil:
+		dm.setState(StateFailed)
+	default:
+		dm.setState(StateCompleted)
+	}
+
+	result.Duration = time.Since(start)
+	result.Validators = dm.Downloader.Metadata.Validators
+	if dl := dm.Downloader; dl.ResolvedURL != nil {
+		result.ResolvedURL = dl.ResolvedURL.String()
+		for _, u := range dl.RedirectChain {
+			result.Redirects = append(result.Redirects, u.String())
+		}
+	}
+	if dm.Segm != nil {
+		result.Retries = make([]int, len(dm.Segm.Segments))
+		for i, seg := range dm.Segm.Segments {
+			result.Retries[i] = seg.retries
+			if seg.hedged {
+				result.Hedged++
+			}
+		}
+	}
+	if dm.mirrors != nil {
+		result.Mirrors = dm.mirrors.stats()
+	}
+
+	if err != nil {
+		// the download may have failed because ctx is done, e.g. interrupted, the hooks run regardless
+		hookCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), failureHookTimeout)
+		defer cancel()
+
+		info := DownloadInfo{SourceURL: dm.Downloader.SourceURL.String(), Err: err}
+		if herr := runHooks(hookCtx, "on-failure", dm.OnFailure, info); herr != nil {
+			return result, errors.Join(err, herr)
+		}
+		return result, err
+	}
+
+	result.Path, result.Filename = info.Path, filepath.Base(info.Path)
+	result.Size, result.Hashes = info.Size, info.Hashes
+	if seconds := result.Duration.Seconds(); seconds > 0 {
+		result.AverageSpeed = float64(result.Size) / seconds
+	}
+
+	return result, runHooks(ctx, "on-complete", dm.OnComplete, info)
+}
+
+// runHooks runs the given hooks in order and stops at the first failure.
+func runHooks(ctx context.Context, kind string, hooks []Hook, info DownloadInfo) error {
+	for _, hook := range hooks {
+		if err := hook(ctx, info); err != nil {
+			return fmt.Errorf("%s hook: %w", kind, err)
+		}
+	}
+
+	return nil
+}
+
+// download downloads, merges, verifies and post-processes the file, it returns the final path,
+// the size and the hashes of the downloaded file.
+func (dm *DownloadManager) download(ctx context.Context, opts ...SegmentManagerOption) (DownloadInfo, error) {
+	dm.mirrors = newDownloaderMirrorPool(dm.Downloader)
+	dm.rangesIgnored.Store(false)
+
+	err := dm.probe(ctx)
 	if err != nil {
-		return err
+		return DownloadInfo{}, err
 	}
 
 	dm.Segm, err = NewSegmentManager(
@@ -46,16 +279,194 @@ func (dm *DownloadManager) Download(ctx context.Context, opts ...SegmentManagerO
 		opts...,
 	)
 	if err != nil {
-		return err
+		return DownloadInfo{}, err
+	}
+
+	// a server without range support sends the whole file to every segment, it's split from a single stream instead
+	if !dm.Downloader.RangeSupport.SupportsRangeRequests && len(dm.Segm.Segments) > 1 {
+		dm.rangesIgnored.Store(true)
+	}
+
+	// fail early rather than after most of the file is downloaded
+	if err = checkDiskSpace(dm.Segm.DestinationDir, dm.Segm.RequiredSpace()); err != nil {
+		dm.Segm.RemoveFiles()
+		return DownloadInfo{}, err
+	}
+
+	dm.Progress.start(dm.Segm.FileSize)
+	for _, segment := range dm.Segm.Segments {
+		seg := segment
+		seg.onProgress = func(n int64) {
+			dm.Progress.add(n)
+			dm.mirrors.addBytes(seg.source, n)
+		}
+	}
+
+	if err = dm.runSegments(ctx); err != nil {
+		if errors.Is(err, ErrCanceled) {
+			dm.Segm.RemoveFiles()
+		}
+		return DownloadInfo{}, err
+	}
+
+	// the size of a stream of unknown length is known once it ended
+	if dm.Segm.FileSize <= 0 && len(dm.Segm.Segments) == 1 {
+		dm.Segm.FileSize = dm.Segm.Segments[0].CurrentOffset
+		dm.Progress.setTotal(dm.Segm.FileSize)
+	}
+
+	path, err := dm.Segm.MergeFiles(dm.Downloader.Filename())
+	if err != nil {
+		return DownloadInfo{}, err
+	}
+
+	if dm.Pieces != nil {
+		if err = dm.repairPieces(ctx, path); err != nil {
+			return DownloadInfo{}, fmt.Errorf("verifying %s: %w", path, err)
+		}
+	}
+
+	info := DownloadInfo{Path: path, SourceURL: dm.Downloader.SourceURL.String()}
+	if info.Size, info.Hashes, err = hashFile(path); err != nil {
+		return DownloadInfo{}, err
+	}
+
+	// a corrupted or tampered file must not be unpacked
+	for _, verifier := range dm.Verifiers {
+		if err = verifier(ctx, info); err != nil {
+			return DownloadInfo{}, fmt.Errorf("verifying %s: %w", path, err)
+		}
+	}
+
+	for _, processor := range dm.PostProcessors {
+		if err = processor.Process(ctx, path); err != nil {
+			return DownloadInfo{}, fmt.Errorf("post-processing %s: %w", path, err)
+		}
+	}
+
+	return info, nil
+}
+
+// probe probes the source and the mirrors. A download canceled while they're probed returns ErrCanceled,
+// a paused one is probed anyway and waits to be resumed before its segments start, see runSegments.
+func (dm *DownloadManager) probe(ctx context.Context) error {
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dm.mu.Lock()
+	if dm.state == StateCanceled {
+		dm.mu.Unlock()
+		return ErrCanceled
+	}
+	dm.cancelProbe = cancel
+	dm.mu.Unlock()
+
+	err := dm.Downloader.ValidateRangeSupport(probeCtx,
+		dm.Downloader.UpdateRangeSupportState,
+		dm.Downloader.UpdateFileMetadata,
+		dm.Downloader.UpdateRedirects,
+	)
+	if err == nil {
+		dm.probeMirrors(probeCtx, dm.mirrors)
+	}
+
+	dm.mu.Lock()
+	dm.cancelProbe = nil
+	state := dm.state
+	dm.mu.Unlock()
+
+	if state == StateCanceled {
+		return ErrCanceled
+	}
+
+	return err
+}
+
+// runSegments downloads the segments until they're all done or one of them fails.
+// While the download is paused, it waits for the download to be resumed, then continues
+// the segments from their recorded offsets, without probing the server again.
+func (dm *DownloadManager) runSegments(ctx context.Context) error {
+	for {
+		segCtx, cancel := context.WithCancel(ctx)
+		dm.mu.Lock()
+		state := dm.state
+		dm.cancelSegments = cancel
+		dm.mu.Unlock()
+
+		var err error
+		if state == StateDownloading {
+			err = dm.downloadSegments(segCtx)
+		}
+		// the segments were stopped by Pause, even if the download was resumed since
+		interrupted := err != nil && segCtx.Err() != nil && ctx.Err() == nil
+		cancel()
+
+		dm.mu.Lock()
+		state = dm.state
+		dm.cancelSegments = nil
+		dm.mu.Unlock()
+
+		switch {
+		case state == StateCanceled:
+			return ErrCanceled
+		case state == StatePaused || interrupted:
+			// the segments are stopped, persist their buffered data so that they continue from there
+			for _, seg := range dm.Segm.Segments {
+				if serr := seg.syncOffset(); serr != nil {
+					return serr
+				}
+			}
+
+			if state == StatePaused {
+				dm.Downloader.Logger.Info("download paused")
+				if err = dm.waitForResume(ctx); err != nil {
+					return err
+				}
+				dm.Downloader.Logger.Info("download resumed")
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// downloadSegments downloads the segments that are not done yet concurrently, see raceSegment.
+// When multi-range requests are enabled, the segments are first requested together, see downloadMultiRange.
+// When the server ignores a range request, the segments are stopped and the rest of the file is
+// downloaded in a single stream, keeping the data of the segments, see DownloadStream.
+func (dm *DownloadManager) downloadSegments(ctx context.Context) error {
+	if dm.rangesIgnored.Load() {
+		return dm.downloadStream(ctx)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dm.stopSegments = cancel
+
+	if dm.Downloader.MultiRange > 1 && dm.Downloader.RangeSupport.SupportsRangeRequests {
+		dm.downloadMultiRange(ctx)
 	}
 
 	// capture errors for each segment
 	errs := make(chan error, dm.Segm.TotalSegments)
 
+	done := 0
+	for _, segment := range dm.Segm.Segments {
+		if segment.Done {
+			done++
+		}
+	}
+	h := newHedger(dm.HedgeThreshold, len(dm.Segm.Segments), done)
+
 	// Use a WaitGroup to wait for all download goroutines to complete
 	wg := &sync.WaitGroup{}
-	wg.Add(dm.Segm.TotalSegments)
 	for _, segment := range dm.Segm.Segments {
+		if segment.Done {
+			continue
+		}
+
+		wg.Add(1)
 		go func(seg *Segment) {
 			defer wg.Done()
 
@@ -65,18 +476,24 @@ func (dm *DownloadManager) Download(ctx context.Context, opts ...SegmentManagerO
 			default:
 			}
 
-			// Attempt to download the segment with retries
-			err = dm.RetryPolicy.Retry(ctx, seg.ID, func() error {
-				return dm.Downloader.DownloadSegment(ctx, seg)
-			})
+			// Attempt to download the segment with retries, from the healthy mirrors
+			err := dm.raceSegment(ctx, seg, h)
 			if err != nil {
-				errs <- err
+				errs <- &SegmentError{
+					SegmentID: seg.ID,
+					Err:       err,
+					Details:   fmt.Sprintf("downloading segment %d failed", seg.ID),
+				}
 			}
 		}(segment)
 	}
 	wg.Wait()
 	close(errs)
 
+	if dm.rangesIgnored.Load() && parent.Err() == nil {
+		return dm.downloadStream(parent)
+	}
+
 	// Aggregate and return any errors encountered during the download
 	var allErrors []error
 	for err := range errs {
@@ -84,8 +501,181 @@ func (dm *DownloadManager) Download(ctx context.Context, opts ...SegmentManagerO
 	}
 
 	if len(allErrors) > 0 {
-		return fmt.Errorf("download encountered following errors: %v", allErrors)
+		return &DownloadError{Errs: allErrors}
+	}
+
+	return nil
+}
+
+// ignoreRanges records that the server ignored a range request and stops the segments,
+// the rest of the file is downloaded in a single stream, see downloadSegments.
+func (dm *DownloadManager) ignoreRanges(seg *Segment, err error) {
+	if !dm.rangesIgnored.CompareAndSwap(false, true) {
+		return
+	}
+
+	dm.Downloader.Logger.Warn("server ignored a range request, downloading the file in a single stream",
+		slog.Int("segment", seg.ID),
+		slog.String("error", err.Error()),
+	)
+	dm.stopSegments()
+}
+
+// waitForResume blocks while the download is paused. It returns ErrCanceled if the download
+// is canceled instead of resumed, or the context's error if it's done first.
+func (dm *DownloadManager) waitForResume(ctx context.Context) error {
+	for {
+		dm.mu.Lock()
+		state := dm.state
+		wake := dm.wakeChan()
+		dm.mu.Unlock()
+
+		switch state {
+		case StateCanceled:
+			return ErrCanceled
+		case StatePaused:
+		default:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// State returns the current state of the download.
+func (dm *DownloadManager) State() State {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	return dm.stateLocked()
+}
+
+// Pause stops all the segments of a running download once their buffered data is written to disk.
+// The download blocks until it's resumed or canceled, see Resume and Cancel.
+func (dm *DownloadManager) Pause() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.state != StateDownloading {
+		return fmt.Errorf("%w: can't pause a download that is %s", ErrInvalidState, dm.stateLocked())
 	}
 
-	return dm.Segm.MergeFiles(dm.Downloader.Filename())
+	dm.state = StatePaused
+	if dm.cancelSegments != nil {
+		dm.cancelSegments()
+	}
+
+	return nil
+}
+
+// Resume continues a paused download from where its segments stopped.
+func (dm *DownloadManager) Resume() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.state != StatePaused {
+		return fmt.Errorf("%w: can't resume a download that is %s", ErrInvalidState, dm.stateLocked())
+	}
+
+	dm.state = StateDownloading
+	dm.notify()
+
+	return nil
+}
+
+// Cancel stops a running or paused download and removes its temporary files,
+// the download returns ErrCanceled.
+func (dm *DownloadManager) Cancel() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.state != StateDownloading && dm.state != StatePaused {
+		return fmt.Errorf("%w: can't cancel a download that is %s", ErrInvalidState, dm.stateLocked())
+	}
+
+	dm.state = StateCanceled
+	if dm.cancelProbe != nil {
+		dm.cancelProbe()
+	}
+	if dm.cancelSegments != nil {
+		dm.cancelSegments()
+	}
+	dm.notify()
+
+	return nil
+}
+
+func (dm *DownloadManager) setState(state State) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.state = state
+}
+
+// stateLocked returns the current state, it must be called with the lock held.
+func (dm *DownloadManager) stateLocked() State {
+	if dm.state == "" {
+		return StateIdle
+	}
+
+	return dm.state
+}
+
+// wakeChan returns the channel notifying a paused download, it must be called with the lock held.
+func (dm *DownloadManager) wakeChan() chan struct{} {
+	if dm.wake == nil {
+		dm.wake = make(chan struct{}, 1)
+	}
+
+	return dm.wake
+}
+
+// notify wakes a paused download up without blocking, it must be called with the lock held.
+func (dm *DownloadManager) notify() {
+	select {
+	case dm.wakeChan() <- struct{}{}:
+	default:
+	}
+}
+
+// downloadSegment downloads the given segment, pausing it while the destination file system is full.
+// Running out of disk space is not a transient network error, hence waiting for free space
+// doesn't consume the attempts of the RetryPolicy.
+func (dm *DownloadManager) downloadSegment(ctx context.Context, seg *Segment) error {
+	interval := dm.DiskSpacePollInterval
+	if interval <= 0 {
+		interval = defaultDiskSpacePollInterval
+	}
+
+	for {
+		err := dm.Downloader.DownloadSegment(ctx, seg)
+		if !isNoSpaceErr(err) {
+			return err
+		}
+
+		// wait for enough space to store the rest of the segment
+		remaining := seg.End - seg.Start + 1 - seg.CurrentOffset
+		if remaining <= 0 {
+			remaining = 1
+		}
+
+		dm.Downloader.Logger.Warn("segment paused, no space left on device",
+			slog.Int("segment", seg.ID),
+			slog.String("required", formatBytes(remaining)),
+		)
+
+		werr := waitForDiskSpace(ctx, dm.Segm.DestinationDir, remaining, interval)
+		if errors.Is(werr, errDiskSpaceUnknown) {
+			return err
+		}
+		if werr != nil {
+			return werr
+		}
+
+		dm.Downloader.Logger.Info("segment resumed", slog.Int("segment", seg.ID))
+	}
 }
@@ -2,12 +2,19 @@ package download
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/azhovan/durable-resume/pkg/logger"
 	"github.com/stretchr/testify/assert"
@@ -26,10 +33,29 @@ func TestNewDownloadManager(t *testing.T) {
 			})
 
 			dlManager := NewDownloadManager(downloader, DefaultRetryPolicy())
-			err = dlManager.Download(context.Background())
+			_, err = dlManager.Download(context.Background())
 			assert.NoError(t, err)
 		}
 	})
+	t.Run("NewDownloadManager with local server", func(t *testing.T) {
+		content := strings.Repeat("0123456789", 100)
+		server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+		}))
+		defer server.Close()
+
+		dir := t.TempDir()
+		downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+		if assert.NoError(t, err) {
+			dlManager := NewDownloadManager(downloader, DefaultRetryPolicy())
+			_, err = dlManager.Download(context.Background(), WithNumberOfSegments(3))
+			if assert.NoError(t, err) {
+				got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+				assert.NoError(t, err)
+				assert.Equal(t, content, string(got))
+			}
+		}
+	})
 	t.Run("NewDownloadManager with err", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
 			// Simulate the support of the range request and have a body of 123 bytes.
@@ -47,7 +73,7 @@ func TestNewDownloadManager(t *testing.T) {
 			})
 
 			dlManager := NewDownloadManager(downloader, DefaultRetryPolicy())
-			err = dlManager.Download(context.Background())
+			_, err = dlManager.Download(context.Background())
 			assert.NotNil(t, err)
 
 			// Assert error is EOF
@@ -55,3 +81,195 @@ func TestNewDownloadManager(t *testing.T) {
 		}
 	})
 }
+
+// newPausableServer serves content with range requests. Until release is closed, a GET request
+// only gets the first half of its range, then blocks until the client gives up.
+func newPausableServer(t *testing.T, content string, release chan struct{}) (*httptest.Server, func() (int, []string)) {
+	var mu sync.Mutex
+	var heads int
+	var ranges []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		if req.Method == http.MethodHead {
+			heads++
+		} else {
+			ranges = append(ranges, req.Header.Get("Range"))
+		}
+		mu.Unlock()
+
+		select {
+		case <-release:
+		default:
+			var start, end int
+			if req.Method == http.MethodGet {
+				if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+					wr.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+					wr.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+					wr.WriteHeader(http.StatusPartialContent)
+					_, _ = wr.Write([]byte(content[start : start+(end-start+1)/2]))
+					http.NewResponseController(wr).Flush() //nolint:errcheck
+					<-req.Context().Done()
+					return
+				}
+			}
+		}
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() (int, []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return heads, append([]string(nil), ranges...)
+	}
+}
+
+func TestDownloadManager_PauseResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 300)
+	release := make(chan struct{})
+	server, requests := newPausableServer(t, content, release)
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+	assert.Equal(t, StateIdle, dm.State())
+	assert.ErrorIs(t, dm.Pause(), ErrInvalidState)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := dm.Download(context.Background(), WithNumberOfSegments(3))
+		done <- err
+	}()
+
+	// wait for every segment to receive the first half of its range
+	assert.Eventually(t, func() bool {
+		return dm.Progress.Snapshot().Downloaded == int64(len(content)/2)
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, StateDownloading, dm.State())
+
+	assert.NoError(t, dm.Pause())
+	assert.Equal(t, StatePaused, dm.State())
+	assert.ErrorIs(t, dm.Pause(), ErrInvalidState)
+
+	// the paused segments persist the received data
+	assert.Eventually(t, func() bool {
+		for _, seg := range dm.Segm.Segments {
+			fi, err := os.Stat(filepath.Join(dir, seg.Name))
+			if err != nil || fi.Size() != 500 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 5*time.Millisecond)
+
+	close(release)
+	assert.NoError(t, dm.Resume())
+	assert.NoError(t, <-done)
+	assert.Equal(t, StateCompleted, dm.State())
+
+	got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(got))
+
+	heads, ranges := requests()
+	assert.Equal(t, 1, heads, "the server is not probed again on resume")
+	assert.ElementsMatch(t, []string{
+		"bytes=0-999", "bytes=1000-1999", "bytes=2000-2999",
+		"bytes=500-999", "bytes=1500-1999", "bytes=2500-2999",
+	}, ranges)
+}
+
+func TestDownloadManager_Cancel(t *testing.T) {
+	content := strings.Repeat("0123456789", 300)
+	server, _ := newPausableServer(t, content, make(chan struct{}))
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := dm.Download(context.Background(), WithNumberOfSegments(3))
+		done <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		return dm.Progress.Snapshot().Downloaded > 0
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.NoError(t, dm.Pause())
+	assert.NoError(t, dm.Cancel())
+
+	assert.ErrorIs(t, <-done, ErrCanceled)
+	assert.Equal(t, StateCanceled, dm.State())
+	assert.ErrorIs(t, dm.Resume(), ErrInvalidState)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "the temporary files are removed")
+}
+
+func TestDownloadManager_Result(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("ETag", `"v1"`)
+		http.ServeContent(wr, req, "data.txt", modTime, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloader, err := NewDownloader(t.TempDir(), server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewDownloadManager(downloader, NewRetryPolicy(1)).Download(context.Background(), WithNumberOfSegments(2))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "data.txt", result.Filename)
+		assert.Equal(t, filepath.Join(downloader.DestinationDIR.String(), "data.txt"), result.Path)
+		assert.Equal(t, int64(len(content)), result.Size)
+		assert.Positive(t, result.Duration)
+		assert.Positive(t, result.AverageSpeed)
+		assert.Equal(t, []int{0, 0}, result.Retries)
+		assert.Len(t, result.Hashes["sha256"], 64)
+		assert.Equal(t, Validators{ETag: `"v1"`, LastModified: modTime}, result.Validators)
+	}
+}
+
+func TestDownloadManager_SegmentErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		// the body is shorter than the announced length, every segment fails with an unexpected EOF
+		wr.Header().Set("Content-Length", "123")
+		wr.Header().Set("Accept-Ranges", "bytes")
+		if req.Method == http.MethodHead {
+			wr.WriteHeader(http.StatusOK)
+			return
+		}
+		wr.WriteHeader(http.StatusPartialContent)
+	}))
+	defer server.Close()
+
+	downloader, err := NewDownloader(t.TempDir(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewDownloadManager(downloader, NewRetryPolicy(2)).Download(context.Background(), WithNumberOfSegments(2))
+
+	var dlErr *DownloadError
+	if assert.ErrorAs(t, err, &dlErr) {
+		assert.Len(t, dlErr.Errs, 2)
+	}
+	var segErr *SegmentError
+	assert.ErrorAs(t, err, &segErr)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	assert.Empty(t, result.Path)
+	assert.Equal(t, []int{1, 1}, result.Retries)
+}
@@ -7,8 +7,9 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/azhovan/durable-resume/pkg/logger"
 )
@@ -22,17 +23,77 @@ type Downloader struct {
 	// Source URL of the file to be downloaded.
 	SourceURL *url.URL
 
+	// Mirrors are additional URLs of the same file, the segments are spread across
+	// the source and the mirrors, see WithMirrors.
+	Mirrors []*url.URL
+
+	// MirrorPriorities holds the priority of every mirror, in the order of Mirrors, a missing one is 0 like
+	// the priority of the source URL. The segments are spread across the healthy sources with the lowest
+	// priority value, the others are used once they're excluded, see WithMirrorPriority.
+	MirrorPriorities []int
+
+	// MultiRange is the maximum number of segment ranges requested in a single request,
+	// the segments are requested one by one when it's less than 2, see WithMultiRange.
+	MultiRange int
+
 	// Destination URL where the file will be saved.
 	DestinationDIR *url.URL
 
 	// RangeSupport provides information about the server's capabilities regarding range requests.
 	RangeSupport RangeSupport
 
+	// Metadata holds the response metadata used to resolve the downloaded file name.
+	Metadata FileMetadata
+
 	// Custom HTTP Client for making requests.
 	Client *Client
 
+	// Header holds additional headers sent with every request, see WithHeader.
+	// The headers managed by the downloader, e.g. Range, are not sent.
+	Header http.Header
+
+	// UserAgent is the User-Agent header sent with every request, Go's default one when empty.
+	UserAgent string
+
+	// Jar stores the cookies sent with the requests and received from the server, see WithCookieJar.
+	Jar http.CookieJar
+
+	// RequestModifiers are called in order on every request right before it's sent, after the
+	// headers and the authentication are set, see WithRequestModifier.
+	RequestModifiers []RequestModifier
+
+	// StallWindow is the period over which the throughput of a response is measured, a response
+	// delivering less than MinThroughput bytes per second during a window fails with ErrStalled.
+	// Stall detection is disabled when both are zero, see WithStallDetection.
+	StallWindow time.Duration
+
+	// MinThroughput is the minimum throughput of a response in bytes per second, see StallWindow.
+	MinThroughput int64
+
+	// RedirectPolicy controls the redirects followed by the requests, see WithRedirectPolicy.
+	RedirectPolicy RedirectPolicy
+
+	// RedirectChain holds the URLs the source URL redirected to when it was probed, in order, the
+	// last one being ResolvedURL. It's empty when the source URL wasn't redirected.
+	RedirectChain []*url.URL
+
+	// ResolvedURL is the final URL of the source URL, once the redirects are followed.
+	ResolvedURL *url.URL
+
 	// Optional Logger for logging debug and error information.
 	Logger *slog.Logger
+
+	// mirrors are the raw mirror URLs given with WithMirrors, parsed by NewDownloader.
+	mirrors []string
+
+	// mirrorPriorities holds the priority of every raw mirror URL, see WithMirrorPriority.
+	mirrorPriorities []int
+
+	// pins holds the URLs the source and the mirrors redirect to, see RedirectPolicy.Pin.
+	pins *pinTable
+
+	// s3Endpoint and s3Region resolve the s3:// source and mirror URLs, see WithS3Endpoint.
+	s3Endpoint, s3Region string
 }
 
 type RangeSupport struct {
@@ -47,6 +108,10 @@ type RangeSupport struct {
 	// This value typically indicates the unit that can be used for range requests, such as "bytes".
 	// When the server supports range requests, the Downloader can use this capability to resume downloads after interruptions.
 	AcceptRanges string
+
+	// ProbeMethod is the HTTP method of the request the server was probed with: HEAD, or GET
+	// with a Range: bytes=0-0 header when the server rejected HEAD or didn't advertise its range support.
+	ProbeMethod string
 }
 
 // NewDownloader initializes a new instance of Downloader with the provided source and destination URLs.
@@ -73,11 +138,42 @@ func NewDownloader(dst, src string, options ...DownloaderOption) (*Downloader, e
 		DestinationDIR: dstURL,
 		Client:         Client,
 		Logger:         logger.DefaultLogger(),
+		pins:           newPinTable(),
 	}
 	for _, opt := range options {
 		opt(dl)
 	}
 
+	if dl.Jar != nil || dl.RedirectPolicy != (RedirectPolicy{}) {
+		// the jar and the redirect policy are set on a copy, the http.Client may be shared, e.g. http.DefaultClient
+		httpClient := *dl.Client.httpClient
+		if dl.Jar != nil {
+			httpClient.Jar = dl.Jar
+		}
+		if dl.RedirectPolicy != (RedirectPolicy{}) {
+			httpClient.CheckRedirect = dl.RedirectPolicy.checkRedirect
+		}
+		clone := *dl.Client
+		clone.httpClient = &httpClient
+		dl.Client = &clone
+	}
+
+	if dl.SourceURL, err = dl.resolveS3URL(dl.SourceURL); err != nil {
+		return nil, err
+	}
+
+	for i, mirror := range dl.mirrors {
+		u, err := url.ParseRequestURI(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror: %w", err)
+		}
+		if u, err = dl.resolveS3URL(u); err != nil {
+			return nil, fmt.Errorf("invalid mirror: %w", err)
+		}
+		dl.Mirrors = append(dl.Mirrors, u)
+		dl.MirrorPriorities = append(dl.MirrorPriorities, dl.mirrorPriorities[i])
+	}
+
 	return dl, err
 }
 
@@ -107,76 +203,297 @@ func WithFileName(name string) DownloaderOption {
 	}
 }
 
+// WithMirrors is an option function that adds mirrors of the source URL. The mirrors must serve
+// the same file, mirrors that don't agree with the source on its size and validators are not used.
+func WithMirrors(urls ...string) DownloaderOption {
+	return WithMirrorPriority(0, urls...)
+}
+
+// WithMirrorPriority is an option function that adds mirrors of the source URL with the given priority,
+// e.g. the one of a metalink file. The segments are downloaded from the healthy sources with the lowest
+// priority value, the source URL and the mirrors of WithMirrors having priority 0, the other mirrors are
+// only used once those are excluded.
+func WithMirrorPriority(priority int, urls ...string) DownloaderOption {
+	return func(dl *Downloader) {
+		for _, u := range urls {
+			dl.mirrors = append(dl.mirrors, u)
+			dl.mirrorPriorities = append(dl.mirrorPriorities, priority)
+		}
+	}
+}
+
+// managedHeaders are the headers set by the downloader itself, the ones of the
+// Header field would break the segments, e.g. a Range replacing the one of a segment.
+var managedHeaders = []string{"Range", "If-Range"}
+
+// IsManagedHeader reports whether the header is set by the downloader, WithHeader ignores it.
+func IsManagedHeader(name string) bool {
+	for _, managed := range managedHeaders {
+		if http.CanonicalHeaderKey(name) == managed {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestModifier is a function that modifies a request before it's sent, e.g. to sign it.
+type RequestModifier func(*http.Request)
+
+// WithHeader is an option function that adds a header sent with every request,
+// replacing any value set before for the same name. The headers managed by the
+// downloader are ignored, see IsManagedHeader.
+func WithHeader(name, value string) DownloaderOption {
+	return func(dl *Downloader) {
+		if dl.Header == nil {
+			dl.Header = make(http.Header)
+		}
+		dl.Header.Set(name, value)
+	}
+}
+
+// WithUserAgent is an option function that sets the User-Agent header sent with every request.
+func WithUserAgent(userAgent string) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.UserAgent = userAgent
+	}
+}
+
+// WithCookieJar is an option function that sets the cookie jar of the requests,
+// e.g. one loaded from a cookies.txt file with LoadCookieFile.
+func WithCookieJar(jar http.CookieJar) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.Jar = jar
+	}
+}
+
+// WithRequestModifier is an option function that adds a function called on every request right before it's sent.
+func WithRequestModifier(modifier RequestModifier) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.RequestModifiers = append(dl.RequestModifiers, modifier)
+	}
+}
+
+// prepareRequest applies the headers, the user agent, the authentication and the
+// request modifiers of the Downloader to the request, in this order.
+func (dl *Downloader) prepareRequest(req *http.Request) error {
+	for name, values := range dl.Header {
+		if IsManagedHeader(name) {
+			continue
+		}
+		req.Header[name] = append([]string(nil), values...)
+	}
+	if dl.UserAgent != "" {
+		req.Header.Set("User-Agent", dl.UserAgent)
+	}
+
+	// apply auth method if it's been set
+	if dl.Client.auth != nil {
+		if err := dl.Client.auth.Apply(req.Context(), req); err != nil {
+			return fmt.Errorf("authenticating request: %w", err)
+		}
+	}
+
+	for _, modify := range dl.RequestModifiers {
+		modify(req)
+	}
+
+	return nil
+}
+
+// do prepares and sends the request, see prepareRequest. The request is sent to the URL its URL is pinned
+// to, if any, unless resolve is set, see RedirectPolicy.Pin. When the response is 401 Unauthorized and
+// the authentication strategy is a Reauthenticator, the request is sent once more with new credentials.
+func (dl *Downloader) do(req *http.Request, resolve bool) (*http.Response, error) {
+	resp, err := dl.doPinned(req, resolve)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	reauth, ok := dl.Client.auth.(Reauthenticator)
+	if !ok {
+		return resp, nil
+	}
+	retry, err := reauth.Reauthenticate(req.Context(), resp)
+	if err != nil {
+		resp.Body.Close() //nolint:errcheck
+		return nil, fmt.Errorf("authenticating request: %w", err)
+	}
+	if !retry {
+		return resp, nil
+	}
+	resp.Body.Close() //nolint:errcheck
+
+	dl.Logger.Debug("request unauthorized, retrying with new credentials", slog.String("url", req.URL.String()))
+
+	return dl.doPinned(req, resolve)
+}
+
+// send prepares a clone of the request and sends it to the given URL, or to the URL of the request when nil.
+func (dl *Downloader) send(req *http.Request, target *url.URL) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if target != nil {
+		out.URL, out.Host = target, ""
+	}
+	if err := dl.prepareRequest(out); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(out.URL.Hostname(), req.URL.Hostname()) {
+		// like http.Client on redirects, the credentials are not sent to another host
+		out.Header.Del("Authorization")
+		out.Header.Del("Cookie")
+	}
+
+	return dl.Client.httpClient.Do(out)
+}
+
 // ResponseCallback defines a callback function that processes an HTTP response.
 type ResponseCallback func(*http.Response)
 
 // UpdateRangeSupportState update the Downloader's understanding of the server's support
-// for range requests based on the HTTP response received
+// for range requests based on the HTTP response received.
+// Range requests are supported when the server advertises Accept-Ranges: bytes, or answers a ranged
+// GET with 206 Partial Content, in which case the size of the file is read from the Content-Range header.
 func (dl *Downloader) UpdateRangeSupportState(response *http.Response) {
-	ac := response.Header.Get("Accept-Ranges")
-	cl := response.ContentLength
-	if ac == "" && cl <= 0 {
-		return
+	rs := RangeSupport{
+		AcceptRanges:  response.Header.Get("Accept-Ranges"),
+		ContentLength: response.ContentLength,
+	}
+	if response.Request != nil {
+		rs.ProbeMethod = response.Request.Method
 	}
 
-	dl.RangeSupport.SupportsRangeRequests = true
-	dl.RangeSupport.AcceptRanges = response.Header.Get("Accept-Ranges")
-	dl.RangeSupport.ContentLength = response.ContentLength
+	if response.StatusCode == http.StatusPartialContent {
+		rs.SupportsRangeRequests = true
+		rs.ContentLength = 0
+		if size, ok := contentRangeSize(response.Header.Get("Content-Range")); ok {
+			rs.ContentLength = size
+		}
+	} else {
+		rs.SupportsRangeRequests = strings.EqualFold(rs.AcceptRanges, "bytes")
+	}
+
+	dl.RangeSupport = rs
 }
 
 // Filename returns the filename associated with the Downloader.
+// When no file name is set explicitly, it is resolved from the server response
+// metadata and the source URL, see resolveFilename.
 func (dl *Downloader) Filename() string {
 	if dl.FileName != "" {
 		return dl.FileName
 	}
 
-	return filepath.Base(dl.SourceURL.Path)
+	return resolveFilename(dl.SourceURL, dl.Metadata)
 }
 
-// ValidateRangeSupport checks if the server supports range requests by making a test request.
-// It returns true if range requests are supported, false otherwise, along with an error if the check fails.
-func (dl *Downloader) ValidateRangeSupport(ctx context.Context, callback ResponseCallback) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dl.SourceURL.String(), http.NoBody)
-	if err != nil {
-		return fmt.Errorf("creating range request: %v", err)
-	}
+// ValidateRangeSupport checks if the server supports range requests by probing the source URL.
+// It sends a HEAD request first, and a GET request for the first byte (Range: bytes=0-0) when the HEAD
+// request fails or its response doesn't send Accept-Ranges, see probe. The given callbacks are invoked in
+// order with the server response, the result is stored in RangeSupport by UpdateRangeSupportState.
+// It returns an error if the server can't be probed.
+func (dl *Downloader) ValidateRangeSupport(ctx context.Context, callbacks ...ResponseCallback) error {
+	return dl.probe(ctx, dl.SourceURL, callbacks...)
+}
 
-	// apply auth method if it's been set
-	if dl.Client.auth != nil {
-		dl.Client.auth.Apply(req)
+// probe makes a test request to the given URL and invokes the callbacks in order with the server response.
+// The server is probed with a HEAD request first. When it fails, or the server doesn't tell whether it
+// supports range requests, i.e. neither Accept-Ranges: bytes nor Accept-Ranges: none is sent, the server
+// is probed again with a GET request for the first byte of the file, whose body is not read.
+func (dl *Downloader) probe(ctx context.Context, src *url.URL, callbacks ...ResponseCallback) error {
+	resp, err := dl.probeRequest(ctx, http.MethodHead, src)
+	if err == nil && resp.StatusCode == http.StatusOK && advertisesRanges(resp) {
+		defer resp.Body.Close() //nolint:errcheck
+		runCallbacks(resp, callbacks)
+		return nil
+	}
+	if err == nil {
+		resp.Body.Close() //nolint:errcheck
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("making range request: %w", ctx.Err())
 	}
 
-	resp, err := dl.Client.httpClient.Do(req)
+	resp, err = dl.probeRequest(ctx, http.MethodGet, src)
 	if err != nil {
-		return fmt.Errorf("making range request: %v", err) //nolint:errcheck
+		return fmt.Errorf("making range request: %w", err)
 	}
 	defer resp.Body.Close() //nolint:errcheck
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		return ErrRangeRequestNotSupported
 	}
+	runCallbacks(resp, callbacks)
 
-	if callback != nil {
-		callback(resp)
+	return nil
+}
+
+// probeRequest sends a probe request with the given method, a GET request is limited to the first byte.
+func (dl *Downloader) probeRequest(ctx context.Context, method string, src *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, src.String(), http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("creating range request: %v", err)
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
 	}
 
-	return nil
+	// the probe always follows the redirects, to resolve the URL again
+	return dl.do(req, true)
+}
+
+// advertisesRanges reports whether the response tells if the server supports range requests.
+func advertisesRanges(resp *http.Response) bool {
+	ac := resp.Header.Get("Accept-Ranges")
+	return strings.EqualFold(ac, "bytes") || strings.EqualFold(ac, "none")
+}
+
+func runCallbacks(resp *http.Response, callbacks []ResponseCallback) {
+	for _, callback := range callbacks {
+		if callback != nil {
+			callback(resp)
+		}
+	}
 }
 
 func (dl *Downloader) DownloadSegment(ctx context.Context, segment *Segment) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.SourceURL.String(), http.NoBody)
+	src := dl.SourceURL
+	if segment.source != nil {
+		src = segment.source
+	}
+
+	ctx, stall := dl.watchStall(ctx)
+	defer stall.stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), http.NoBody)
 	if err != nil {
 		return err
 	}
 
-	var rangeRequest string
-	if dl.RangeSupport.SupportsRangeRequests {
-		rangeRequest = "bytes=" + strconv.FormatInt(segment.Start, 10) + "-" + strconv.FormatInt(segment.End, 10)
-		req.Header.Set("Range", rangeRequest)
+	// a new attempt starts without the error of the previous one, and
+	// continues an interrupted segment from the data already persisted
+	segment.Err = nil
+	if err := segment.syncOffset(); err != nil {
+		return err
 	}
 
-	if dl.Client.auth != nil {
-		dl.Client.auth.Apply(req)
+	var rangeRequest string
+	offset := segment.Start + segment.CurrentOffset
+	switch {
+	case segment.End <= 0 && segment.CurrentOffset > 0 && !strings.EqualFold(dl.RangeSupport.AcceptRanges, "none"):
+		// the size of the file is unknown, try to continue the stream from the data already written
+		rangeRequest = "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		req.Header.Set("Range", rangeRequest)
+	case segment.End > 0 && dl.RangeSupport.SupportsRangeRequests:
+		if offset > segment.End {
+			return segment.setDone(true)
+		}
+		rangeRequest = "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(segment.End, 10)
+		req.Header.Set("Range", rangeRequest)
+	case segment.CurrentOffset > 0:
+		// the server can't continue from an offset, start over
+		if err := segment.truncate(); err != nil {
+			return err
+		}
 	}
 
 	select {
@@ -189,14 +506,16 @@ func (dl *Downloader) DownloadSegment(ctx context.Context, segment *Segment) err
 		slog.Group("segment",
 			slog.Int64("start", segment.Start),
 			slog.Int64("end", segment.End),
+			slog.Int64("offset", segment.CurrentOffset),
 			slog.Int("ID", segment.ID)),
+		slog.String("source", src.String()),
 		slog.Group("range-request",
 			slog.Bool("supported", dl.RangeSupport.SupportsRangeRequests),
 			slog.String("value", rangeRequest),
 		),
 	)
 
-	resp, err := dl.Client.httpClient.Do(req)
+	resp, err := dl.do(req, false)
 	if err != nil {
 		segment.setErr(err)
 		return err
@@ -208,9 +527,32 @@ func (dl *Downloader) DownloadSegment(ctx context.Context, segment *Segment) err
 		return segment.setDone(true)
 	}
 
+	switch {
+	case rangeRequest == "" && segment.Start == 0:
+		// the whole file is requested, e.g. from a server without range support
+	case segment.End <= 0 && resp.StatusCode == http.StatusOK:
+		// the server can't continue the stream of unknown size, it starts over
+		if err := segment.truncate(); err != nil {
+			return err
+		}
+	case segment.End <= 0 && resp.StatusCode == http.StatusPartialContent:
+		value := resp.Header.Get("Content-Range")
+		if start, _, err := parseContentRange(value); err != nil || start != offset {
+			err = fmt.Errorf("%w: %q, expected a range starting at %d", ErrInvalidContentRange, value, offset)
+			segment.setErr(err)
+			return err
+		}
+	default:
+		// the server must send the requested range, not another one or the whole file
+		if err := checkRange(resp, offset); err != nil {
+			segment.setErr(err)
+			return err
+		}
+	}
+
 	// the server sent the entire response of the request.
 	if (resp.StatusCode == http.StatusOK) || (resp.StatusCode == http.StatusPartialContent) {
-		_, err := segment.ReadFrom(resp.Body)
+		_, err := segment.ReadFrom(segment.track(stall.watch(resp.Body)))
 		if err != nil {
 			segment.setErr(err)
 			return err
@@ -5,7 +5,13 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -152,3 +158,184 @@ func TestNewDownloader(t *testing.T) {
 		}
 	})
 }
+
+func TestDownloader_Probe(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		supported bool
+		size      int64
+		method    string
+		err       error
+	}{
+		{
+			name: "HEAD",
+			handler: func(wr http.ResponseWriter, req *http.Request) {
+				http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+			},
+			supported: true,
+			size:      4000,
+			method:    http.MethodHead,
+		},
+		{
+			name: "HEAD rejected",
+			handler: func(wr http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodHead {
+					wr.WriteHeader(http.StatusForbidden)
+					return
+				}
+				http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+			},
+			supported: true,
+			size:      4000,
+			method:    http.MethodGet,
+		},
+		{
+			name: "Accept-Ranges none",
+			handler: func(wr http.ResponseWriter, req *http.Request) {
+				wr.Header().Set("Accept-Ranges", "none")
+				wr.Header().Set("Content-Length", "4000")
+			},
+			size:   4000,
+			method: http.MethodHead,
+		},
+		{
+			name: "ranges ignored",
+			handler: func(wr http.ResponseWriter, req *http.Request) {
+				wr.Header().Set("Content-Length", "4000")
+				wr.Write([]byte(content)) //nolint:errcheck
+			},
+			size:   4000,
+			method: http.MethodGet,
+		},
+		{
+			name: "rejected",
+			handler: func(wr http.ResponseWriter, req *http.Request) {
+				wr.WriteHeader(http.StatusForbidden)
+			},
+			err: ErrRangeRequestNotSupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			dl, err := NewDownloader(t.TempDir(), server.URL+"/data.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = dl.ValidateRangeSupport(context.Background(), dl.UpdateRangeSupportState)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.supported, dl.RangeSupport.SupportsRangeRequests)
+				assert.Equal(t, tt.size, dl.RangeSupport.ContentLength)
+				assert.Equal(t, tt.method, dl.RangeSupport.ProbeMethod)
+			}
+		})
+	}
+}
+
+func TestDownloader_ManagedHeaders(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+
+		assert.Empty(t, req.Header.Get("If-Range"))
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, server.URL+"/data.txt",
+		WithHeader("range", "bytes=0-9"),
+		WithHeader("If-Range", `"etag"`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDownloadManager(downloader, NewRetryPolicy(1)).Download(context.Background(), WithNumberOfSegments(2))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(got))
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(ranges)
+	assert.Equal(t, []string{"", "bytes=0-1999", "bytes=2000-3999"}, ranges, "the managed headers aren't replaced")
+}
+
+func TestDownloader_RequestOptions(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+
+	var mu sync.Mutex
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		http.SetCookie(wr, &http.Cookie{Name: "server", Value: "set"})
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	jar, err := ParseCookieFile(strings.NewReader("127.0.0.1\tFALSE\t/\tFALSE\t0\tsession\tabc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, server.URL+"/data.txt",
+		WithHeader("X-Token", "secret"),
+		WithUserAgent("dr-test"),
+		WithCookieJar(jar),
+		WithRequestModifier(func(req *http.Request) {
+			req.Header.Set("X-Signature", req.Method+" "+req.Header.Get("X-Token"))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, http.DefaultClient.Jar, "the shared client is not modified")
+
+	_, err = NewDownloadManager(downloader, NewRetryPolicy(1)).Download(context.Background(), WithNumberOfSegments(2))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, requests, 3) {
+		for _, req := range requests {
+			assert.Equal(t, "secret", req.Header.Get("X-Token"))
+			assert.Equal(t, "dr-test", req.UserAgent())
+			assert.Equal(t, req.Method+" secret", req.Header.Get("X-Signature"))
+
+			cookie, err := req.Cookie("session")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "abc", cookie.Value)
+			}
+		}
+
+		// the cookies set by the server are sent back
+		_, err = requests[2].Cookie("server")
+		assert.NoError(t, err)
+	}
+}
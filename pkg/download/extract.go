@@ -0,0 +1,344 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var ErrUnsupportedArchive = errors.New("unsupported archive format")
+
+// PostProcessor processes the downloaded file once the download is complete,
+// e.g. to decompress or extract it. The given path is the final path of the downloaded file.
+type PostProcessor interface {
+	Process(ctx context.Context, path string) error
+}
+
+// PostProcessorFunc is an adapter to allow the use of ordinary functions as a PostProcessor.
+type PostProcessorFunc func(ctx context.Context, path string) error
+
+func (f PostProcessorFunc) Process(ctx context.Context, path string) error {
+	return f(ctx, path)
+}
+
+var _ PostProcessor = (*Extractor)(nil)
+
+// Extractor is a PostProcessor that decompresses gzip, bzip2, xz and zstd files
+// and unpacks tar and zip archives into a target directory.
+//
+// The format is determined from the content of the file, the same way the extension of a
+// downloaded file is. A compressed tar archive is unpacked, any other compressed file is
+// decompressed into a file named after the downloaded one without the compression extension.
+//
+// Entries that would be written outside the target directory, either directly or through
+// a symbolic link, are rejected with ErrPathTraversal.
+type Extractor struct {
+	// TargetDir is the directory the content is extracted into.
+	// If empty, the directory of the downloaded file is used.
+	TargetDir string
+}
+
+// NewExtractor creates a new Extractor that extracts downloaded files into the given directory.
+func NewExtractor(targetDir string) *Extractor {
+	return &Extractor{TargetDir: targetDir}
+}
+
+// Process extracts the file at the given path into the target directory.
+// A truncated or corrupted compressed file fails the extraction.
+func (e *Extractor) Process(_ context.Context, path string) error {
+	root := e.TargetDir
+	if root == "" {
+		root = filepath.Dir(path)
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+
+	r := bufio.NewReader(file)
+	head, _ := r.Peek(512)
+
+	switch ct := detectContentType(head); ct {
+	case "application/zip":
+		return extractZip(root, path)
+	case "application/x-tar":
+		return extractTar(root, r)
+	case "application/x-gzip", "application/x-bzip2", "application/x-xz", "application/zstd":
+		dr, err := decompress(ct, r)
+		if err != nil {
+			return err
+		}
+
+		err = extractDecompressed(root, strings.TrimSuffix(filepath.Base(path), commonMimeTypes[ct]), path, dr)
+		if cerr := dr.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedArchive, ct)
+	}
+}
+
+// extractDecompressed unpacks the decompressed content of the file at the given path when it's a tar
+// archive, or writes it into the file of the given name, suffixed with .out when it's the one of the file.
+func extractDecompressed(root, name, path string, r io.Reader) error {
+	inner := bufio.NewReader(r)
+	head, _ := inner.Peek(512)
+	if detectContentType(head) == "application/x-tar" {
+		if err := extractTar(root, inner); err != nil {
+			return err
+		}
+		// the end of the stream is read too, a truncated or corrupted one fails its checksum
+		_, err := io.Copy(io.Discard, inner)
+		return err
+	}
+
+	if name == filepath.Base(path) {
+		name += ".out"
+	}
+	return extractFile(root, name, 0o644, inner)
+}
+
+// decompress wraps the given reader with a decompressor for the given media type.
+func decompress(mediaType string, r io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case "application/x-gzip":
+		return gzip.NewReader(r)
+	case "application/x-bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "application/x-xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case "application/zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedArchive, mediaType)
+}
+
+func extractTar(root string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(root, hdr.Name)
+		case tar.TypeReg:
+			err = extractFile(root, hdr.Name, hdr.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = extractSymlink(root, hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = extractHardLink(root, hdr.Name, hdr.Linkname)
+		default:
+			// devices, fifos and the like are not meant to be in a downloaded archive
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(root, path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close() //nolint:errcheck
+
+	for _, f := range zr.File {
+		if err := extractZipEntry(root, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractZipEntry(root string, f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return extractDir(root, f.Name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close() //nolint:errcheck
+
+	if mode&fs.ModeSymlink != 0 {
+		link, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		return extractSymlink(root, f.Name, string(link))
+	}
+
+	return extractFile(root, f.Name, mode, rc)
+}
+
+func extractDir(root, name string) error {
+	target, err := safeEntryPath(root, name)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(target, 0o755)
+}
+
+func extractFile(root, name string, mode fs.FileMode, r io.Reader) error {
+	target, err := safeEntryPath(root, name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	// never write through a symbolic link created by a previous entry
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		if err = os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0o644
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		// a partially written file must not be mistaken for a complete one
+		_ = f.Close()
+		_ = os.Remove(target)
+		return err
+	}
+
+	return f.Close()
+}
+
+func extractSymlink(root, name, link string) error {
+	target, err := safeEntryPath(root, name)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	// the link must resolve inside the root, relative to the directory it's physically created in
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realParent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, filepath.Join(realParent, link))
+	if filepath.IsAbs(link) || err != nil || !isLocalPath(rel) {
+		return fmt.Errorf("%w: %q links to %q", ErrPathTraversal, name, link)
+	}
+
+	_ = os.Remove(target)
+
+	return os.Symlink(link, target)
+}
+
+func extractHardLink(root, name, link string) error {
+	target, err := safeEntryPath(root, name)
+	if err != nil {
+		return err
+	}
+	source, err := safeEntryPath(root, link)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+
+	return os.Link(source, target)
+}
+
+// safeEntryPath resolves the name of an archive entry inside root. Unlike SafeJoin, the name may
+// contain directories, but neither the name nor the symbolic links already extracted
+// can lead outside of root.
+func safeEntryPath(root, name string) (string, error) {
+	name = filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	if filepath.IsAbs(name) || !isLocalPath(filepath.Clean(name)) {
+		return "", fmt.Errorf("%w: %q", ErrPathTraversal, name)
+	}
+
+	target := filepath.Join(root, name)
+
+	// the parent directory may be, or go through, a symbolic link created by a previous entry
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Dir(target)
+	for {
+		realParent, err := filepath.EvalSymlinks(parent)
+		if err == nil {
+			rel, err := filepath.Rel(realRoot, realParent)
+			if err != nil || !isLocalPath(rel) {
+				return "", fmt.Errorf("%w: %q", ErrPathTraversal, name)
+			}
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// walk up to the closest existing directory
+		parent = filepath.Dir(parent)
+	}
+
+	return target, nil
+}
+
+// isLocalPath reports whether the relative, cleaned path stays within its base directory.
+func isLocalPath(rel string) bool {
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,229 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+type archiveEntry struct {
+	name, body, link string
+	typeflag         byte
+}
+
+func writeTarGz(t *testing.T, path string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		hdr := &tar.Header{Name: e.name, Typeflag: typeflag, Linkname: e.link, Mode: 0o644, Size: int64(len(e.body))}
+		if typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+}
+
+func writeZip(t *testing.T, path string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+}
+
+func compressXz(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func compressZstd(t *testing.T, data []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close() //nolint:errcheck
+	return w.EncodeAll(data, nil)
+}
+
+func TestExtractor_Process(t *testing.T) {
+	t.Run("tar.gz", func(t *testing.T) {
+		dir, target := t.TempDir(), t.TempDir()
+		archive := filepath.Join(dir, "release.tar.gz")
+		writeTarGz(t, archive, []archiveEntry{
+			{name: "bin/", typeflag: tar.TypeDir},
+			{name: "bin/app", body: "binary"},
+			{name: "README", body: "readme"},
+			{name: "bin/current", link: "app", typeflag: tar.TypeSymlink},
+		})
+
+		err := NewExtractor(target).Process(context.Background(), archive)
+		if assert.NoError(t, err) {
+			got, err := os.ReadFile(filepath.Join(target, "bin", "current"))
+			assert.NoError(t, err)
+			assert.Equal(t, "binary", string(got))
+			assert.FileExists(t, filepath.Join(target, "README"))
+		}
+	})
+	t.Run("zip", func(t *testing.T) {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "docs.zip")
+		writeZip(t, archive, []archiveEntry{{name: "docs/index.html", body: "<html></html>"}})
+
+		// extracted next to the archive
+		err := NewExtractor("").Process(context.Background(), archive)
+		if assert.NoError(t, err) {
+			assert.FileExists(t, filepath.Join(dir, "docs", "index.html"))
+		}
+	})
+	t.Run("gzip single file", func(t *testing.T) {
+		dir := t.TempDir()
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, _ = gw.Write([]byte("a,b,c\n"))
+		assert.NoError(t, gw.Close())
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "export.csv.gz"), buf.Bytes(), 0o644))
+
+		err := NewExtractor("").Process(context.Background(), filepath.Join(dir, "export.csv.gz"))
+		if assert.NoError(t, err) {
+			got, err := os.ReadFile(filepath.Join(dir, "export.csv"))
+			assert.NoError(t, err)
+			assert.Equal(t, "a,b,c\n", string(got))
+		}
+	})
+	t.Run("xz and zstd", func(t *testing.T) {
+		for name, compressed := range map[string][]byte{
+			"notes.txt.xz":  compressXz(t, []byte("compressed with xz")),
+			"notes.txt.zst": compressZstd(t, []byte("compressed with zstd")),
+		} {
+			dir := t.TempDir()
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, name), compressed, 0o644))
+
+			err := NewExtractor("").Process(context.Background(), filepath.Join(dir, name))
+			if assert.NoError(t, err, name) {
+				got, err := os.ReadFile(filepath.Join(dir, "notes.txt"))
+				assert.NoError(t, err)
+				assert.Contains(t, string(got), "compressed with")
+			}
+		}
+	})
+	t.Run("unsupported format", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "plain.txt"), []byte("plain text"), 0o644))
+
+		err := NewExtractor("").Process(context.Background(), filepath.Join(dir, "plain.txt"))
+		assert.ErrorIs(t, err, ErrUnsupportedArchive)
+	})
+}
+
+func TestExtractor_PathTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+	}{
+		{
+			name:    "relative path",
+			entries: []archiveEntry{{name: "../../evil.sh", body: "evil"}},
+		},
+		{
+			name:    "absolute path",
+			entries: []archiveEntry{{name: "/tmp/evil.sh", body: "evil"}},
+		},
+		{
+			name:    "symlink outside the target",
+			entries: []archiveEntry{{name: "escape", link: "../..", typeflag: tar.TypeSymlink}},
+		},
+		{
+			name: "write through a symlink",
+			entries: []archiveEntry{
+				{name: "a/b", link: "..", typeflag: tar.TypeSymlink},
+				{name: "a/b/c", link: "..", typeflag: tar.TypeSymlink},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, target := t.TempDir(), t.TempDir()
+			archive := filepath.Join(dir, "archive.tar.gz")
+			writeTarGz(t, archive, tt.entries)
+
+			err := NewExtractor(target).Process(context.Background(), archive)
+			assert.ErrorIs(t, err, ErrPathTraversal)
+		})
+	}
+
+	t.Run("zip slip", func(t *testing.T) {
+		dir, target := t.TempDir(), t.TempDir()
+		archive := filepath.Join(dir, "archive.zip")
+		writeZip(t, archive, []archiveEntry{{name: "../evil.sh", body: "evil"}})
+
+		err := NewExtractor(target).Process(context.Background(), archive)
+		assert.ErrorIs(t, err, ErrPathTraversal)
+		assert.NoFileExists(t, filepath.Join(dir, "evil.sh"))
+	})
+}
+
+func TestExtractor_Truncated(t *testing.T) {
+	content := []byte(strings.Repeat("some log line\n", 10000))
+
+	var tarGz bytes.Buffer
+	gw := gzip.NewWriter(&tarGz)
+	tw := tar.NewWriter(gw)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "app.log", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+
+	tests := map[string][]byte{
+		"app.log.xz":  compressXz(t, content),
+		"app.log.zst": compressZstd(t, content),
+		"app.tar.gz":  tarGz.Bytes(),
+	}
+	for name, compressed := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, target := t.TempDir(), t.TempDir()
+			path := filepath.Join(dir, name)
+			// the end of the stream is missing, e.g. a download cut short
+			assert.NoError(t, os.WriteFile(path, compressed[:len(compressed)-8], 0o644))
+
+			err := NewExtractor(target).Process(context.Background(), path)
+			assert.Error(t, err)
+			if filepath.Ext(name) != ".gz" {
+				assert.NoFileExists(t, filepath.Join(target, "app.log"), "a partially written file is removed")
+			}
+		})
+	}
+}
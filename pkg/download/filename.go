@@ -0,0 +1,182 @@
+package download
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultFilename is used when neither the server nor the URL provides a usable file name.
+const defaultFilename = "download"
+
+// FileMetadata holds the information collected from the server response while probing
+// the remote file. It is used to resolve the name of the downloaded file, and is reported
+// in the Result of the download.
+type FileMetadata struct {
+	// ContentDisposition is the raw value of the Content-Disposition header, if any.
+	ContentDisposition string
+
+	// ContentType is the media type of the Content-Type header, without parameters.
+	ContentType string
+
+	// FinalURL is the URL the server eventually responded from, after following redirects.
+	FinalURL *url.URL
+
+	// Validators identify the version of the remote file.
+	Validators Validators
+}
+
+// Validators are the HTTP validators of a remote file, they change when the file changes.
+type Validators struct {
+	// ETag is the value of the ETag header, if any.
+	ETag string `json:"etag,omitempty"`
+
+	// LastModified is the time of the Last-Modified header, zero if absent or malformed.
+	LastModified time.Time `json:"last_modified,omitempty"`
+}
+
+// UpdateFileMetadata records the response headers relevant to the name of the downloaded file.
+// It is meant to be used as a ResponseCallback for ValidateRangeSupport.
+func (dl *Downloader) UpdateFileMetadata(response *http.Response) {
+	dl.Metadata.ContentDisposition = response.Header.Get("Content-Disposition")
+
+	if ct := response.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err == nil {
+			dl.Metadata.ContentType = mediaType
+		}
+	}
+
+	if response.Request != nil && response.Request.URL != nil {
+		dl.Metadata.FinalURL = response.Request.URL
+	}
+
+	dl.Metadata.Validators = Validators{ETag: response.Header.Get("ETag")}
+	if lm, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		dl.Metadata.Validators.LastModified = lm
+	}
+}
+
+// resolveFilename determines the name of the downloaded file from the collected metadata.
+// The name is taken from the first of the following that yields a usable value:
+//   - the Content-Disposition header (filename* takes precedence over filename)
+//   - the last path element of the final URL, after redirects
+//   - the last path element of the source URL
+//
+// Each candidate comes from a remote party and is passed through SanitizeFilename,
+// candidates that can't be sanitized are skipped.
+// If the resolved name has no extension, one is derived from the Content-Type header.
+func resolveFilename(src *url.URL, md FileMetadata) string {
+	candidates := []string{filenameFromContentDisposition(md.ContentDisposition)}
+	if md.FinalURL != nil {
+		candidates = append(candidates, filenameFromURL(md.FinalURL))
+	}
+	if src != nil {
+		candidates = append(candidates, filenameFromURL(src))
+	}
+
+	name := defaultFilename
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if clean, err := SanitizeFilename(candidate); err == nil {
+			name = clean
+			break
+		}
+	}
+
+	if filepath.Ext(name) == "" {
+		name += extensionFromContentType(md.ContentType)
+	}
+
+	return name
+}
+
+// filenameFromContentDisposition extracts the file name from a Content-Disposition header value.
+// The extended parameter (RFC 5987, filename*=UTF-8'en'name) is decoded and preferred over the plain one.
+func filenameFromContentDisposition(cd string) string {
+	if cd == "" {
+		return ""
+	}
+
+	// mime.ParseMediaType silently drops extended parameters with charsets other than UTF-8
+	// and rejects the whole header when a single parameter is malformed, so the parameters
+	// are scanned leniently first.
+	var plain, extended string
+	for _, part := range strings.Split(cd, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "filename":
+			plain = strings.Trim(strings.TrimSpace(value), `"`)
+		case "filename*":
+			extended = decodeExtValue(strings.Trim(strings.TrimSpace(value), `"`))
+		}
+	}
+	if extended != "" {
+		return extended
+	}
+
+	// prefer the standard parser for the plain parameter, it handles quoted-string escapes.
+	if _, params, err := mime.ParseMediaType(cd); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+
+	return plain
+}
+
+// decodeExtValue decodes an RFC 5987 ext-value (charset'language'percent-encoded-value).
+// ISO-8859-1 values are converted to UTF-8, other charsets are decoded as-is.
+func decodeExtValue(v string) string {
+	parts := strings.SplitN(v, "'", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+
+	decoded, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+
+	if strings.EqualFold(parts[0], "iso-8859-1") {
+		runes := make([]rune, 0, len(decoded))
+		for i := 0; i < len(decoded); i++ {
+			runes = append(runes, rune(decoded[i]))
+		}
+		return string(runes)
+	}
+
+	return decoded
+}
+
+// filenameFromURL returns the last element of the URL path, or an empty string
+// when the path doesn't end with a usable name.
+func filenameFromURL(u *url.URL) string {
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return ""
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	return name
+}
+
+// extensionFromContentType maps a media type to a file extension using commonMimeTypes.
+// The generic application/octet-stream type doesn't say anything about the content, hence ignored.
+func extensionFromContentType(mediaType string) string {
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		return ""
+	}
+
+	return commonMimeTypes[mediaType]
+}
@@ -0,0 +1,136 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveFilename(t *testing.T) {
+	mustParse := func(raw string) *url.URL {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	tests := []struct {
+		name string
+		src  string
+		md   FileMetadata
+		want string
+	}{
+		{
+			name: "url path",
+			src:  "https://example.com/files/report.pdf",
+			want: "report.pdf",
+		},
+		{
+			name: "content disposition",
+			src:  "https://example.com/api/download?id=123",
+			md:   FileMetadata{ContentDisposition: `attachment; filename="report.pdf"`},
+			want: "report.pdf",
+		},
+		{
+			name: "content disposition extended value takes precedence",
+			src:  "https://example.com/api/download?id=123",
+			md:   FileMetadata{ContentDisposition: `attachment; filename="fallback.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+			want: "résumé.pdf",
+		},
+		{
+			name: "content disposition with latin-1 extended value",
+			src:  "https://example.com/api/download?id=123",
+			md:   FileMetadata{ContentDisposition: `attachment; filename="fallback.pdf"; filename*=iso-8859-1'en'%E9t%E9.pdf`},
+			want: "été.pdf",
+		},
+		{
+			name: "content disposition with traversal",
+			src:  "https://example.com/api/download?id=123",
+			md:   FileMetadata{ContentDisposition: `attachment; filename="../../.bashrc"`},
+			want: "bashrc",
+		},
+		{
+			name: "unusable content disposition falls back to url",
+			src:  "https://example.com/files/report.pdf",
+			md:   FileMetadata{ContentDisposition: `attachment; filename="NUL"`},
+			want: "report.pdf",
+		},
+		{
+			name: "final url after redirect",
+			src:  "https://example.com/latest",
+			md:   FileMetadata{FinalURL: mustParse("https://cdn.example.com/releases/app-1.2.0.tar.gz?sig=abc")},
+			want: "app-1.2.0.tar.gz",
+		},
+		{
+			name: "extension from content type",
+			src:  "https://example.com/api/export",
+			md:   FileMetadata{ContentType: "application/json"},
+			want: "export.json",
+		},
+		{
+			name: "generic content type is ignored",
+			src:  "https://example.com/api/export",
+			md:   FileMetadata{ContentType: "application/octet-stream"},
+			want: "export",
+		},
+		{
+			name: "no usable name",
+			src:  "https://example.com/?id=123",
+			md:   FileMetadata{ContentType: "application/zip"},
+			want: "download.zip",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, resolveFilename(mustParse(tt.src), tt.md))
+		})
+	}
+}
+
+func TestDownloader_UpdateFileMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/latest" {
+			http.Redirect(wr, req, "/releases/data", http.StatusFound)
+			return
+		}
+		wr.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		wr.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dl, err := NewDownloader(t.TempDir(), server.URL+"/latest")
+	if assert.NoError(t, err) {
+		err = dl.ValidateRangeSupport(context.Background(), dl.UpdateRangeSupportState, dl.UpdateFileMetadata)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "text/csv", dl.Metadata.ContentType)
+			assert.Equal(t, "/releases/data", dl.Metadata.FinalURL.Path)
+			assert.Equal(t, "data.csv", dl.Filename())
+		}
+	}
+}
+
+func TestSegmentManager_MergeFilesKeepsExtension(t *testing.T) {
+	dir := t.TempDir()
+
+	sm, err := NewSegmentManager(dir, 0)
+	if assert.NoError(t, err) {
+		_, err = sm.Segments[0].Write([]byte("PK\x03\x04 not really a zip"))
+		assert.NoError(t, err)
+
+		path, err := sm.MergeFiles("archive.zip")
+		if assert.NoError(t, err) {
+			assert.Equal(t, filepath.Join(dir, "archive.zip"), path)
+			assert.FileExists(t, path)
+			_, err = os.Stat(filepath.Join(dir, "archive.zip.zip"))
+			assert.True(t, os.IsNotExist(err))
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// hedger triggers the hedged requests of a download once enough of its segments are done.
+type hedger struct {
+	// threshold is the number of done segments from which the in-flight segments are hedged.
+	threshold int
+
+	mu   sync.Mutex
+	done int
+
+	once    sync.Once
+	trigger chan struct{}
+}
+
+// newHedger returns a hedger triggering once the given fraction of the total segments is done,
+// done being the number of segments already done. It returns nil when hedging is disabled.
+func newHedger(fraction float64, total, done int) *hedger {
+	if fraction <= 0 {
+		return nil
+	}
+
+	h := &hedger{
+		threshold: max(1, int(math.Ceil(fraction*float64(total)))),
+		trigger:   make(chan struct{}),
+	}
+	for range done {
+		h.segmentDone()
+	}
+
+	return h
+}
+
+// segmentDone records a done segment.
+func (h *hedger) segmentDone() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.done++
+	if h.done >= h.threshold {
+		h.once.Do(func() { close(h.trigger) })
+	}
+}
+
+// raceSegment downloads the segment, see fetchSegment. When hedging is enabled and the segment
+// is still in flight once enough segments are done, its range is also requested on a second
+// connection, from the next healthy mirror. Whichever request finishes first wins, the other one
+// is canceled and the data of the hedged request is discarded unless it won.
+func (dm *DownloadManager) raceSegment(ctx context.Context, seg *Segment, h *hedger) error {
+	if h == nil || !dm.Downloader.RangeSupport.SupportsRangeRequests || seg.End <= 0 {
+		return dm.fetchSegment(ctx, seg)
+	}
+
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	defer cancelPrimary()
+
+	primary := make(chan error, 1)
+	go func() { primary <- dm.fetchSegment(primaryCtx, seg) }()
+
+	select {
+	case err := <-primary:
+		if err == nil {
+			h.segmentDone()
+		}
+		return err
+	case <-h.trigger:
+	}
+
+	hedge, err := dm.newHedgeSegment(seg)
+	if err != nil {
+		dm.Downloader.Logger.Warn("hedging segment failed",
+			slog.Int("segment", seg.ID),
+			slog.String("error", err.Error()),
+		)
+		if err = <-primary; err == nil {
+			h.segmentDone()
+		}
+		return err
+	}
+	defer dm.discardHedge(hedge)
+
+	dm.Downloader.Logger.Debug("hedging segment", slog.Int("segment", seg.ID))
+
+	hedgeCtx, cancelHedge := context.WithCancel(ctx)
+	defer cancelHedge()
+
+	hedged := make(chan error, 1)
+	go func() { hedged <- dm.fetchSegment(hedgeCtx, hedge) }()
+
+	var primaryErr, hedgeErr error
+	select {
+	case primaryErr = <-primary:
+		if primaryErr == nil {
+			cancelHedge()
+		}
+		hedgeErr = <-hedged
+	case hedgeErr = <-hedged:
+		if hedgeErr == nil {
+			cancelPrimary()
+		}
+		primaryErr = <-primary
+	}
+
+	switch {
+	case primaryErr == nil:
+	case hedgeErr == nil && ctx.Err() == nil:
+		if err = seg.adopt(hedge); err != nil {
+			return err
+		}
+		seg.hedged, seg.source = true, hedge.source
+		dm.mirrors.addBytes(hedge.source, hedge.CurrentOffset)
+		dm.Downloader.Logger.Debug("hedged request won",
+			slog.Int("segment", seg.ID),
+			slog.String("source", hedge.source.String()),
+		)
+	default:
+		return primaryErr
+	}
+
+	h.segmentDone()
+	return nil
+}
+
+// newHedgeSegment returns a segment requesting the same range as the given one, written to its own file.
+func (dm *DownloadManager) newHedgeSegment(seg *Segment) (*Segment, error) {
+	name := seg.Name + "-hedge"
+	file, err := NewFileWriter(dm.Segm.DestinationDir, name)
+	if err != nil {
+		return nil, err
+	}
+	// a leftover of an interrupted download must not be appended to
+	if err = file.Truncate(0); err != nil {
+		file.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	return NewSegment(SegmentParams{
+		ID:             seg.ID,
+		Name:           name,
+		Start:          seg.Start,
+		End:            seg.End,
+		MaxSegmentSize: seg.MaxSegmentSize,
+		Writer:         file,
+	})
+}
+
+// discardHedge closes and removes the file of a hedged segment.
+func (dm *DownloadManager) discardHedge(hedge *Segment) {
+	_ = hedge.Close()
+	_ = os.Remove(filepath.Join(dm.Segm.DestinationDir, hedge.Name))
+}
+
+// adopt replaces the data of the segment with the data of the given hedged segment,
+// which downloaded the same range, and marks the segment as done.
+func (seg *Segment) adopt(hedge *Segment) error {
+	if err := seg.truncate(); err != nil {
+		return err
+	}
+
+	src, ok := hedge.Writer.(io.ReadSeeker)
+	if !ok {
+		return errors.New("hedged segment writer is not readable")
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	seg.Err = nil
+	n, err := seg.ReadFrom(src)
+	seg.reportProgress(n)
+	if err != nil {
+		return err
+	}
+
+	return seg.setDone(true)
+}
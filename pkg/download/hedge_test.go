@@ -0,0 +1,148 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTailServer serves content, the requests of the given range are handled by tail in the order they're received.
+func newTailServer(t *testing.T, content, tailRange string, tail ...func(wr http.ResponseWriter, req *http.Request)) *httptest.Server {
+	var mu sync.Mutex
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet && req.Header.Get("Range") == tailRange {
+			mu.Lock()
+			n := requests
+			requests++
+			mu.Unlock()
+
+			if n < len(tail) {
+				tail[n](wr, req)
+				return
+			}
+		}
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// stall sends the first bytes of the range then blocks until the request is canceled.
+func stall(content string, start int) func(wr http.ResponseWriter, req *http.Request) {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Range", "bytes */*")
+		wr.WriteHeader(http.StatusPartialContent)
+		wr.Write([]byte(content[start : start+10])) //nolint:errcheck
+		http.NewResponseController(wr).Flush()      //nolint:errcheck
+		<-req.Context().Done()
+	}
+}
+
+func TestDownloadManager_Hedging(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+	// the last of 4 segments
+	tailRange := "bytes=3000-3999"
+
+	tests := []struct {
+		name   string
+		tail   []func(wr http.ResponseWriter, req *http.Request)
+		hedged int
+	}{
+		{
+			name:   "hedged request wins",
+			tail:   []func(wr http.ResponseWriter, req *http.Request){stall(content, 3000)},
+			hedged: 1,
+		},
+		{
+			name: "first request wins",
+			tail: []func(wr http.ResponseWriter, req *http.Request){
+				func(wr http.ResponseWriter, req *http.Request) {
+					time.Sleep(200 * time.Millisecond)
+					http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+				},
+				stall(content, 3000),
+			},
+			hedged: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTailServer(t, content, tailRange, tt.tail...)
+
+			dir := t.TempDir()
+			downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1), WithHedging(0.75))
+			result, err := dm.Download(context.Background(), WithNumberOfSegments(4))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got), "the data of the losing request is discarded")
+			assert.Equal(t, tt.hedged, result.Hedged)
+			assert.Equal(t, int64(len(content)), dm.Progress.Snapshot().Downloaded)
+
+			entries, err := os.ReadDir(dir)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1, "the hedged segment files are removed")
+		})
+	}
+}
+
+func TestDownloadManager_HedgingDisabled(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+	server := newTailServer(t, content, "bytes=3000-3999", func(wr http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	})
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewDownloadManager(downloader, NewRetryPolicy(1)).Download(context.Background(), WithNumberOfSegments(4))
+	if assert.NoError(t, err) {
+		assert.Zero(t, result.Hedged)
+	}
+}
+
+func TestNewHedger(t *testing.T) {
+	assert.Nil(t, newHedger(0, 4, 0))
+
+	h := newHedger(0.75, 4, 2)
+	assert.Equal(t, 3, h.threshold)
+
+	select {
+	case <-h.trigger:
+		t.Fatal("triggered before the threshold")
+	default:
+	}
+
+	h.segmentDone()
+	select {
+	case <-h.trigger:
+	default:
+		t.Fatal("not triggered at the threshold")
+	}
+
+	// done segments past the threshold don't close the trigger twice
+	h.segmentDone()
+}
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"context"
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// DownloadInfo describes the outcome of a download, it is handed to the completion and failure hooks.
+type DownloadInfo struct {
+	// Path is the final path of the downloaded file. It's empty when the download failed.
+	Path string
+
+	// Size is the size of the downloaded file, in bytes.
+	Size int64
+
+	// Hashes maps a hash algorithm name (md5, sha256) to the hex encoded digest of the downloaded file.
+	Hashes map[string]string
+
+	// SourceURL is the address the file was downloaded from.
+	SourceURL string
+
+	// Err is the error the download failed with, it's only set for failure hooks.
+	Err error
+}
+
+// Hook is a function run after a download finalized, successfully or not.
+// A non-nil error returned by a hook is reflected in the result of the download.
+type Hook func(ctx context.Context, info DownloadInfo) error
+
+// CommandHook returns a Hook that runs the given command line with the system shell.
+// The download information is passed to the command through the following environment variables:
+//
+//	DR_PATH        the final path of the downloaded file
+//	DR_SIZE        the size of the downloaded file in bytes
+//	DR_MD5         the md5 digest of the downloaded file
+//	DR_SHA256      the sha256 digest of the downloaded file
+//	DR_SOURCE_URL  the address the file was downloaded from
+//	DR_ERROR       the error message, for failed downloads
+//
+// The output of the command is forwarded to the standard output and error. A non-zero exit status
+// is returned as an *exec.ExitError.
+func CommandHook(command string) Hook {
+	return func(ctx context.Context, info DownloadInfo) error {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command)
+		}
+
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), info.environ()...)
+
+		return cmd.Run()
+	}
+}
+
+// environ returns the download information as a list of environment variables.
+func (info DownloadInfo) environ() []string {
+	env := []string{
+		"DR_PATH=" + info.Path,
+		"DR_SIZE=" + strconv.FormatInt(info.Size, 10),
+		"DR_MD5=" + info.Hashes["md5"],
+		"DR_SHA256=" + info.Hashes["sha256"],
+		"DR_SOURCE_URL=" + info.SourceURL,
+	}
+	if info.Err != nil {
+		env = append(env, "DR_ERROR="+info.Err.Error())
+	}
+
+	return env
+}
+
+// hashFile computes the size and the md5 and sha256 digests of the file at the given path.
+func hashFile(path string) (int64, map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	md5Hash, sha256Hash := md5.New(), sha256.New() //nolint:gosec
+	n, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return n, map[string]string{
+		"md5":    hex.EncodeToString(md5Hash.Sum(nil)),
+		"sha256": hex.EncodeToString(sha256Hash.Sum(nil)),
+	}, nil
+}
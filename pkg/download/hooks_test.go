@@ -0,0 +1,138 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadManager_Hooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(wr, req)
+			return
+		}
+		http.ServeContent(wr, req, "hello.txt", time.Time{}, strings.NewReader("hello world"))
+	}))
+	defer server.Close()
+
+	t.Run("on complete", func(t *testing.T) {
+		dir := t.TempDir()
+		downloader, err := NewDownloader(dir, server.URL+"/hello.txt")
+		if assert.NoError(t, err) {
+			var got DownloadInfo
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1), WithOnComplete(func(ctx context.Context, info DownloadInfo) error {
+				got = info
+				return nil
+			}))
+
+			_, err = dm.Download(context.Background())
+			if assert.NoError(t, err) {
+				assert.Equal(t, filepath.Join(dir, "hello.txt"), got.Path)
+				assert.Equal(t, int64(11), got.Size)
+				assert.Equal(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", got.Hashes["md5"])
+				assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", got.Hashes["sha256"])
+				assert.Equal(t, server.URL+"/hello.txt", got.SourceURL)
+			}
+		}
+	})
+	t.Run("on complete failure is reflected", func(t *testing.T) {
+		downloader, err := NewDownloader(t.TempDir(), server.URL+"/hello.txt")
+		if assert.NoError(t, err) {
+			hookErr := errors.New("scan failed")
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1), WithOnComplete(func(ctx context.Context, info DownloadInfo) error {
+				return hookErr
+			}))
+
+			_, err = dm.Download(context.Background())
+			assert.ErrorIs(t, err, hookErr)
+		}
+	})
+	t.Run("on failure", func(t *testing.T) {
+		downloader, err := NewDownloader(t.TempDir(), server.URL+"/missing")
+		if assert.NoError(t, err) {
+			var got DownloadInfo
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1), WithOnFailure(func(ctx context.Context, info DownloadInfo) error {
+				got = info
+				return nil
+			}))
+
+			_, err = dm.Download(context.Background())
+			assert.Error(t, err)
+			assert.Equal(t, err, got.Err)
+			assert.Empty(t, got.Path)
+		}
+	})
+}
+
+func TestDownloadManager_FailureHookAfterCancel(t *testing.T) {
+	content := strings.Repeat("0123456789", 300)
+	server, _ := newPausableServer(t, content, make(chan struct{}))
+
+	downloader, err := NewDownloader(t.TempDir(), server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failure DownloadInfo
+	hookErr := errors.New("not called")
+	dm := NewDownloadManager(downloader, NewRetryPolicy(1), WithOnFailure(func(ctx context.Context, info DownloadInfo) error {
+		failure, hookErr = info, ctx.Err()
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := dm.Download(ctx, WithNumberOfSegments(3))
+		done <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		return dm.Progress.Snapshot().Downloaded > 0
+	}, 5*time.Second, 5*time.Millisecond)
+	cancel()
+
+	err = <-done
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, hookErr, "the hook runs with a live context")
+	assert.ErrorIs(t, failure.Err, context.Canceled)
+}
+
+func TestCommandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands rely on a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	info := DownloadInfo{
+		Path:      "/downloads/file.zip",
+		Size:      42,
+		Hashes:    map[string]string{"sha256": "abc"},
+		SourceURL: "https://example.com/file.zip",
+	}
+
+	err := CommandHook(`echo "$DR_PATH $DR_SIZE $DR_SHA256 $DR_SOURCE_URL" > `+out)(context.Background(), info)
+	if assert.NoError(t, err) {
+		got, err := os.ReadFile(out)
+		assert.NoError(t, err)
+		assert.Equal(t, "/downloads/file.zip 42 abc https://example.com/file.zip\n", string(got))
+	}
+
+	err = CommandHook("exit 3")(context.Background(), info)
+	var exitErr *exec.ExitError
+	if assert.ErrorAs(t, err, &exitErr) {
+		assert.Equal(t, 3, exitErr.ExitCode())
+	}
+}
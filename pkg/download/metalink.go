@@ -0,0 +1,316 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"  //nolint:gosec
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidMetalink = errors.New("invalid metalink document")
+
+// metalinkHashes lists the hash algorithms supported for the verification of metalink files,
+// from the strongest to the weakest.
+var metalinkHashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New}, //nolint:gosec
+	{"md5", md5.New},   //nolint:gosec
+}
+
+// defaultMetalinkPriority is the priority of URLs without one, they come after the others.
+const defaultMetalinkPriority = 999999
+
+// Metalink is a Metalink document, it describes files along with their mirrors and hashes.
+// Both Metalink 4 (RFC 5854, .meta4) and Metalink 3 (.metalink) documents are supported.
+type Metalink struct {
+	Files []MetalinkFile
+}
+
+// MetalinkFile is a file described by a Metalink document.
+type MetalinkFile struct {
+	// Name is the name of the file.
+	Name string
+
+	// Size is the size of the file in bytes, zero when unknown.
+	Size int64
+
+	// Hashes holds the hex encoded digests of the whole file, indexed by algorithm, e.g. sha256.
+	Hashes map[string]string
+
+	// Pieces holds the digests of consecutive pieces of the file, if any.
+	Pieces *MetalinkPieces
+
+	// URLs are the HTTP(S) mirrors of the file, sorted by priority.
+	URLs []MetalinkURL
+}
+
+// MetalinkPieces are the digests of consecutive pieces of a file.
+type MetalinkPieces struct {
+	// Algorithm is the hash algorithm, e.g. sha1.
+	Algorithm string
+
+	// Length is the size of every piece in bytes, except the last one which may be shorter.
+	Length int64
+
+	// Hashes holds the hex encoded digest of every piece, in order.
+	Hashes []string
+}
+
+// MetalinkURL is a mirror of a file.
+type MetalinkURL struct {
+	// URL is the address of the mirror.
+	URL string
+
+	// Location is the ISO 3166-1 alpha-2 country code of the mirror, if any.
+	Location string
+
+	// Priority orders the mirrors, lower values come first.
+	Priority int
+}
+
+// metalinkXML maps both Metalink 4 and Metalink 3 documents, the elements are matched on their local name.
+type metalinkXML struct {
+	Files   []metalinkFileXML `xml:"file"`
+	V3Files []metalinkFileXML `xml:"files>file"`
+}
+
+type metalinkFileXML struct {
+	Name     string              `xml:"name,attr"`
+	Size     int64               `xml:"size"`
+	Hashes   []metalinkHashXML   `xml:"hash"`
+	Pieces   []metalinkPiecesXML `xml:"pieces"`
+	URLs     []metalinkURLXML    `xml:"url"`
+	V3Hashes []metalinkHashXML   `xml:"verification>hash"`
+	V3Pieces []metalinkPiecesXML `xml:"verification>pieces"`
+	V3URLs   []metalinkURLXML    `xml:"resources>url"`
+}
+
+type metalinkHashXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPiecesXML struct {
+	Type   string            `xml:"type,attr"`
+	Length int64             `xml:"length,attr"`
+	Hashes []metalinkHashXML `xml:"hash"`
+}
+
+type metalinkURLXML struct {
+	Location string `xml:"location,attr"`
+	Priority int    `xml:"priority,attr"`
+	// Preference is the Metalink 3 counterpart of Priority, from 1 to 100 where higher values come first.
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
+
+// ParseMetalinkFile reads the Metalink document at the given path, see ParseMetalink.
+func ParseMetalinkFile(path string) (*Metalink, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	ml, err := ParseMetalink(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return ml, nil
+}
+
+// ParseMetalink reads a Metalink document. Only the HTTP(S) URLs of the files are kept,
+// and the hash algorithms are normalized, e.g. sha-256 becomes sha256.
+// Files without any usable URL are reported as an ErrInvalidMetalink error.
+func ParseMetalink(r io.Reader) (*Metalink, error) {
+	var doc metalinkXML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetalink, err)
+	}
+
+	ml := &Metalink{}
+	for _, fx := range append(doc.Files, doc.V3Files...) {
+		file := MetalinkFile{
+			Name:   strings.TrimSpace(fx.Name),
+			Size:   fx.Size,
+			Hashes: make(map[string]string),
+		}
+
+		for _, h := range append(fx.Hashes, fx.V3Hashes...) {
+			file.Hashes[normalizeHashName(h.Type)] = strings.ToLower(strings.TrimSpace(h.Value))
+		}
+
+		if pieces := append(fx.Pieces, fx.V3Pieces...); len(pieces) > 0 {
+			p := pieces[0]
+			file.Pieces = &MetalinkPieces{Algorithm: normalizeHashName(p.Type), Length: p.Length}
+			for _, h := range p.Hashes {
+				file.Pieces.Hashes = append(file.Pieces.Hashes, strings.ToLower(strings.TrimSpace(h.Value)))
+			}
+		}
+
+		for _, ux := range fx.URLs {
+			file.addURL(ux.Value, ux.Location, ux.Priority)
+		}
+		for _, ux := range fx.V3URLs {
+			priority := 0
+			if ux.Preference > 0 {
+				priority = 101 - ux.Preference
+			}
+			file.addURL(ux.Value, ux.Location, priority)
+		}
+		sort.SliceStable(file.URLs, func(i, j int) bool {
+			return file.URLs[i].Priority < file.URLs[j].Priority
+		})
+
+		if len(file.URLs) == 0 {
+			return nil, fmt.Errorf("%w: file %q has no HTTP(S) url", ErrInvalidMetalink, file.Name)
+		}
+		ml.Files = append(ml.Files, file)
+	}
+
+	if len(ml.Files) == 0 {
+		return nil, fmt.Errorf("%w: no file", ErrInvalidMetalink)
+	}
+
+	return ml, nil
+}
+
+func (f *MetalinkFile) addURL(raw, location string, priority int) {
+	u, err := url.ParseRequestURI(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+	if priority <= 0 {
+		priority = defaultMetalinkPriority
+	}
+
+	f.URLs = append(f.URLs, MetalinkURL{URL: u.String(), Location: strings.ToLower(location), Priority: priority})
+}
+
+// normalizeHashName turns a hash name of a Metalink document into the one used by this package, e.g. sha-256 into sha256.
+func normalizeHashName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "")
+}
+
+// BatchEntry returns the download of the file: the URL with the highest priority is the source, the
+// others are its mirrors, the ones with a lower priority being used once the better ones are excluded,
+// see WithMirrorPriority. The checksum is set when the file has a sha256 or md5 hash. The mismatching
+// pieces are downloaded again, see WithPieceHashes, and the file is verified by VerifyMetalink before
+// it's post-processed.
+func (f MetalinkFile) BatchEntry() BatchEntry {
+	entry := BatchEntry{URL: f.URLs[0].URL}
+	for _, u := range f.URLs[1:] {
+		if u.Priority == f.URLs[0].Priority {
+			entry.Mirrors = append(entry.Mirrors, u.URL)
+			continue
+		}
+		entry.DownloaderOptions = append(entry.DownloaderOptions, WithMirrorPriority(u.Priority-f.URLs[0].Priority, u.URL))
+	}
+
+	// the pieces are checked and downloaded again piece by piece, the rest of the file is verified afterwards
+	verified := f
+	verified.Pieces = nil
+	if f.Pieces != nil {
+		entry.ManagerOptions = append(entry.ManagerOptions, WithPieceHashes(f.Pieces))
+	}
+	entry.ManagerOptions = append(entry.ManagerOptions, WithVerifier(VerifyMetalink(verified)))
+
+	// the name may contain directories, only the last element is kept
+	if name, err := SanitizeFilename(f.Name); err == nil {
+		entry.Filename = name
+	}
+
+	for _, algorithm := range []string{"sha256", "md5"} {
+		if value, ok := f.Hashes[algorithm]; ok {
+			entry.Checksum = algorithm + ":" + value
+			break
+		}
+	}
+
+	return entry
+}
+
+// VerifyMetalink returns a Hook that fails the download with ErrChecksumMismatch when the downloaded
+// file doesn't match the size, the strongest supported whole-file hash, or the piece hashes of the
+// metalink file. The indexes of the mismatching pieces are reported in the error, see WithVerifier.
+func VerifyMetalink(file MetalinkFile) Hook {
+	return func(_ context.Context, info DownloadInfo) error {
+		if file.Size > 0 && info.Size != file.Size {
+			return fmt.Errorf("%w: expected %d bytes, got %d", ErrChecksumMismatch, file.Size, info.Size)
+		}
+
+		for _, h := range metalinkHashes {
+			expected, ok := file.Hashes[h.name]
+			if !ok {
+				continue
+			}
+			got, ok := info.Hashes[h.name]
+			if !ok {
+				var err error
+				if got, err = hashFileWith(info.Path, h.new()); err != nil {
+					return err
+				}
+			}
+			if got != expected {
+				return fmt.Errorf("%w: expected %s:%s, got %s:%s", ErrChecksumMismatch, h.name, expected, h.name, got)
+			}
+			break
+		}
+
+		if file.Pieces != nil {
+			return verifyPieces(info.Path, file.Pieces)
+		}
+
+		return nil
+	}
+}
+
+// verifyPieces checks the piece hashes of the file at the given path.
+func verifyPieces(path string, pieces *MetalinkPieces) error {
+	newHash := pieceHash(pieces)
+	if newHash == nil {
+		// pieces that can't be verified are ignored, like unsupported whole-file hashes
+		return nil
+	}
+
+	mismatches, err := mismatchingPieces(path, pieces, newHash)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: %s pieces %v of %d", ErrChecksumMismatch, pieces.Algorithm, mismatches, len(pieces.Hashes))
+	}
+
+	return nil
+}
+
+// hashFileWith returns the hex encoded digest of the file at the given path.
+func hashFileWith(path string, h hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() //nolint:errcheck
+
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
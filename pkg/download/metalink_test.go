@@ -0,0 +1,285 @@
+package download
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const metalink4 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example/example.ext">
+    <size>11</size>
+    <hash type="sha-256">%SHA256%</hash>
+    <pieces length="4" type="sha-1">
+      <hash>%PIECE0%</hash>
+      <hash>%PIECE1%</hash>
+      <hash>%PIECE2%</hash>
+    </pieces>
+    <url location="us" priority="2">http://us.example.com/example.ext</url>
+    <url location="de" priority="1">https://de.example.com/example.ext</url>
+    <url>ftp://ftp.example.com/example.ext</url>
+    <url>http://other.example.com/example.ext</url>
+    <metaurl mediatype="torrent" priority="1">http://example.com/example.ext.torrent</metaurl>
+  </file>
+</metalink>`
+
+const metalink3 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.ext">
+      <size>11</size>
+      <verification>
+        <hash type="md5">5eb63bbbe01eeed093cb22bb8f5acdc3</hash>
+      </verification>
+      <resources>
+        <url type="http" location="us" preference="10">http://us.example.com/example.ext</url>
+        <url type="http" location="de" preference="90">http://de.example.com/example.ext</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+func sum(data string, sha string) string {
+	if sha == "sha1" {
+		h := sha1.Sum([]byte(data)) //nolint:gosec
+		return hex.EncodeToString(h[:])
+	}
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func newMetalink4(content string) string {
+	return strings.NewReplacer(
+		"%SHA256%", sum(content, "sha256"),
+		"%PIECE0%", sum(content[0:4], "sha1"),
+		"%PIECE1%", sum(content[4:8], "sha1"),
+		"%PIECE2%", sum(content[8:], "sha1"),
+	).Replace(metalink4)
+}
+
+func TestParseMetalink(t *testing.T) {
+	t.Run("metalink 4", func(t *testing.T) {
+		ml, err := ParseMetalink(strings.NewReader(newMetalink4("hello world")))
+		if !assert.NoError(t, err) || !assert.Len(t, ml.Files, 1) {
+			return
+		}
+
+		file := ml.Files[0]
+		assert.Equal(t, "example/example.ext", file.Name)
+		assert.Equal(t, int64(11), file.Size)
+		assert.Equal(t, sum("hello world", "sha256"), file.Hashes["sha256"])
+		if assert.NotNil(t, file.Pieces) {
+			assert.Equal(t, "sha1", file.Pieces.Algorithm)
+			assert.Equal(t, int64(4), file.Pieces.Length)
+			assert.Len(t, file.Pieces.Hashes, 3)
+		}
+		assert.Equal(t, []MetalinkURL{
+			{URL: "https://de.example.com/example.ext", Location: "de", Priority: 1},
+			{URL: "http://us.example.com/example.ext", Location: "us", Priority: 2},
+			{URL: "http://other.example.com/example.ext", Priority: defaultMetalinkPriority},
+		}, file.URLs)
+
+		entry := file.BatchEntry()
+		assert.Equal(t, "https://de.example.com/example.ext", entry.URL)
+		assert.Empty(t, entry.Mirrors, "the other mirrors have a lower priority")
+		assert.Len(t, entry.DownloaderOptions, 2)
+		assert.Len(t, entry.ManagerOptions, 2, "the pieces and the whole file are verified")
+		assert.Equal(t, "example.ext", entry.Filename)
+		assert.Equal(t, "sha256:"+sum("hello world", "sha256"), entry.Checksum)
+
+		downloader, err := NewDownloader(t.TempDir(), entry.URL, entry.DownloaderOptions...)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []int{1, defaultMetalinkPriority - 1}, downloader.MirrorPriorities)
+		}
+	})
+	t.Run("metalink 3", func(t *testing.T) {
+		ml, err := ParseMetalink(strings.NewReader(metalink3))
+		if !assert.NoError(t, err) || !assert.Len(t, ml.Files, 1) {
+			return
+		}
+
+		file := ml.Files[0]
+		assert.Equal(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", file.Hashes["md5"])
+		if assert.Len(t, file.URLs, 2) {
+			assert.Equal(t, "http://de.example.com/example.ext", file.URLs[0].URL)
+		}
+		assert.Equal(t, "md5:5eb63bbbe01eeed093cb22bb8f5acdc3", file.BatchEntry().Checksum)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseMetalink(strings.NewReader("not xml"))
+		assert.ErrorIs(t, err, ErrInvalidMetalink)
+
+		_, err = ParseMetalink(strings.NewReader(`<metalink><file name="a"><url>ftp://example.com/a</url></file></metalink>`))
+		assert.ErrorIs(t, err, ErrInvalidMetalink)
+	})
+}
+
+func TestVerifyMetalink(t *testing.T) {
+	ml, err := ParseMetalink(strings.NewReader(newMetalink4("hello world")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := ml.Files[0]
+
+	verify := func(content string) error {
+		path := filepath.Join(t.TempDir(), "example.ext")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		size, hashes, err := hashFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VerifyMetalink(file)(context.Background(), DownloadInfo{Path: path, Size: size, Hashes: hashes})
+	}
+
+	assert.NoError(t, verify("hello world"))
+	assert.ErrorIs(t, verify("hello"), ErrChecksumMismatch)
+	assert.ErrorIs(t, verify("hello w0rld"), ErrChecksumMismatch)
+
+	// without the whole-file hash, the pieces point at the corrupted data
+	delete(file.Hashes, "sha256")
+	err = verify("hello w0rld")
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, "pieces [1] of 3")
+}
+
+// pieceServer serves content, with the first byte of every piece of the given length corrupted when corrupt is set.
+// It records the ranges of the GET requests.
+type pieceServer struct {
+	content     string
+	pieceLength int
+	corrupt     bool
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *pieceServer) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, req.Header.Get("Range"))
+		s.mu.Unlock()
+	}
+
+	content := []byte(s.content)
+	if s.corrupt {
+		for i := 0; i < len(content); i += s.pieceLength {
+			content[i] ^= 0xff
+		}
+	}
+	http.ServeContent(wr, req, "", time.Time{}, strings.NewReader(string(content)))
+}
+
+// pieceRequests returns the number of GET requests of a single piece.
+func (s *pieceServer) pieceRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, r := range s.ranges {
+		first, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+		start, _ := strconv.Atoi(first)
+		end, err := strconv.Atoi(last)
+		if ok && err == nil && start%s.pieceLength == 0 && end-start+1 == s.pieceLength {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestBatch_MetalinkPieces(t *testing.T) {
+	const pieceLength = 500
+	content := strings.Repeat("0123456789", 400)
+
+	var pieces strings.Builder
+	for i := 0; i < len(content); i += pieceLength {
+		fmt.Fprintf(&pieces, "<hash>%s</hash>", sum(content[i:i+pieceLength], "sha1"))
+	}
+	newMetalink := func(urls ...string) MetalinkFile {
+		doc := fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="data.bin"><size>%d</size>`+
+			`<hash type="sha-256">%s</hash><pieces length="%d" type="sha-1">%s</pieces>`,
+			len(content), sum(content, "sha256"), pieceLength, pieces.String())
+		for _, u := range urls {
+			doc += `<url priority="1">` + u + `</url>`
+		}
+		ml, err := ParseMetalink(strings.NewReader(doc + `</file></metalink>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ml.Files[0]
+	}
+
+	t.Run("corrupted pieces are downloaded again", func(t *testing.T) {
+		corrupt := &pieceServer{content: content, pieceLength: pieceLength, corrupt: true}
+		good := &pieceServer{content: content, pieceLength: pieceLength}
+		corruptServer, goodServer := httptest.NewServer(corrupt), httptest.NewServer(good)
+		defer corruptServer.Close()
+		defer goodServer.Close()
+
+		dir := t.TempDir()
+		file := newMetalink(corruptServer.URL+"/data.bin", goodServer.URL+"/data.bin")
+		batch, err := NewBatch([]BatchEntry{file.BatchEntry()},
+			WithOutputDir(dir),
+			WithSegmentOptions(WithNumberOfSegments(4)),
+			WithBatchRetryPolicy(func() *RetryPolicy { return NewRetryPolicy(2) }),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := batch.Run(context.Background())
+		if !assert.Len(t, results, 1) || !assert.Equal(t, BatchSucceeded, results[0].Status, results[0].Err) {
+			return
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(got))
+
+		// the 2 segments of the corrupted mirror hold 4 pieces, they're downloaded again from the other one
+		assert.Equal(t, 4, good.pieceRequests())
+		assert.Zero(t, corrupt.pieceRequests(), "the corrupted mirror is excluded")
+	})
+
+	t.Run("pieces can't be repaired", func(t *testing.T) {
+		corrupt := &pieceServer{content: content, pieceLength: pieceLength, corrupt: true}
+		server := httptest.NewServer(corrupt)
+		defer server.Close()
+
+		target := t.TempDir()
+		file := newMetalink(server.URL + "/data.bin")
+		batch, err := NewBatch([]BatchEntry{file.BatchEntry()},
+			WithOutputDir(t.TempDir()),
+			WithManagerOptions(WithPostProcessor(NewExtractor(target))),
+			WithBatchRetryPolicy(func() *RetryPolicy { return NewRetryPolicy(1) }),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := batch.Run(context.Background())
+		if assert.Len(t, results, 1) {
+			assert.ErrorIs(t, results[0].Err, ErrChecksumMismatch)
+			assert.ErrorContains(t, results[0].Err, "pieces [0 1 2 3 4 5 6 7] of 8")
+		}
+		assert.Equal(t, 8, corrupt.pieceRequests(), "the last mirror is retried once")
+		entries, err := os.ReadDir(target)
+		assert.NoError(t, err)
+		assert.Empty(t, entries, "the file isn't post-processed")
+	})
+}
@@ -45,6 +45,8 @@ var commonMimeTypes = map[string]string{
 	"application/x-rar-compressed": ".rar",
 	"application/x-bzip":           ".bz",
 	"application/x-bzip2":          ".bz2",
+	"application/x-xz":             ".xz",
+	"application/zstd":             ".zst",
 	"application/json":             ".json",
 	"application/xml":              ".xml",
 	"application/zip":              ".zip",
@@ -0,0 +1,268 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrMirrorMismatch = errors.New("mirror doesn't match the source")
+
+// MirrorStats are the statistics of a source of a download, i.e. the source URL or a mirror.
+type MirrorStats struct {
+	// URL is the address of the mirror.
+	URL string
+
+	// Segments is the number of segments downloaded from the mirror.
+	Segments int
+
+	// Bytes is the number of bytes downloaded from the mirror.
+	Bytes int64
+
+	// Failures is the number of failed attempts to download a segment from the mirror.
+	Failures int
+
+	// Healthy is false for a mirror that was excluded from the download, see Err.
+	Healthy bool
+
+	// Err is the reason the mirror was excluded from the download.
+	Err error
+}
+
+// mirror is a source of a download.
+type mirror struct {
+	url *url.URL
+
+	segments atomic.Int64
+	bytes    atomic.Int64
+	failures atomic.Int64
+
+	// priority orders the mirrors, the segments are downloaded from the healthy ones with the lowest value.
+	priority int
+
+	// healthy and err are guarded by the lock of the pool.
+	healthy bool
+	err     error
+}
+
+// mirrorPool spreads the segments of a download across its sources, the first one being the
+// source URL of the Downloader. A mirror on which the RetryPolicy is exhausted is considered
+// unhealthy, and its segments are reassigned to the remaining healthy mirrors.
+type mirrorPool struct {
+	// mirrors is not modified once the pool is created, only the state of its elements is.
+	mirrors []*mirror
+
+	mu   sync.Mutex
+	next int
+}
+
+func newMirrorPool(urls ...*url.URL) *mirrorPool {
+	p := &mirrorPool{}
+	for _, u := range urls {
+		p.mirrors = append(p.mirrors, &mirror{url: u, healthy: true})
+	}
+
+	return p
+}
+
+// newDownloaderMirrorPool returns the pool of the source URL and the mirrors of the Downloader, with their priorities.
+func newDownloaderMirrorPool(dl *Downloader) *mirrorPool {
+	p := newMirrorPool(append([]*url.URL{dl.SourceURL}, dl.Mirrors...)...)
+	for i, priority := range dl.MirrorPriorities {
+		if i < len(dl.Mirrors) {
+			p.mirrors[i+1].priority = priority
+		}
+	}
+
+	return p
+}
+
+// assign returns the next healthy mirror with the lowest priority value in a round-robin fashion,
+// or nil if there is none.
+func (p *mirrorPool) assign() *mirror {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *mirror
+	for _, m := range p.mirrors {
+		if m.healthy && (best == nil || m.priority < best.priority) {
+			best = m
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	for range p.mirrors {
+		m := p.mirrors[p.next%len(p.mirrors)]
+		p.next++
+		if m.healthy && m.priority == best.priority {
+			return m
+		}
+	}
+
+	return best
+}
+
+// exclude marks the mirror as unhealthy because of the given error.
+// It reports whether healthy mirrors remain.
+func (p *mirrorPool) exclude(m *mirror, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if m.healthy {
+		m.healthy, m.err = false, err
+	}
+	for _, other := range p.mirrors {
+		if other.healthy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reject records that the mirror of the given URL served corrupted data, it's excluded
+// because of the given error, unless it's the last healthy one.
+func (p *mirrorPool) reject(u *url.URL, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var rejected *mirror
+	healthy := 0
+	for _, m := range p.mirrors {
+		if m.url == u {
+			rejected = m
+		}
+		if m.healthy {
+			healthy++
+		}
+	}
+	if rejected == nil {
+		return
+	}
+
+	rejected.failures.Add(1)
+	if rejected.healthy && healthy > 1 {
+		rejected.healthy, rejected.err = false, err
+	}
+}
+
+// addBytes records n bytes downloaded from the given URL.
+func (p *mirrorPool) addBytes(u *url.URL, n int64) {
+	for _, m := range p.mirrors {
+		if m.url == u {
+			m.bytes.Add(n)
+			return
+		}
+	}
+}
+
+// stats returns the statistics of the mirrors, in the order they were given.
+func (p *mirrorPool) stats() []MirrorStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]MirrorStats, len(p.mirrors))
+	for i, m := range p.mirrors {
+		stats[i] = MirrorStats{
+			URL:      m.url.String(),
+			Segments: int(m.segments.Load()),
+			Bytes:    m.bytes.Load(),
+			Failures: int(m.failures.Load()),
+			Healthy:  m.healthy,
+			Err:      m.err,
+		}
+	}
+
+	return stats
+}
+
+// probeMirrors checks that the mirrors of the Downloader serve the same file as its source URL,
+// which must have been probed already. Mirrors are compared on the size of the file, the range
+// support and, when both sides send them, the ETag and Last-Modified validators.
+// Mirrors that can't be probed or don't match are excluded from the pool.
+func (dm *DownloadManager) probeMirrors(ctx context.Context, pool *mirrorPool) {
+	dl := dm.Downloader
+	for _, m := range pool.mirrors[1:] {
+		probed := &Downloader{}
+		err := dl.probe(ctx, m.url, probed.UpdateRangeSupportState, probed.UpdateFileMetadata)
+		if err == nil {
+			err = compareMirror(dl, probed)
+		}
+		if err != nil {
+			pool.exclude(m, err)
+			dl.Logger.Warn("mirror excluded",
+				slog.String("mirror", m.url.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// compareMirror returns an ErrMirrorMismatch error if the probed mirror doesn't serve the same file as the source.
+func compareMirror(src, mirror *Downloader) error {
+	switch a, b := src.RangeSupport, mirror.RangeSupport; {
+	case a.ContentLength != b.ContentLength:
+		return fmt.Errorf("%w: size %d, expected %d", ErrMirrorMismatch, b.ContentLength, a.ContentLength)
+	case a.SupportsRangeRequests != b.SupportsRangeRequests:
+		return fmt.Errorf("%w: range requests support differs", ErrMirrorMismatch)
+	}
+
+	switch a, b := src.Metadata.Validators, mirror.Metadata.Validators; {
+	case a.ETag != "" && b.ETag != "" && a.ETag != b.ETag:
+		return fmt.Errorf("%w: ETag %s, expected %s", ErrMirrorMismatch, b.ETag, a.ETag)
+	case !a.LastModified.IsZero() && !b.LastModified.IsZero() && !a.LastModified.Equal(b.LastModified):
+		return fmt.Errorf("%w: Last-Modified %s, expected %s", ErrMirrorMismatch, b.LastModified, a.LastModified)
+	}
+
+	return nil
+}
+
+// fetchSegment downloads the segment from a healthy mirror, applying the RetryPolicy.
+// When the policy is exhausted, the mirror is excluded and the segment is reassigned
+// to the next healthy mirror, until none remains.
+func (dm *DownloadManager) fetchSegment(ctx context.Context, seg *Segment) error {
+	for {
+		m := dm.mirrors.assign()
+		if m == nil {
+			return errors.New("no healthy mirror left")
+		}
+		seg.source = m.url
+
+		attempts := 0
+		err := dm.RetryPolicy.Retry(ctx, seg.ID, func() error {
+			if attempts > 0 {
+				seg.retries++
+			}
+			attempts++
+
+			err := dm.downloadSegment(ctx, seg)
+			if errors.Is(err, ErrRangeIgnored) {
+				// retrying is pointless, the rest of the file is streamed instead
+				dm.ignoreRanges(seg, err)
+			}
+			if err != nil && ctx.Err() == nil {
+				m.failures.Add(1)
+			}
+			return err
+		})
+		if err == nil {
+			m.segments.Add(1)
+			return nil
+		}
+		if ctx.Err() != nil || !dm.mirrors.exclude(m, err) {
+			return err
+		}
+
+		dm.Downloader.Logger.Warn("mirror failed, reassigning segment",
+			slog.String("mirror", m.url.String()),
+			slog.Int("segment", seg.ID),
+			slog.String("error", err.Error()),
+		)
+	}
+}
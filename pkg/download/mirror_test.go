@@ -0,0 +1,134 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadManager_Mirrors(t *testing.T) {
+	content := strings.Repeat("0123456789", 600)
+	serve := func(content string, fail bool) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			if fail && req.Method == http.MethodGet {
+				http.Error(wr, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	source := serve(content, false)
+	healthy := serve(content, false)
+	different := serve(content+"extra", false)
+	failing := serve(content, true)
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, source.URL+"/data.txt",
+		WithMirrors(healthy.URL+"/data.txt", different.URL+"/data.txt", failing.URL+"/data.txt"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewDownloadManager(downloader, NewRetryPolicy(2)).Download(context.Background(), WithNumberOfSegments(6))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(got))
+
+	if assert.Len(t, result.Mirrors, 4) {
+		src, ok, diff, bad := result.Mirrors[0], result.Mirrors[1], result.Mirrors[2], result.Mirrors[3]
+
+		assert.True(t, src.Healthy)
+		assert.True(t, ok.Healthy)
+		assert.Equal(t, 6, src.Segments+ok.Segments, "the segments of the failing mirror are reassigned")
+		assert.Equal(t, int64(len(content)), src.Bytes+ok.Bytes)
+		assert.Positive(t, ok.Segments)
+
+		assert.False(t, diff.Healthy)
+		assert.ErrorIs(t, diff.Err, ErrMirrorMismatch)
+		assert.Zero(t, diff.Segments)
+
+		assert.False(t, bad.Healthy)
+		assert.Error(t, bad.Err)
+		assert.Zero(t, bad.Segments)
+		assert.Positive(t, bad.Failures)
+	}
+}
+
+func TestNewDownloader_InvalidMirror(t *testing.T) {
+	_, err := NewDownloader(t.TempDir(), "http://example.com/file", WithMirrors("not a url"))
+	assert.ErrorContains(t, err, "invalid mirror")
+}
+
+func TestCompareMirror(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := &Downloader{
+		RangeSupport: RangeSupport{SupportsRangeRequests: true, ContentLength: 100},
+		Metadata:     FileMetadata{Validators: Validators{ETag: `"a"`, LastModified: modTime}},
+	}
+
+	tests := []struct {
+		name   string
+		mirror Downloader
+		match  bool
+	}{
+		{"same", *src, true},
+		{"no validators", Downloader{RangeSupport: src.RangeSupport}, true},
+		{"size", Downloader{RangeSupport: RangeSupport{SupportsRangeRequests: true, ContentLength: 99}}, false},
+		{"ranges", Downloader{RangeSupport: RangeSupport{ContentLength: 100}}, false},
+		{"etag", Downloader{RangeSupport: src.RangeSupport, Metadata: FileMetadata{Validators: Validators{ETag: `"b"`}}}, false},
+		{"last modified", Downloader{RangeSupport: src.RangeSupport, Metadata: FileMetadata{Validators: Validators{LastModified: modTime.Add(time.Hour)}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := compareMirror(src, &tt.mirror)
+			if tt.match {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrMirrorMismatch)
+			}
+		})
+	}
+}
+
+func TestMirrorPool_Priorities(t *testing.T) {
+	source, _ := url.Parse("http://source.example.com/data.txt")
+	primary, _ := url.Parse("http://primary.example.com/data.txt")
+	fallback, _ := url.Parse("http://fallback.example.com/data.txt")
+	pool := newDownloaderMirrorPool(&Downloader{
+		SourceURL:        source,
+		Mirrors:          []*url.URL{fallback, primary},
+		MirrorPriorities: []int{10},
+	})
+
+	assigned := map[*url.URL]int{}
+	for range 6 {
+		assigned[pool.assign().url]++
+	}
+	assert.Equal(t, map[*url.URL]int{source: 3, primary: 3}, assigned, "the fallback mirror isn't used")
+
+	pool.exclude(pool.mirrors[0], assert.AnError)
+	pool.exclude(pool.mirrors[2], assert.AnError)
+	assert.Same(t, fallback, pool.assign().url, "the fallback mirror replaces the excluded ones")
+
+	pool.reject(fallback, assert.AnError)
+	if m := pool.assign(); assert.NotNil(t, m, "the last healthy mirror isn't excluded") {
+		assert.Same(t, fallback, m.url)
+		assert.Equal(t, int64(1), m.failures.Load())
+	}
+}
@@ -0,0 +1,254 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrMultiRangeNotSupported = errors.New("server doesn't support multi-range requests")
+	ErrInvalidContentRange    = errors.New("invalid Content-Range")
+)
+
+// WithMultiRange is an option function that requests up to n segment ranges in a single request,
+// e.g. Range: bytes=0-99,100-199, for servers that limit the number of connections per client.
+// The multipart/byteranges response is demultiplexed into the segments. When the server ignores
+// the ranges and sends the whole file, the segments are requested one by one instead.
+func WithMultiRange(n int) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.MultiRange = n
+	}
+}
+
+// DownloadSegments downloads the remaining ranges of the given segments in a single multi-range request.
+// The parts of the response are written to the segments they belong to, a segment is done once
+// its whole range is received. The segments the server didn't send are left as they are, they
+// can be downloaded with DownloadSegment. It returns ErrMultiRangeNotSupported when the server
+// ignored the ranges.
+func (dl *Downloader) DownloadSegments(ctx context.Context, segments []*Segment) error {
+	src := dl.SourceURL
+	var ranges []string
+	var pending []*Segment
+	for _, seg := range segments {
+		if seg.source != nil {
+			src = seg.source
+		}
+
+		seg.Err = nil
+		if err := seg.syncOffset(); err != nil {
+			return err
+		}
+
+		start := seg.Start + seg.CurrentOffset
+		if seg.Done || start > seg.End {
+			continue
+		}
+		ranges = append(ranges, strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(seg.End, 10))
+		pending = append(pending, seg)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctx, stall := dl.watchStall(ctx)
+	defer stall.stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	rangeRequest := "bytes=" + strings.Join(ranges, ",")
+	req.Header.Set("Range", rangeRequest)
+
+	dl.Logger.Debug("multi-range download",
+		slog.Int("segments", len(pending)),
+		slog.String("source", src.String()),
+		slog.String("range-request", rangeRequest),
+	)
+
+	resp, err := dl.do(req, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return ErrMultiRangeNotSupported
+	default:
+		return fmt.Errorf("server responded with: %s error", resp.Status)
+	}
+
+	body := stall.watch(resp.Body)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		// a single range, e.g. the server coalesced adjacent ranges
+		start, end, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		return writeRange(pending, start, end, body)
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		start, end, err := parseContentRange(part.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if err = writeRange(pending, start, end, part); err != nil {
+			return err
+		}
+	}
+}
+
+// writeRange writes the range [start, end] of the file read from r to the segments it covers,
+// the range may span several adjacent segments.
+func writeRange(segments []*Segment, start, end int64, r io.Reader) error {
+	for pos := start; pos <= end; {
+		seg := segmentAt(segments, pos)
+		if seg == nil {
+			return fmt.Errorf("%w: unexpected range %d-%d", ErrInvalidContentRange, start, end)
+		}
+
+		n := min(end, seg.End) - pos + 1
+		written, err := seg.ReadFrom(seg.track(io.LimitReader(r, n)))
+		if err == nil && written < n {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			seg.setErr(err)
+			return err
+		}
+		if seg.Start+seg.CurrentOffset > seg.End {
+			if err = seg.setDone(true); err != nil {
+				return err
+			}
+		}
+		pos += n
+	}
+
+	return nil
+}
+
+// segmentAt returns the segment whose next byte to write is at the given position of the file, or nil.
+func segmentAt(segments []*Segment, pos int64) *Segment {
+	for _, seg := range segments {
+		if !seg.Done && seg.Start+seg.CurrentOffset == pos {
+			return seg
+		}
+	}
+
+	return nil
+}
+
+// parseContentRange parses the range of a Content-Range header, e.g. bytes 0-99/200.
+func parseContentRange(value string) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidContentRange, value)
+	}
+	spec, _, _ = strings.Cut(spec, "/")
+
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidContentRange, value)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err == nil {
+		end, err = strconv.ParseInt(last, 10, 64)
+	}
+	if err != nil || start < 0 || end < start {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidContentRange, value)
+	}
+
+	return start, end, nil
+}
+
+// contentRangeSize returns the size of the file of a Content-Range header, e.g. 200 for bytes 0-99/200.
+// It reports false when the size is unknown, i.e. bytes 0-99/*.
+func contentRangeSize(value string) (int64, bool) {
+	_, size, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// downloadMultiRange downloads the pending segments in multi-range requests of up to
+// Downloader.MultiRange segments each, from the healthy mirrors. It's a best effort:
+// the segments that are not done afterwards are downloaded one by one, with retries.
+func (dm *DownloadManager) downloadMultiRange(ctx context.Context) {
+	dl := dm.Downloader
+
+	var pending []*Segment
+	for _, seg := range dm.Segm.Segments {
+		if !seg.Done && seg.End > 0 {
+			pending = append(pending, seg)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for len(pending) > 1 {
+		n := min(dl.MultiRange, len(pending))
+		batch := pending[:n]
+		pending = pending[n:]
+
+		m := dm.mirrors.assign()
+		if m == nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for _, seg := range batch {
+				seg.source = m.url
+			}
+
+			err := dl.DownloadSegments(ctx, batch)
+			for _, seg := range batch {
+				if seg.Done {
+					m.segments.Add(1)
+				}
+			}
+			switch {
+			case err == nil || ctx.Err() != nil:
+			case errors.Is(err, ErrMultiRangeNotSupported):
+				dl.Logger.Info("multi-range request ignored by the server, downloading segments one by one",
+					slog.String("source", m.url.String()),
+				)
+			default:
+				m.failures.Add(1)
+				dl.Logger.Warn("multi-range request failed, downloading segments one by one",
+					slog.String("source", m.url.String()),
+					slog.String("error", err.Error()),
+				)
+			}
+		}()
+	}
+	wg.Wait()
+}
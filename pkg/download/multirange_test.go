@@ -0,0 +1,115 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadManager_MultiRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+	serveContent := func(wr http.ResponseWriter, req *http.Request) {
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}
+
+	tests := []struct {
+		name       string
+		multiRange func(wr http.ResponseWriter, req *http.Request)
+		requests   int64
+	}{
+		{
+			name:       "multipart/byteranges",
+			multiRange: serveContent,
+			requests:   1,
+		},
+		{
+			name: "ranges ignored",
+			multiRange: func(wr http.ResponseWriter, req *http.Request) {
+				wr.Write([]byte(content)) //nolint:errcheck
+			},
+			requests: 1 + 4,
+		},
+		{
+			name: "ranges coalesced",
+			multiRange: func(wr http.ResponseWriter, req *http.Request) {
+				// only the first two segments, as a single range
+				wr.Header().Set("Content-Range", "bytes 0-1999/4000")
+				wr.WriteHeader(http.StatusPartialContent)
+				wr.Write([]byte(content[:2000])) //nolint:errcheck
+			},
+			requests: 1 + 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodGet {
+					serveContent(wr, req)
+					return
+				}
+				requests.Add(1)
+				if strings.Contains(req.Header.Get("Range"), ",") {
+					tt.multiRange(wr, req)
+					return
+				}
+				serveContent(wr, req)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			downloader, err := NewDownloader(dir, server.URL+"/data.txt", WithMultiRange(4))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+			_, err = dm.Download(context.Background(), WithNumberOfSegments(4))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got))
+			assert.Equal(t, tt.requests, requests.Load())
+			assert.Equal(t, int64(len(content)), dm.Progress.Snapshot().Downloaded)
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int64
+		valid      bool
+	}{
+		{"bytes 0-99/200", 0, 99, true},
+		{"bytes 100-199/*", 100, 199, true},
+		{"bytes */200", 0, 0, false},
+		{"bytes 99-0/200", 0, 0, false},
+		{"0-99/200", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			start, end, err := parseContentRange(tt.value)
+			if !tt.valid {
+				assert.ErrorIs(t, err, ErrInvalidContentRange)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.start, start)
+				assert.Equal(t, tt.end, end)
+			}
+		})
+	}
+}
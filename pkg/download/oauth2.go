@@ -0,0 +1,174 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTokenRequest is returned when an access token can't be obtained from the token endpoint.
+var ErrTokenRequest = errors.New("oauth2 token request failed")
+
+// DefaultTokenExpiryDelta is how long before it expires an access token is refreshed when OAuth2.ExpiryDelta is zero.
+const DefaultTokenExpiryDelta = 30 * time.Second
+
+var _ Reauthenticator = (*OAuth2)(nil)
+
+// OAuth2 authenticates the requests with an access token obtained from a token endpoint with the
+// OAuth 2.0 client credentials grant, or the refresh token grant when RefreshToken is set. The token
+// is cached, it's refreshed shortly before it expires and when a request is rejected with 401 Unauthorized.
+// It must not be copied once used.
+type OAuth2 struct {
+	// TokenURL is the address of the token endpoint.
+	TokenURL string
+
+	// ClientID and ClientSecret are the credentials of the client, sent with HTTP Basic authentication.
+	ClientID, ClientSecret string
+
+	// Scopes are the requested scopes, none by default.
+	Scopes []string
+
+	// RefreshToken is the refresh token exchanged for the access tokens. It's replaced when the token
+	// endpoint issues a new one.
+	RefreshToken string
+
+	// ExpiryDelta is how long before it expires an access token is refreshed, DefaultTokenExpiryDelta when zero.
+	ExpiryDelta time.Duration
+
+	// HTTPClient sends the token requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+
+	mu    sync.Mutex
+	token *oauth2Token
+}
+
+// oauth2Token is an access token issued by the token endpoint.
+type oauth2Token struct {
+	// authorization is the Authorization header value of the token.
+	authorization string
+
+	// expiry is when the token must be refreshed, it's zero for tokens that don't expire.
+	expiry time.Time
+}
+
+// oauth2TokenResponse is the response of the token endpoint, see RFC 6749 section 5.
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Apply sets the Authorization header of the request, requesting an access token first when none
+// is cached or the cached one is about to expire.
+func (o *OAuth2) Apply(ctx context.Context, req *http.Request) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token == nil || (!o.token.expiry.IsZero() && time.Now().After(o.token.expiry)) {
+		token, err := o.requestToken(ctx)
+		if err != nil {
+			return err
+		}
+		o.token = token
+	}
+	req.Header.Set("Authorization", o.token.authorization)
+
+	return nil
+}
+
+// Reauthenticate discards the cached access token when the server rejected it, so that a new one is
+// requested. A request authenticated with an older token is retried with the current one.
+func (o *OAuth2) Reauthenticate(_ context.Context, resp *http.Response) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token != nil && resp.Request != nil && resp.Request.Header.Get("Authorization") == o.token.authorization {
+		o.token = nil
+	}
+
+	return true, nil
+}
+
+// requestToken requests a new access token from the token endpoint.
+func (o *OAuth2) requestToken(ctx context.Context) (*oauth2Token, error) {
+	form := url.Values{}
+	if o.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", o.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenRequest, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+
+	client := o.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenRequest, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenRequest, err)
+	}
+
+	var token oauth2TokenResponse
+	if err = json.Unmarshal(body, &token); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("%w: invalid response: %v", ErrTokenRequest, err)
+	}
+	switch {
+	case token.Error != "":
+		return nil, fmt.Errorf("%w: %s: %s %s", ErrTokenRequest, resp.Status, token.Error, token.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: %s", ErrTokenRequest, resp.Status)
+	case token.AccessToken == "":
+		return nil, fmt.Errorf("%w: no access token in the response", ErrTokenRequest)
+	}
+
+	if token.RefreshToken != "" {
+		o.RefreshToken = token.RefreshToken
+	}
+
+	tokenType := token.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	issued := &oauth2Token{authorization: tokenType + " " + token.AccessToken}
+	if token.ExpiresIn > 0 {
+		delta := o.ExpiryDelta
+		if delta == 0 {
+			delta = DefaultTokenExpiryDelta
+		}
+		// a token shorter lived than the delta is used until it expires
+		delta = min(delta, time.Duration(token.ExpiresIn)*time.Second/2)
+		issued.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - delta)
+	}
+
+	return issued, nil
+}
@@ -0,0 +1,149 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTokenServer issues the access tokens tok-1, tok-2... valid for expiresIn seconds. The returned
+// function returns the number of issued tokens and the form of the last token request.
+func newTokenServer(t *testing.T, expiresIn int) (*httptest.Server, func() (int, map[string]string)) {
+	var mu sync.Mutex
+	var issued int
+	var form map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if id, secret, ok := req.BasicAuth(); !ok || id != "client" || secret != "s3cr3t" {
+			wr.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(wr).Encode(map[string]string{"error": "invalid_client"}) //nolint:errcheck
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			wr.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		issued++
+		form = map[string]string{}
+		for name := range req.PostForm {
+			form[name] = req.PostForm.Get(name)
+		}
+		n := issued
+		mu.Unlock()
+
+		json.NewEncoder(wr).Encode(map[string]any{ //nolint:errcheck
+			"access_token":  "tok-" + strconv.Itoa(n),
+			"token_type":    "bearer",
+			"expires_in":    expiresIn,
+			"refresh_token": "refresh-" + strconv.Itoa(n),
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() (int, map[string]string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return issued, form
+	}
+}
+
+func TestOAuth2_Apply(t *testing.T) {
+	tokenServer, stats := newTokenServer(t, 1)
+
+	auth := &OAuth2{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "s3cr3t", Scopes: []string{"read", "files"}}
+	req := httptest.NewRequest(http.MethodGet, "http://files.example/data.txt", http.NoBody)
+
+	if assert.NoError(t, auth.Apply(context.Background(), req)) {
+		assert.Equal(t, "Bearer tok-1", req.Header.Get("Authorization"))
+	}
+	_, form := stats()
+	assert.Equal(t, map[string]string{"grant_type": "client_credentials", "scope": "read files"}, form)
+
+	// cached
+	assert.NoError(t, auth.Apply(context.Background(), req))
+	assert.Equal(t, "Bearer tok-1", req.Header.Get("Authorization"))
+
+	// refreshed before it expires
+	time.Sleep(600 * time.Millisecond)
+	assert.NoError(t, auth.Apply(context.Background(), req))
+	assert.Equal(t, "Bearer tok-2", req.Header.Get("Authorization"))
+
+	issued, _ := stats()
+	assert.Equal(t, 2, issued)
+}
+
+func TestOAuth2_RefreshToken(t *testing.T) {
+	tokenServer, stats := newTokenServer(t, 3600)
+
+	auth := &OAuth2{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "s3cr3t", RefreshToken: "initial"}
+	req := httptest.NewRequest(http.MethodGet, "http://files.example/data.txt", http.NoBody)
+
+	assert.NoError(t, auth.Apply(context.Background(), req))
+	_, form := stats()
+	assert.Equal(t, map[string]string{"grant_type": "refresh_token", "refresh_token": "initial"}, form)
+	assert.Equal(t, "refresh-1", auth.RefreshToken, "the rotated refresh token is kept")
+
+	auth = &OAuth2{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "wrong"}
+	err := auth.Apply(context.Background(), req)
+	assert.ErrorIs(t, err, ErrTokenRequest)
+	assert.ErrorContains(t, err, "invalid_client")
+}
+
+func TestDownloadManager_OAuth2(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	tokenServer, stats := newTokenServer(t, 3600)
+
+	// tok-1 is revoked once it was used for two downloads
+	var mu sync.Mutex
+	var used int
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		authorization := req.Header.Get("Authorization")
+		valid := authorization == "Bearer tok-2" || (authorization == "Bearer tok-1" && used < 2)
+		if valid && authorization == "Bearer tok-1" && req.Method == http.MethodGet {
+			used++
+		}
+		mu.Unlock()
+
+		if !valid {
+			wr.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(WithAuth(&OAuth2{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "s3cr3t"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloader, err := NewDownloader(t.TempDir(), server.URL+"/data.txt", WithClient(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the segments are not retried by the policy, only once with a new token
+	dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+	result, err := dm.Download(context.Background(), WithNumberOfSegments(4))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := os.ReadFile(result.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(got))
+
+	issued, _ := stats()
+	assert.Equal(t, 2, issued, "the revoked token is refreshed once")
+}
@@ -0,0 +1,177 @@
+package download
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// WithPieceHashes is an option function that verifies the downloaded file against the digests of its
+// consecutive pieces, e.g. the ones of a metalink file, before it's verified and post-processed.
+// The pieces that don't match are downloaded again, up to the MaxRetries of the RetryPolicy, and the
+// mirrors that served them are excluded as long as other healthy ones remain.
+func WithPieceHashes(pieces *MetalinkPieces) DownloadManagerOption {
+	return func(dm *DownloadManager) {
+		dm.Pieces = pieces
+	}
+}
+
+// repairPieces downloads again the pieces of the file at the given path that don't match their digest,
+// until they all match. It returns an ErrChecksumMismatch error listing the pieces that still don't.
+func (dm *DownloadManager) repairPieces(ctx context.Context, path string) error {
+	pieces := dm.Pieces
+	newHash := pieceHash(pieces)
+	if newHash == nil {
+		// pieces that can't be verified are ignored, like unsupported whole-file hashes
+		return nil
+	}
+
+	// the sources of the pieces are the ones of the segments they overlap
+	sources := make(map[int][]*url.URL)
+	for i := range pieces.Hashes {
+		start, end := pieces.bounds(i, dm.Segm.FileSize)
+		for _, seg := range dm.Segm.Segments {
+			if seg.source != nil && seg.Start <= end && seg.End >= start {
+				sources[i] = append(sources[i], seg.source)
+			}
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		mismatches, err := mismatchingPieces(path, pieces, newHash)
+		if err != nil || len(mismatches) == 0 {
+			return err
+		}
+
+		mismatchErr := fmt.Errorf("%w: %s pieces %v of %d", ErrChecksumMismatch, pieces.Algorithm, mismatches, len(pieces.Hashes))
+		if attempt >= dm.RetryPolicy.MaxRetries || !dm.Downloader.RangeSupport.SupportsRangeRequests || dm.Segm.FileSize <= 0 {
+			return mismatchErr
+		}
+
+		for _, i := range mismatches {
+			if start, _ := pieces.bounds(i, dm.Segm.FileSize); start >= dm.Segm.FileSize {
+				// the piece is beyond the end of the file, it can't be downloaded
+				return mismatchErr
+			}
+		}
+
+		for _, i := range mismatches {
+			for _, u := range sources[i] {
+				dm.mirrors.reject(u, fmt.Errorf("%w: %s piece %d", ErrChecksumMismatch, pieces.Algorithm, i))
+			}
+
+			dm.Downloader.Logger.Warn("piece mismatch, downloading it again",
+				slog.Int("piece", i),
+				slog.Int("attempt", attempt+1),
+			)
+
+			source, err := dm.downloadPiece(ctx, path, i)
+			if err != nil {
+				return fmt.Errorf("downloading piece %d: %w", i, err)
+			}
+			sources[i] = []*url.URL{source}
+		}
+	}
+}
+
+// downloadPiece downloads the i-th piece from a healthy mirror and writes it in place in the file
+// at the given path, it returns the URL the piece was downloaded from.
+func (dm *DownloadManager) downloadPiece(ctx context.Context, path string, i int) (*url.URL, error) {
+	start, end := dm.Pieces.bounds(i, dm.Segm.FileSize)
+
+	name := fmt.Sprintf("segment-%d-piece-%d", dm.Segm.ID, i)
+	file, err := NewFileWriter(dm.Segm.DestinationDir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(filepath.Join(dm.Segm.DestinationDir, name)) //nolint:errcheck
+	defer file.Close()                                           //nolint:errcheck
+
+	// a leftover of an interrupted download must not be appended to
+	if err = file.Truncate(0); err != nil {
+		return nil, err
+	}
+
+	seg, err := NewSegment(SegmentParams{
+		ID:             i,
+		Name:           name,
+		Start:          start,
+		End:            end,
+		MaxSegmentSize: end - start + 1,
+		Writer:         file,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = dm.fetchSegment(ctx, seg); err != nil {
+		return nil, err
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	dst, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(io.NewOffsetWriter(dst, start), file); err != nil {
+		dst.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	return seg.source, dst.Close()
+}
+
+// bounds returns the first and the last byte of the i-th piece of a file of the given size.
+func (p *MetalinkPieces) bounds(i int, size int64) (int64, int64) {
+	start := int64(i) * p.Length
+	end := start + p.Length - 1
+	if size > 0 && end >= size {
+		end = size - 1
+	}
+
+	return start, end
+}
+
+// pieceHash returns the hash function of the pieces, or nil when they can't be verified.
+func pieceHash(pieces *MetalinkPieces) func() hash.Hash {
+	if pieces == nil || pieces.Length <= 0 {
+		return nil
+	}
+	for _, h := range metalinkHashes {
+		if h.name == pieces.Algorithm {
+			return h.new
+		}
+	}
+
+	return nil
+}
+
+// mismatchingPieces returns the indexes of the pieces of the file at the given path that don't match their digest.
+func mismatchingPieces(path string, pieces *MetalinkPieces, newHash func() hash.Hash) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var mismatches []int
+	for i, expected := range pieces.Hashes {
+		h := newHash()
+		if _, err = io.CopyN(h, f, pieces.Length); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != expected {
+			mismatches = append(mismatches, i)
+		}
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,97 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Progress tracks the number of bytes downloaded by a DownloadManager, it's safe for concurrent use.
+type Progress struct {
+	total      atomic.Int64
+	downloaded atomic.Int64
+	started    atomic.Int64
+}
+
+// ProgressSnapshot is the state of a download at a point in time.
+type ProgressSnapshot struct {
+	// Downloaded is the number of bytes downloaded so far.
+	Downloaded int64 `json:"downloaded"`
+
+	// Total is the size of the file, zero or negative when unknown.
+	Total int64 `json:"total"`
+
+	// Elapsed is the time since the download started.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// Speed is the average download speed, in bytes per second.
+	Speed float64 `json:"speed"`
+}
+
+// Percent returns the downloaded percentage, or -1 when the file size is unknown.
+func (s ProgressSnapshot) Percent() float64 {
+	if s.Total <= 0 {
+		return -1
+	}
+
+	return float64(s.Downloaded) * 100 / float64(s.Total)
+}
+
+// Snapshot returns the current state of the download.
+func (p *Progress) Snapshot() ProgressSnapshot {
+	s := ProgressSnapshot{
+		Downloaded: p.downloaded.Load(),
+		Total:      p.total.Load(),
+	}
+
+	if started := p.started.Load(); started > 0 {
+		s.Elapsed = time.Since(time.Unix(0, started))
+		if seconds := s.Elapsed.Seconds(); seconds > 0 {
+			s.Speed = float64(s.Downloaded) / seconds
+		}
+	}
+
+	return s
+}
+
+// start resets the progress for a download of the given size.
+func (p *Progress) start(total int64) {
+	p.total.Store(total)
+	p.downloaded.Store(0)
+	p.started.Store(time.Now().UnixNano())
+}
+
+// setTotal sets the size of the file once it's known, e.g. at the end of a stream of unknown length.
+func (p *Progress) setTotal(total int64) {
+	p.total.Store(total)
+}
+
+// add records n downloaded bytes, n is negative when downloaded data is discarded.
+func (p *Progress) add(n int64) {
+	p.downloaded.Add(n)
+}
+
+// progressReader reports the bytes read from the underlying reader.
+type progressReader struct {
+	r   io.Reader
+	add func(n int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.add(int64(n))
+	}
+	return n, err
+}
+
+// String formats the snapshot for humans, e.g. 45.2% of 10.0 MiB at 1.2 MiB/s.
+func (s ProgressSnapshot) String() string {
+	speed := formatBytes(int64(s.Speed)) + "/s"
+	if s.Total <= 0 {
+		return fmt.Sprintf("%s at %s", formatBytes(s.Downloaded), speed)
+	}
+
+	return fmt.Sprintf("%.1f%% of %s at %s", s.Percent(), formatBytes(s.Total), speed)
+}
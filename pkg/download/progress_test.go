@@ -0,0 +1,34 @@
+package download
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	p := &Progress{}
+	assert.Equal(t, ProgressSnapshot{}, p.Snapshot())
+
+	p.start(20)
+	r := &progressReader{r: strings.NewReader("hello world"), add: p.add}
+	_, err := io.Copy(io.Discard, r)
+	assert.NoError(t, err)
+
+	s := p.Snapshot()
+	assert.Equal(t, int64(11), s.Downloaded)
+	assert.Equal(t, int64(20), s.Total)
+	assert.Equal(t, 55.0, s.Percent())
+	assert.Positive(t, s.Elapsed)
+
+	p.add(-11)
+	assert.Equal(t, int64(0), p.Snapshot().Downloaded)
+	assert.Equal(t, -1.0, ProgressSnapshot{Downloaded: 5}.Percent())
+}
+
+func TestProgressSnapshot_String(t *testing.T) {
+	assert.Equal(t, "50.0% of 2.0 KiB at 512 B/s", ProgressSnapshot{Downloaded: 1024, Total: 2048, Speed: 512}.String())
+	assert.Equal(t, "1.0 KiB at 0 B/s", ProgressSnapshot{Downloaded: 1024}.String())
+}
@@ -0,0 +1,160 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrRedirectRejected is returned when a request is redirected against the RedirectPolicy of the Downloader.
+var ErrRedirectRejected = errors.New("redirect rejected")
+
+// DefaultMaxRedirects is the maximum number of redirects followed by a request when
+// RedirectPolicy.MaxRedirects is zero, as http.Client does.
+const DefaultMaxRedirects = 10
+
+// RedirectPolicy controls the redirects followed by the requests of a Downloader, see WithRedirectPolicy.
+type RedirectPolicy struct {
+	// MaxRedirects is the maximum number of redirects followed by a request, DefaultMaxRedirects
+	// when zero. Redirects are not followed at all when it's negative.
+	MaxRedirects int
+
+	// SameHost rejects the redirects to another host than the one of the original request.
+	SameHost bool
+
+	// NoDowngrade rejects the redirects from https to http.
+	NoDowngrade bool
+
+	// Pin sends the requests of the segments straight to the URL the source, or a mirror, redirects
+	// to once it's resolved, instead of following the redirects for every segment. A pinned URL
+	// rejected with 403 Forbidden or 410 Gone, e.g. an expired signed URL, is resolved again from
+	// the original URL.
+	Pin bool
+}
+
+// WithRedirectPolicy is an option function that sets the redirect policy of the requests.
+func WithRedirectPolicy(policy RedirectPolicy) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.RedirectPolicy = policy
+	}
+}
+
+// checkRedirect is the http.Client CheckRedirect function enforcing the policy.
+func (p RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := p.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+	if len(via) > max(maxRedirects, 0) {
+		return fmt.Errorf("%w: more than %d redirects", ErrRedirectRejected, max(maxRedirects, 0))
+	}
+
+	origin, prev := via[0].URL, via[len(via)-1].URL
+	if p.SameHost && !strings.EqualFold(req.URL.Hostname(), origin.Hostname()) {
+		return fmt.Errorf("%w: %s redirects to another host, %s", ErrRedirectRejected, origin, req.URL)
+	}
+	if p.NoDowngrade && prev.Scheme == "https" && req.URL.Scheme == "http" {
+		return fmt.Errorf("%w: %s redirects to http, %s", ErrRedirectRejected, prev, req.URL)
+	}
+
+	return nil
+}
+
+// UpdateRedirects records the redirects the response to a request for the source URL went through,
+// see RedirectChain and ResolvedURL.
+func (dl *Downloader) UpdateRedirects(response *http.Response) {
+	if response.Request == nil {
+		return
+	}
+
+	var chain []*url.URL
+	for req := response.Request; req.Response != nil && req.Response.Request != nil; req = req.Response.Request {
+		chain = append([]*url.URL{req.URL}, chain...)
+	}
+	dl.RedirectChain = chain
+	dl.ResolvedURL = response.Request.URL
+}
+
+// pinTable maps the source and mirror URLs to the URLs they redirect to, see RedirectPolicy.Pin.
+type pinTable struct {
+	mu   sync.Mutex
+	pins map[string]*url.URL
+}
+
+func newPinTable() *pinTable {
+	return &pinTable{pins: make(map[string]*url.URL)}
+}
+
+// pin records the URL the request for source was redirected to, when the response is successful and
+// the RedirectPolicy pins the redirects.
+func (dl *Downloader) pin(source *url.URL, resp *http.Response) {
+	if !dl.RedirectPolicy.Pin || dl.pins == nil || resp.Request == nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return
+	}
+
+	dl.pins.mu.Lock()
+	defer dl.pins.mu.Unlock()
+
+	if resp.Request.URL.String() == source.String() {
+		delete(dl.pins.pins, source.String())
+		return
+	}
+	dl.pins.pins[source.String()] = resp.Request.URL
+}
+
+// pinned returns the URL source is pinned to, or nil.
+func (dl *Downloader) pinned(source *url.URL) *url.URL {
+	if dl.pins == nil {
+		return nil
+	}
+
+	dl.pins.mu.Lock()
+	defer dl.pins.mu.Unlock()
+
+	return dl.pins.pins[source.String()]
+}
+
+// unpin forgets the URL source is pinned to, unless it was pinned to another one in the meantime.
+func (dl *Downloader) unpin(source, pinned *url.URL) {
+	dl.pins.mu.Lock()
+	defer dl.pins.mu.Unlock()
+
+	if dl.pins.pins[source.String()] == pinned {
+		delete(dl.pins.pins, source.String())
+	}
+}
+
+// doPinned sends the request, to the URL its URL is pinned to if any and resolve is not set. When the
+// pinned URL is rejected with 403 Forbidden or 410 Gone, the request is sent to its original URL
+// again, and the URL it's redirected to is pinned instead.
+func (dl *Downloader) doPinned(req *http.Request, resolve bool) (*http.Response, error) {
+	source := req.URL
+	if target := dl.pinned(source); target != nil && !resolve {
+		resp, err := dl.send(req, target)
+		if err != nil || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusGone) {
+			return resp, err
+		}
+		resp.Body.Close() //nolint:errcheck
+
+		dl.unpin(source, target)
+		dl.Logger.Info("pinned URL rejected, resolving it again",
+			slog.String("source", source.String()),
+			slog.String("status", resp.Status),
+		)
+	}
+
+	resp, err := dl.send(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	dl.pin(source, resp)
+
+	return resp, nil
+}
@@ -0,0 +1,185 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloader_RedirectPolicy(t *testing.T) {
+	content := "redirected content"
+	handler := http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.RedirectHandler(plain.URL+"/data.txt", http.StatusFound))
+	defer secure.Close()
+
+	// localhost and 127.0.0.1 are different hosts
+	otherHost := strings.Replace(plain.URL, "127.0.0.1", "localhost", 1)
+	hops := http.NewServeMux()
+	hops.Handle("/data.txt", handler)
+	hops.Handle("/hop3", http.RedirectHandler("/data.txt", http.StatusFound))
+	hops.Handle("/hop2", http.RedirectHandler("/hop3", http.StatusFound))
+	hops.Handle("/hop1", http.RedirectHandler("/hop2", http.StatusFound))
+	hops.Handle("/other-host", http.RedirectHandler(otherHost+"/data.txt", http.StatusFound))
+	server := httptest.NewServer(hops)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		src    string
+		policy RedirectPolicy
+		valid  bool
+	}{
+		{name: "default", src: server.URL + "/hop1", valid: true},
+		{name: "max redirects", src: server.URL + "/hop1", policy: RedirectPolicy{MaxRedirects: 3}, valid: true},
+		{name: "too many redirects", src: server.URL + "/hop1", policy: RedirectPolicy{MaxRedirects: 2}},
+		{name: "no redirects", src: server.URL + "/hop1", policy: RedirectPolicy{MaxRedirects: -1}},
+		{name: "other host", src: server.URL + "/other-host", valid: true},
+		{name: "same host", src: server.URL + "/other-host", policy: RedirectPolicy{SameHost: true}},
+		{name: "downgrade", src: secure.URL, valid: true},
+		{name: "no downgrade", src: secure.URL, policy: RedirectPolicy{NoDowngrade: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl, err := NewDownloader(t.TempDir(), tt.src,
+				WithClient(&Client{httpClient: secure.Client()}),
+				WithRedirectPolicy(tt.policy),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = dl.ValidateRangeSupport(context.Background(), dl.UpdateRangeSupportState, dl.UpdateRedirects)
+			if !tt.valid {
+				assert.ErrorIs(t, err, ErrRedirectRejected)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, int64(len(content)), dl.RangeSupport.ContentLength)
+				assert.True(t, strings.HasSuffix(dl.ResolvedURL.String(), "/data.txt"), dl.ResolvedURL.String())
+			}
+		})
+	}
+}
+
+// newSignedURLServer serves content from /signed URLs that /latest redirects to, through /release. A signed
+// URL expires once it served expireAfter requests, /latest then redirects to a new one. The returned
+// function returns the number of requests to /latest and the token of the current signed URL.
+func newSignedURLServer(t *testing.T, content string, expireAfter int) (*httptest.Server, func() (int, int)) {
+	var mu sync.Mutex
+	var latest, token, served int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest", func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		latest++
+		if served >= expireAfter {
+			token, served = token+1, 0
+		}
+		http.Redirect(wr, req, "/release", http.StatusFound)
+	})
+	mux.HandleFunc("/release", func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		http.Redirect(wr, req, "/signed?token="+strconv.Itoa(token), http.StatusFound)
+	})
+	mux.HandleFunc("/signed", func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		expired := req.URL.Query().Get("token") != strconv.Itoa(token) || served >= expireAfter
+		if !expired && req.Method == http.MethodGet {
+			served++
+		}
+		mu.Unlock()
+
+		if expired {
+			wr.WriteHeader(http.StatusGone)
+			return
+		}
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return latest, token
+	}
+}
+
+func TestDownloadManager_PinnedRedirects(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+
+	tests := []struct {
+		name        string
+		pin         bool
+		expireAfter int
+		check       func(t *testing.T, latest, token int)
+	}{
+		{
+			name:        "not pinned",
+			expireAfter: 100,
+			check: func(t *testing.T, latest, token int) {
+				assert.Equal(t, 1+4, latest, "every segment follows the redirects")
+			},
+		},
+		{
+			name:        "pinned",
+			pin:         true,
+			expireAfter: 100,
+			check: func(t *testing.T, latest, token int) {
+				assert.Equal(t, 1, latest, "only the probe follows the redirects")
+			},
+		},
+		{
+			name:        "pinned URL expired",
+			pin:         true,
+			expireAfter: 2,
+			check: func(t *testing.T, latest, token int) {
+				assert.Greater(t, latest, 1, "the expired URL is resolved again")
+				assert.Positive(t, token, "a new signed URL is used")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, stats := newSignedURLServer(t, content, tt.expireAfter)
+
+			downloader, err := NewDownloader(t.TempDir(), server.URL+"/latest",
+				WithFileName("data.txt"),
+				WithRedirectPolicy(RedirectPolicy{Pin: tt.pin}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dm := NewDownloadManager(downloader, NewRetryPolicy(1))
+			result, err := dm.Download(context.Background(), WithNumberOfSegments(4))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(result.Path)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got))
+
+			assert.Equal(t, []string{server.URL + "/release", server.URL + "/signed?token=0"}, result.Redirects)
+			assert.Equal(t, server.URL+"/signed?token=0", result.ResolvedURL)
+			latest, token := stats()
+			tt.check(t, latest, token)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package download
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Result describes a finished download.
+type Result struct {
+	// Path is the final path of the downloaded file, it's empty when the download failed.
+	Path string
+
+	// Filename is the name of the downloaded file, as resolved from the server response or the URL.
+	Filename string
+
+	// Size is the number of bytes of the downloaded file.
+	Size int64
+
+	// Duration is the time spent on the download, from probing the server to post-processing the file.
+	Duration time.Duration
+
+	// AverageSpeed is the average download speed, in bytes per second.
+	AverageSpeed float64
+
+	// Retries holds the number of retries of every segment, indexed by segment ID.
+	Retries []int
+
+	// Hedged is the number of segments won by a hedged request, see WithHedging.
+	Hedged int
+
+	// Hashes holds the hex encoded digests of the downloaded file, indexed by algorithm, see hashFile.
+	Hashes map[string]string
+
+	// Validators are the validators of the remote file sent by the server.
+	Validators Validators
+
+	// ResolvedURL is the final URL of the source URL, once the redirects are followed.
+	ResolvedURL string
+
+	// Redirects holds the URLs the source URL redirected to, in order, see Downloader.RedirectChain.
+	Redirects []string
+
+	// Mirrors holds the statistics of the source URL and of every mirror, in this order.
+	Mirrors []MirrorStats
+}
+
+// DownloadError is returned when one or more segments of a download failed.
+// It unwraps to the *SegmentError of every failed segment, so that errors.Is and errors.As
+// can be used to inspect the failures, e.g.
+//
+//	var segErr *SegmentError
+//	if errors.As(err, &segErr) {
+//	    fmt.Println(segErr.SegmentID)
+//	}
+type DownloadError struct {
+	Errs []error
+}
+
+func (e *DownloadError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("download encountered following errors: [%s]", strings.Join(msgs, "; "))
+}
+
+func (e *DownloadError) Unwrap() []error {
+	return e.Errs
+}
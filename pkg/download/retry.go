@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -30,7 +31,7 @@ type RetryPolicy struct {
 	OnRetry func(id int, attempt int, nextRetryIn time.Duration)
 
 	// ShouldRetry is an optional callback that determines whether a retry should be attempted
-	// after an error. If not set, all errors will trigger a retry.
+	// after an error. If not set, all errors will trigger a retry. ErrStalled is always retried.
 	ShouldRetry func(err error) bool
 
 	// MaxTotalRetryDuration is the maximum total time to spend on all retry attempts.
@@ -40,8 +41,9 @@ type RetryPolicy struct {
 	// seed is a source of random numbers used to generate jitter in retry intervals.
 	// It ensures that each retry interval has some level of randomness,
 	// reducing the chance of synchronized retries in distributed systems.
-	// This random number generator is safe for concurrent use.
+	// This random number generator is guarded by mu, so the policy is safe for concurrent use.
 	seed *rand.Rand
+	mu   sync.Mutex
 }
 
 // NewRetryPolicy creates a new RetryPolicy with the given parameters.
@@ -127,13 +129,13 @@ func (p *RetryPolicy) Retry(ctx context.Context, segmentID int, task func() erro
 			return nil
 		}
 
-		// when ShouldRetry is not set, it'll always retry
-		if p.ShouldRetry != nil && !p.ShouldRetry(err) {
+		// when ShouldRetry is not set, it'll always retry, a stalled connection is transient
+		if p.ShouldRetry != nil && !errors.Is(err, ErrStalled) && !p.ShouldRetry(err) {
 			return err
 		}
 
 		nextRetryIn := p.RetryDelay + time.Duration(float64(attempt)*p.BackoffFactor)*time.Millisecond
-		nextRetryIn += time.Duration(p.seed.Int63n(int64(p.Jitter)))
+		nextRetryIn += p.jitter()
 
 		// Check if exceeding the maximum total retry duration
 		if p.MaxTotalRetryDuration > 0 {
@@ -147,12 +149,28 @@ func (p *RetryPolicy) Retry(ctx context.Context, segmentID int, task func() erro
 			p.OnRetry(segmentID, attempt+1, nextRetryIn)
 		}
 
-		time.Sleep(nextRetryIn)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(nextRetryIn):
+		}
 	}
 
 	return err
 }
 
+// jitter returns a random duration in [0, Jitter).
+func (p *RetryPolicy) jitter() time.Duration {
+	if p.Jitter <= 0 {
+		return 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return time.Duration(p.seed.Int63n(int64(p.Jitter)))
+}
+
 const defaultMaxRetries = 5
 
 // DefaultRetryPolicy creates a retry policy with sensible defaults.
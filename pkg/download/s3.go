@@ -0,0 +1,190 @@
+package download
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidS3URL = errors.New("invalid s3 URL")
+
+// DefaultAWSRegion is the region used when none is configured, see AWSRegion.
+const DefaultAWSRegion = "us-east-1"
+
+// WithS3Endpoint is an option function that sets the endpoint and the region the s3://bucket/key source
+// and mirror URLs are resolved with, see S3URL. By default, they are resolved to AWS in the region of
+// AWSRegion, or to the endpoint of the AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL environment variables.
+func WithS3Endpoint(endpoint, region string) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.s3Endpoint, dl.s3Region = endpoint, region
+	}
+}
+
+// S3URL returns the HTTP URL of the given s3://bucket/key URL. Without endpoint, it's the virtual-hosted
+// style URL of the object in the given AWS region, e.g. https://bucket.s3.eu-west-1.amazonaws.com/key.
+// With an endpoint, e.g. the one of a MinIO server, it's the path-style URL endpoint/bucket/key.
+func S3URL(u *url.URL, endpoint, region string) (*url.URL, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || bucket == "" || key == "" {
+		return nil, fmt.Errorf("%w: %s, expected s3://bucket/key", ErrInvalidS3URL, u)
+	}
+
+	if endpoint == "" {
+		if region == "" {
+			region = DefaultAWSRegion
+		}
+		host := "s3." + region + ".amazonaws.com"
+		// the certificate of AWS doesn't cover the bucket names with dots
+		if strings.Contains(bucket, ".") {
+			return &url.URL{Scheme: "https", Host: host, Path: "/" + bucket + "/" + key}, nil
+		}
+		return &url.URL{Scheme: "https", Host: bucket + "." + host, Path: "/" + key}, nil
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("%w: invalid endpoint %q", ErrInvalidS3URL, endpoint)
+	}
+
+	return base.JoinPath(bucket, key), nil
+}
+
+// resolveS3URL returns the HTTP URL of the given URL when it's an s3:// URL, see WithS3Endpoint.
+func (dl *Downloader) resolveS3URL(u *url.URL) (*url.URL, error) {
+	if u.Scheme != "s3" {
+		return u, nil
+	}
+
+	endpoint, region := dl.s3Endpoint, dl.s3Region
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL_S3")
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if region == "" {
+		region = AWSRegion()
+	}
+
+	return S3URL(u, endpoint, region)
+}
+
+// LoadAWSCredentials returns the AWS credentials of the standard chain: the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, or the profile of the
+// AWS_PROFILE environment variable, default by default, in the shared credentials file,
+// i.e. AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials. It returns ErrNoAWSCredentials when
+// there are none.
+func LoadAWSCredentials() (AWSCredentials, error) {
+	creds := AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		path = awsConfigPath("credentials")
+	}
+	profile, err := readAWSProfile(path, awsProfile())
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+
+	creds = AWSCredentials{
+		AccessKeyID:     profile["aws_access_key_id"],
+		SecretAccessKey: profile["aws_secret_access_key"],
+		SessionToken:    profile["aws_session_token"],
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return AWSCredentials{}, ErrNoAWSCredentials
+	}
+
+	return creds, nil
+}
+
+// AWSRegion returns the AWS region of the AWS_REGION or AWS_DEFAULT_REGION environment variables,
+// or of the profile of AWS_PROFILE in the shared config file, i.e. AWS_CONFIG_FILE or ~/.aws/config.
+// It's DefaultAWSRegion when none is configured.
+func AWSRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+
+	path := os.Getenv("AWS_CONFIG_FILE")
+	if path == "" {
+		path = awsConfigPath("config")
+	}
+	// the profiles of the config file, but the default one, are named "profile NAME"
+	section := awsProfile()
+	if section != "default" {
+		section = "profile " + section
+	}
+	if profile, err := readAWSProfile(path, section); err == nil && profile["region"] != "" {
+		return profile["region"]
+	}
+
+	return DefaultAWSRegion
+}
+
+// awsProfile returns the name of the AWS profile in use.
+func awsProfile() string {
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+
+	return "default"
+}
+
+// awsConfigPath returns the path of the given file of the ~/.aws directory.
+func awsConfigPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".aws", name)
+}
+
+// readAWSProfile returns the keys of the given section of an AWS shared config or credentials file.
+// A missing file or section has no keys.
+func readAWSProfile(path, section string) (map[string]string, error) {
+	keys := map[string]string{}
+	if path == "" {
+		return keys, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var current string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+		case current == section:
+			if name, value, ok := strings.Cut(line, "="); ok {
+				keys[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+			}
+		}
+	}
+
+	return keys, scanner.Err()
+}
@@ -0,0 +1,108 @@
+package download
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3URL(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		endpoint string
+		region   string
+		want     string
+		wantErr  bool
+	}{
+		{name: "virtual-hosted", url: "s3://bucket/dir/file.bin", region: "eu-west-1", want: "https://bucket.s3.eu-west-1.amazonaws.com/dir/file.bin"},
+		{name: "default region", url: "s3://bucket/file.bin", want: "https://bucket.s3.us-east-1.amazonaws.com/file.bin"},
+		{name: "bucket with dots", url: "s3://my.bucket/file.bin", region: "eu-west-1", want: "https://s3.eu-west-1.amazonaws.com/my.bucket/file.bin"},
+		{name: "endpoint", url: "s3://bucket/dir/file.bin", endpoint: "http://localhost:9000", want: "http://localhost:9000/bucket/dir/file.bin"},
+		{name: "endpoint with path", url: "s3://bucket/file.bin", endpoint: "https://storage.example.com/s3/", want: "https://storage.example.com/s3/bucket/file.bin"},
+		{name: "no key", url: "s3://bucket/", wantErr: true},
+		{name: "invalid endpoint", url: "s3://bucket/file.bin", endpoint: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := S3URL(u, tt.endpoint, tt.region)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidS3URL)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got.String())
+			}
+		})
+	}
+}
+
+func TestLoadAWSCredentials(t *testing.T) {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "credentials")
+	config := filepath.Join(dir, "config")
+	err := os.WriteFile(credentials, []byte(`# shared credentials
+[default]
+aws_access_key_id = default-id
+aws_secret_access_key = default-secret
+
+[ci]
+aws_access_key_id=ci-id
+aws_secret_access_key=ci-secret
+aws_session_token=ci-token
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(config, []byte(`[default]
+region = eu-west-1
+
+[profile ci]
+region = ap-south-1
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentials)
+	t.Setenv("AWS_CONFIG_FILE", config)
+
+	creds, err := LoadAWSCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, AWSCredentials{AccessKeyID: "default-id", SecretAccessKey: "default-secret"}, creds)
+	assert.Equal(t, "eu-west-1", AWSRegion())
+
+	t.Setenv("AWS_PROFILE", "ci")
+	creds, err = LoadAWSCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, AWSCredentials{AccessKeyID: "ci-id", SecretAccessKey: "ci-secret", SessionToken: "ci-token"}, creds)
+	assert.Equal(t, "ap-south-1", AWSRegion())
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_REGION", "us-west-2")
+	creds, err = LoadAWSCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, AWSCredentials{AccessKeyID: "env-id", SecretAccessKey: "env-secret"}, creds)
+	assert.Equal(t, "us-west-2", AWSRegion())
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_PROFILE", "missing")
+	_, err = LoadAWSCredentials()
+	assert.ErrorIs(t, err, ErrNoAWSCredentials)
+
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "none"))
+	_, err = LoadAWSCredentials()
+	assert.ErrorIs(t, err, ErrNoAWSCredentials)
+}
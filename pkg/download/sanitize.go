@@ -0,0 +1,104 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidFilename = errors.New("invalid file name")
+	ErrPathTraversal   = errors.New("path escapes the destination directory")
+)
+
+// maxFilenameLength is the maximum length, in bytes, of a file name on most file systems.
+const maxFilenameLength = 255
+
+// reservedNames are device names that can't be used as file names on Windows,
+// with or without an extension.
+var reservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// SanitizeFilename turns a file name coming from an untrusted source, such as the server
+// response or the URL path, into a name that is safe to be created in the destination directory.
+//
+// Directory components (including "..") are stripped and only the last path element is kept,
+// leading and trailing dots and spaces are trimmed, and the name is capped to 255 bytes while
+// preserving its extension. Names containing control characters, reserved device names and
+// names that are empty after cleaning are rejected with ErrInvalidFilename.
+func SanitizeFilename(name string) (string, error) {
+	// treat both separators the same regardless of the platform, the name comes from a remote party.
+	name = strings.ReplaceAll(name, `\`, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidFilename, name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: %q contains control characters", ErrInvalidFilename, name)
+		}
+	}
+
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		return "", fmt.Errorf("%w: empty name", ErrInvalidFilename)
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	if _, ok := reservedNames[strings.ToUpper(strings.TrimSpace(base))]; ok {
+		return "", fmt.Errorf("%w: %q is a reserved name", ErrInvalidFilename, name)
+	}
+
+	return truncateFilename(name, maxFilenameLength), nil
+}
+
+// truncateFilename caps the name to max bytes, keeping the extension when it is reasonably short.
+// The name is never cut in the middle of a UTF-8 sequence.
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > max/4 {
+		ext = ""
+	}
+
+	stem := strings.TrimSuffix(name, ext)
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+
+	return stem[:limit] + ext
+}
+
+// SafeJoin joins the sanitized name to dir and guarantees the resulting path stays inside dir.
+func SafeJoin(dir, name string) (string, error) {
+	clean, err := SanitizeFilename(name)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(root, clean)
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", ErrPathTraversal, name)
+	}
+
+	return target, nil
+}
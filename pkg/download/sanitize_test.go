@@ -0,0 +1,63 @@
+package download
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		given   string
+		want    string
+		wantErr error
+	}{
+		{name: "plain", given: "report.pdf", want: "report.pdf"},
+		{name: "relative traversal", given: "../../etc/passwd", want: "passwd"},
+		{name: "absolute path", given: "/etc/passwd", want: "passwd"},
+		{name: "windows separators", given: `..\..\windows\system.ini`, want: "system.ini"},
+		{name: "trailing dots and spaces", given: " report.pdf. ", want: "report.pdf"},
+		{name: "dot dot only", given: "..", wantErr: ErrInvalidFilename},
+		{name: "empty", given: "", wantErr: ErrInvalidFilename},
+		{name: "control characters", given: "report\n.pdf", wantErr: ErrInvalidFilename},
+		{name: "reserved name", given: "CON", wantErr: ErrInvalidFilename},
+		{name: "reserved name with extension", given: "lpt1.txt", wantErr: ErrInvalidFilename},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeFilename(tt.given)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+
+	t.Run("long name keeps extension", func(t *testing.T) {
+		got, err := SanitizeFilename(strings.Repeat("é", 200) + ".tar.gz")
+		if assert.NoError(t, err) {
+			assert.LessOrEqual(t, len(got), maxFilenameLength)
+			assert.True(t, strings.HasSuffix(got, ".gz"))
+			assert.True(t, strings.HasPrefix(got, "é"))
+		}
+	})
+}
+
+func TestSafeJoin(t *testing.T) {
+	dir := t.TempDir()
+
+	got, err := SafeJoin(dir, "../../outside.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, filepath.Join(dir, "outside.txt"), got)
+	}
+
+	_, err = SafeJoin(dir, "..")
+	assert.ErrorIs(t, err, ErrInvalidFilename)
+}
@@ -2,15 +2,16 @@ package download
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -41,7 +42,20 @@ type Segment struct {
 	// CurrentOffset represents the current position within the file immediately after the last write operation.
 	// It tracks the byte offset where the next writing will occur, ensuring data is written to the correct location in the file.
 	// This offset is updated each time a write operation is completed, reflecting the new position for subsequent operations.
-	CurrentOffset int
+	// The offset is relative to Start, i.e. it is the number of bytes of this segment written so far.
+	CurrentOffset int64
+
+	// onProgress, when set, is called with the number of bytes received or discarded by the segment.
+	onProgress func(n int64)
+
+	// retries is the number of times the download of the segment was retried.
+	retries int
+
+	// source is the URL the segment is downloaded from, the source URL of the Downloader when nil.
+	source *url.URL
+
+	// hedged is true when the data of the segment was downloaded by a hedged request, see raceSegment.
+	hedged bool
 }
 
 // SegmentManager manages the segments involved in a file download process.
@@ -156,6 +170,15 @@ type SegmentParams struct {
 
 const DefaultNumberOfSegments = 4
 
+// defaultDir returns the given directory, or "/tmp" when it's empty.
+// That's where a download without a destination directory is written.
+func defaultDir(dir string) string {
+	if dir == "" {
+		return "/tmp"
+	}
+	return dir
+}
+
 // NewSegmentManager initializes and returns a new SegmentManager.
 // It takes the destination directory for segment files, the total file size to be downloaded,
 // and optional SegmentManagerOption functions to configure the SegmentManager.
@@ -176,12 +199,9 @@ const DefaultNumberOfSegments = 4
 // Each segment is represented by a file in the destination directory, named with a pattern
 // that includes the SegmentManager's ID and the segment's index.
 func NewSegmentManager(dstDir string, fileSize int64, opts ...SegmentManagerOption) (*SegmentManager, error) {
-	if dstDir == "" {
-		dstDir = "/tmp"
-	}
 	sm := &SegmentManager{
 		ID:             time.Now().Nanosecond(),
-		DestinationDir: dstDir,
+		DestinationDir: defaultDir(dstDir),
 		FileSize:       fileSize,
 	}
 
@@ -238,7 +258,7 @@ func NewSegmentManager(dstDir string, fileSize int64, opts ...SegmentManagerOpti
 
 		segmentName := fmt.Sprintf("segment-%d-part-%d", sm.ID, i)
 		// create a new temporary file for each segment,
-		fileWriter, err := NewFileWriter(dstDir, segmentName)
+		fileWriter, err := NewFileWriter(sm.DestinationDir, segmentName)
 		if err != nil {
 			return nil, err
 		}
@@ -261,7 +281,11 @@ func NewSegmentManager(dstDir string, fileSize int64, opts ...SegmentManagerOpti
 	return sm, nil
 }
 
+// SegmentError is an error related to a segment.
 type SegmentError struct {
+	// SegmentID is the ID of the segment the error relates to.
+	SegmentID int
+
 	Err     error
 	Details string
 }
@@ -270,69 +294,97 @@ func (e *SegmentError) Error() string {
 	return fmt.Sprintf("%s, with error: %v", e.Details, e.Err)
 }
 
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// RemoveFiles closes and removes the temporary segment files, it's used to clean up an aborted download.
+func (sm *SegmentManager) RemoveFiles() {
+	for _, seg := range sm.Segments {
+		_ = seg.Close()
+		_ = os.Remove(filepath.Join(sm.DestinationDir, seg.Name))
+	}
+}
+
 // MergeFiles concatenates multiple segment files into one file with the specified filename.
-// The content type of the merged file is determined by reading the first 512 bytes of the first segment.
+// When the filename has no extension, the content type of the merged file is determined by
+// reading the first 512 bytes of the first segment and the matching extension is appended.
 // If there are no segments to merge, it returns an ErrNoContent error.
-func (sm *SegmentManager) MergeFiles(filename string) error {
+// The filename is sanitized and the merged file is guaranteed to stay inside the destination directory.
+// It returns the path of the merged file.
+func (sm *SegmentManager) MergeFiles(filename string) (string, error) {
 	if len(sm.Segments) == 0 {
-		return ErrNoContent
+		return "", ErrNoContent
 	}
 
-	// read 512 bytes of the first segment to determine the content type
 	segment0 := sm.Segments[0]
 	file0, err := NewFileWriter(sm.DestinationDir, segment0.Name)
 	if err != nil {
-		return &SegmentError{Err: err, Details: "reading segment0 failed"}
+		return "", &SegmentError{Err: err, Details: "reading segment0 failed"}
 	}
 
-	m := make([]byte, 512)
-	_, err = file0.Read(m)
-	if err != nil {
-		return &SegmentError{Err: err, Details: "reading segment0 failed"}
+	var ext string
+	if filepath.Ext(filename) == "" {
+		// read 512 bytes of the first segment to determine the content type
+		m := make([]byte, 512)
+		n, err := file0.Read(m)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", &SegmentError{Err: err, Details: "reading segment0 failed"}
+		}
+
+		ext, err = detectType(m[:n])
+		if err != nil {
+			return "", err
+		}
 	}
 
-	ext, err := detectType(m)
+	// the name may come from the server, hence it must not escape the destination directory.
+	dst, err := SafeJoin(sm.DestinationDir, filename+ext)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	wg := &sync.WaitGroup{}
 	// concatenate segment files
 	for i := 1; i < len(sm.Segments); i++ {
 		current := sm.Segments[i]
 		f, err := NewFileWriter(sm.DestinationDir, current.Name)
 		if err != nil {
-			return err
+			return "", err
 		}
 
-		wg.Add(1)
-
 		_, err = segment0.ReadFrom(f)
+		if err == nil {
+			err = segment0.Flush()
+		}
 		if err != nil {
-			return &SegmentError{Err: err, Details: fmt.Sprintf("reading segment %d failed", i)}
+			_ = f.Close()
+			return "", &SegmentError{SegmentID: i, Err: err, Details: fmt.Sprintf("reading segment %d failed", i)}
 		}
 
-		// remove the temporary segment file
-		go func(file *os.File) {
-			defer wg.Done()
-			_ = file.Close()
-			_ = os.Remove(file.Name())
-		}(f)
+		// remove the temporary segment file right away, so the disk usage
+		// never exceeds the file size plus the largest segment, see RequiredSpace.
+		_ = current.Close()
+		_ = f.Close()
+		_ = os.Remove(f.Name())
 	}
 
-	wg.Wait()
-
 	err = segment0.setDone(true)
 	if err != nil {
-		return &SegmentError{Err: err, Details: "closing the segment 0 failed"}
+		return "", &SegmentError{Err: err, Details: "closing the segment 0 failed"}
 	}
+	_ = segment0.Close()
+	_ = file0.Close()
 
 	// set the destination file name
-	return os.Rename(file0.Name(), fmt.Sprintf("%s/%s%s", sm.DestinationDir, filename, ext))
+	if err = os.Rename(file0.Name(), dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
 }
 
 func detectType(m []byte) (string, error) {
-	ct := http.DetectContentType(m)
+	ct := detectContentType(m)
 
 	// usually the content type comes with <media type><subtype>; <extra information>
 	mediaSubtype, _, _ := strings.Cut(ct, ";")
@@ -349,6 +401,23 @@ func detectType(m []byte) (string, error) {
 	return fmt.Sprintf(".%s", subtype), nil
 }
 
+// detectContentType determines the media type of the given data, the way http.DetectContentType does.
+// On top of it, the bzip2, xz, zstd and tar formats are recognized, which the standard sniffing algorithm doesn't cover.
+func detectContentType(m []byte) string {
+	switch {
+	case len(m) >= 4 && string(m[:3]) == "BZh" && m[3] >= '1' && m[3] <= '9':
+		return "application/x-bzip2"
+	case bytes.HasPrefix(m, []byte("\xfd7zXZ\x00")):
+		return "application/x-xz"
+	case bytes.HasPrefix(m, []byte("\x28\xb5\x2f\xfd")):
+		return "application/zstd"
+	case len(m) >= 262 && string(m[257:262]) == "ustar":
+		return "application/x-tar"
+	}
+
+	return http.DetectContentType(m)
+}
+
 // NewSegment creates a new instance of a Segment struct.
 // It initializes a segment of a file to be downloaded, with specified start and end byte positions.
 // The caller is responsible for managing the temporary file, including its deletion after the segment is processed.
@@ -383,28 +452,70 @@ func NewFileWriter(dir, name string) (*os.File, error) {
 	return file, nil
 }
 
+// ReadFrom reads data from src until EOF into the segment's buffer and advances the CurrentOffset.
 func (seg *Segment) ReadFrom(src io.Reader) (int64, error) {
-	if seg.Resumable {
-		seeker, ok := seg.Writer.(io.Seeker)
-		if !ok {
-			return 0, fmt.Errorf("writer does not support seeking")
-		}
-		n, err := seeker.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return n, nil
-		}
-	}
-
-	return seg.Buffer.ReadFrom(src)
+	n, err := seg.Buffer.ReadFrom(src)
+	seg.CurrentOffset += n
+	return n, err
 }
 
 // Write writes the given data to the segment's buffer.
 func (seg *Segment) Write(data []byte) (int, error) {
 	n, err := seg.Buffer.Write(data)
+	seg.CurrentOffset += int64(n)
+	return n, err
+}
+
+// syncOffset aligns the CurrentOffset with the data actually persisted in the underlying writer,
+// so that an interrupted segment continues from where it stopped instead of writing duplicate data.
+// Buffered data that can't be flushed (e.g. the disk is full) is discarded, it'll be fetched again.
+// It's a no-op for writers that are not resumable.
+func (seg *Segment) syncOffset() error {
+	if !seg.Resumable {
+		return nil
+	}
+
+	if err := seg.Buffer.Flush(); err != nil {
+		seg.Buffer.Reset(seg.Writer)
+	}
+
+	size, err := seg.Writer.(io.Seeker).Seek(0, io.SeekEnd)
 	if err != nil {
-		seg.CurrentOffset += n
+		return err
 	}
-	return n, err
+	seg.reportProgress(size - seg.CurrentOffset)
+	seg.CurrentOffset = size
+
+	return nil
+}
+
+// track wraps the reader so that the bytes read are reported as progress of the segment.
+func (seg *Segment) track(r io.Reader) io.Reader {
+	if seg.onProgress == nil {
+		return r
+	}
+
+	return &progressReader{r: r, add: seg.onProgress}
+}
+
+func (seg *Segment) reportProgress(n int64) {
+	if seg.onProgress != nil && n != 0 {
+		seg.onProgress(n)
+	}
+}
+
+// truncate discards all the data written to the segment so far, so it can be downloaded from scratch.
+func (seg *Segment) truncate() error {
+	seg.Buffer.Reset(seg.Writer)
+	seg.reportProgress(-seg.CurrentOffset)
+	seg.CurrentOffset = 0
+
+	truncater, ok := seg.Writer.(interface{ Truncate(size int64) error })
+	if !ok {
+		return fmt.Errorf("writer does not support truncating")
+	}
+
+	return truncater.Truncate(0)
 }
 
 // Flush flushes the segment's buffer, writing any buffered data to the underlying io.Writer.
@@ -0,0 +1,116 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStalled is returned when a response delivers less data than the throughput floor during a stall
+// window, see WithStallDetection. It's transient: the RetryPolicy always retries it, and the next
+// attempt continues from the data already received.
+var ErrStalled = errors.New("download stalled")
+
+// DefaultStallWindow is the stall window used when only a minimum throughput is set.
+const DefaultStallWindow = 30 * time.Second
+
+// WithStallDetection is an option function that aborts a response delivering less than minThroughput
+// bytes per second over a window, or no data at all during a whole window when minThroughput is zero.
+// The request fails with ErrStalled, which is retried from the current offset.
+func WithStallDetection(window time.Duration, minThroughput int64) DownloaderOption {
+	return func(dl *Downloader) {
+		dl.StallWindow = window
+		dl.MinThroughput = minThroughput
+	}
+}
+
+// stallWatchdog cancels a request when its response body delivers too little data, it's disabled when nil.
+type stallWatchdog struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	window time.Duration
+	floor  int64
+
+	r        io.Reader
+	received atomic.Int64
+	stopped  chan struct{}
+}
+
+// watchStall returns the context of a request watched for stalls and its watchdog, which is nil when
+// stall detection is disabled. The body of the response must be read through watch, and stop must be
+// called once the request is done.
+func (dl *Downloader) watchStall(ctx context.Context) (context.Context, *stallWatchdog) {
+	window := dl.StallWindow
+	if window <= 0 {
+		if dl.MinThroughput <= 0 {
+			return ctx, nil
+		}
+		window = DefaultStallWindow
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	return ctx, &stallWatchdog{
+		ctx:    ctx,
+		cancel: cancel,
+		window: window,
+		// at least one byte, a window without any data is always a stall
+		floor:   max(int64(float64(dl.MinThroughput)*window.Seconds()), 1),
+		stopped: make(chan struct{}),
+	}
+}
+
+// watch starts watching the given response body and returns the reader to read it from. The read
+// errors caused by a stall are reported as ErrStalled.
+func (w *stallWatchdog) watch(body io.Reader) io.Reader {
+	if w == nil {
+		return body
+	}
+
+	w.r = body
+	go w.run()
+
+	return w
+}
+
+func (w *stallWatchdog) run() {
+	ticker := time.NewTicker(w.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-ticker.C:
+			if n := w.received.Swap(0); n < w.floor {
+				w.cancel(fmt.Errorf("%w: %d bytes received in %s, expected at least %d", ErrStalled, n, w.window, w.floor))
+				return
+			}
+		}
+	}
+}
+
+func (w *stallWatchdog) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	w.received.Add(int64(n))
+	if err != nil && !errors.Is(err, io.EOF) {
+		if cause := context.Cause(w.ctx); errors.Is(cause, ErrStalled) {
+			err = cause
+		}
+	}
+
+	return n, err
+}
+
+// stop stops the watchdog and releases the context of the request.
+func (w *stallWatchdog) stop() {
+	if w == nil {
+		return
+	}
+
+	close(w.stopped)
+	w.cancel(nil)
+}
@@ -0,0 +1,131 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadManager_Stalled(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		first := req.Method == http.MethodGet && len(ranges) == 0
+		if req.Method == http.MethodGet {
+			ranges = append(ranges, req.Header.Get("Range"))
+		}
+		mu.Unlock()
+
+		if first {
+			// the connection stays open but stops delivering data
+			wr.Header().Set("Content-Range", "bytes 0-9999/10000")
+			wr.WriteHeader(http.StatusPartialContent)
+			wr.Write([]byte(content[:4000]))       //nolint:errcheck
+			http.NewResponseController(wr).Flush() //nolint:errcheck
+			<-req.Context().Done()
+			return
+		}
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloader, err := NewDownloader(t.TempDir(), server.URL+"/data.txt", WithStallDetection(100*time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var retried []error
+	policy := NewRetryPolicy(3, WithShouldRetryPolicy(func(err error) bool {
+		retried = append(retried, err)
+		return false
+	}))
+
+	dm := NewDownloadManager(downloader, policy)
+	result, err := dm.Download(context.Background(), WithNumberOfSegments(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := os.ReadFile(result.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(got))
+	assert.Equal(t, []string{"bytes=0-9999", "bytes=4000-9999"}, ranges, "the download resumes from the current offset")
+	assert.Empty(t, retried, "a stall is retried regardless of ShouldRetry")
+}
+
+func TestDownloader_StallMinThroughput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Range", "bytes 0-999/1000")
+		wr.WriteHeader(http.StatusPartialContent)
+		// 50 bytes per second
+		for range 1000 {
+			if _, err := wr.Write([]byte("x")); err != nil {
+				return
+			}
+			http.NewResponseController(wr).Flush() //nolint:errcheck
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	dl, err := NewDownloader(dir, server.URL, WithStallDetection(200*time.Millisecond, 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.RangeSupport.SupportsRangeRequests = true
+
+	writer, err := NewFileWriter(dir, "segment-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close() //nolint:errcheck
+
+	seg, err := NewSegment(SegmentParams{ID: 0, Start: 0, End: 999, Writer: writer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = dl.DownloadSegment(context.Background(), seg)
+	assert.ErrorIs(t, err, ErrStalled)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Positive(t, seg.CurrentOffset, "the data received before the stall is kept")
+}
+
+func TestStallWatchdog_Canceled(t *testing.T) {
+	dl := &Downloader{StallWindow: time.Hour}
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, stall := dl.watchStall(parent)
+	defer stall.stop()
+
+	cancel()
+	<-ctx.Done()
+
+	// the read errors are not reported as stalls when the download is canceled
+	_, err := stall.watch(errReader{context.Canceled}).Read(make([]byte, 1))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, errors.Is(err, ErrStalled))
+
+	_, stall = (&Downloader{}).watchStall(parent)
+	assert.Nil(t, stall, "stall detection is disabled by default")
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
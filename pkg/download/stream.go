@@ -0,0 +1,149 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// ErrRangeIgnored is returned when the server answers a range request with another range, or with the whole file.
+var ErrRangeIgnored = errors.New("server ignored the range request")
+
+// checkRange returns an ErrRangeIgnored error if the response doesn't hold the requested range starting at start.
+func checkRange(resp *http.Response, start int64) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return fmt.Errorf("%w: %s", ErrRangeIgnored, resp.Status)
+	case http.StatusPartialContent:
+		value := resp.Header.Get("Content-Range")
+		if got, _, err := parseContentRange(value); err == nil && got != start {
+			return fmt.Errorf("%w: Content-Range %q, expected a range starting at %d", ErrRangeIgnored, value, start)
+		}
+	}
+
+	return nil
+}
+
+// DownloadStream downloads the whole file from the source URL in a single request, without any Range header,
+// and splits the stream into the given segments, which must cover the file in order. The data already written
+// to the segments is kept, the matching bytes of the stream are skipped.
+func (dl *Downloader) DownloadStream(ctx context.Context, segments []*Segment) error {
+	return dl.downloadStream(ctx, dl.SourceURL, segments)
+}
+
+// downloadStream is DownloadStream from the given source, the source URL or a mirror.
+func (dl *Downloader) downloadStream(ctx context.Context, src *url.URL, segments []*Segment) error {
+	for _, seg := range segments {
+		seg.Err = nil
+		seg.source = src
+		if err := seg.syncOffset(); err != nil {
+			return err
+		}
+	}
+
+	ctx, stall := dl.watchStall(ctx)
+	defer stall.stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	dl.Logger.Debug("stream download",
+		slog.Int("segments", len(segments)),
+		slog.String("source", src.String()),
+	)
+
+	resp, err := dl.do(req, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with: %s error", resp.Status)
+	}
+
+	body := stall.watch(resp.Body)
+	for _, seg := range segments {
+		size := seg.End - seg.Start + 1
+		if seg.Done {
+			if err = discardN(body, size); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// skip the data the segment already holds
+		if err = discardN(body, seg.CurrentOffset); err != nil {
+			return err
+		}
+
+		n := size - seg.CurrentOffset
+		written, err := seg.ReadFrom(seg.track(io.LimitReader(body, n)))
+		if err == nil && written < n {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			seg.setErr(err)
+			return err
+		}
+		if err = seg.setDone(true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// discardN reads and discards exactly n bytes from r.
+func discardN(r io.Reader, n int64) error {
+	_, err := io.CopyN(io.Discard, r, n)
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// downloadStream downloads the segments that are not done yet in a single stream, applying the RetryPolicy.
+// It's used once the server ignored a range request, see ErrRangeIgnored. The stream is requested from
+// the healthy mirrors like the segments, the next one is used once the RetryPolicy is exhausted on one.
+func (dm *DownloadManager) downloadStream(ctx context.Context) error {
+	for {
+		m := dm.mirrors.assign()
+		if m == nil {
+			return errors.New("no healthy mirror left")
+		}
+
+		pending := 0
+		for _, seg := range dm.Segm.Segments {
+			if !seg.Done {
+				pending++
+			}
+		}
+
+		err := dm.RetryPolicy.Retry(ctx, 0, func() error {
+			err := dm.Downloader.downloadStream(ctx, m.url, dm.Segm.Segments)
+			if err != nil && ctx.Err() == nil {
+				m.failures.Add(1)
+			}
+			return err
+		})
+		if err == nil {
+			m.segments.Add(int64(pending))
+			return nil
+		}
+		if ctx.Err() != nil || !dm.mirrors.exclude(m, err) {
+			return err
+		}
+
+		dm.Downloader.Logger.Warn("mirror failed, streaming from the next one",
+			slog.String("mirror", m.url.String()),
+			slog.String("error", err.Error()),
+		)
+	}
+}
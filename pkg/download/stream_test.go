@@ -0,0 +1,358 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadManager_RangeIgnored(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+
+	tests := []struct {
+		name string
+		get  func(wr http.ResponseWriter, req *http.Request)
+	}{
+		{
+			name: "200",
+			get: func(wr http.ResponseWriter, req *http.Request) {
+				wr.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				wr.Write([]byte(content)) //nolint:errcheck
+			},
+		},
+		{
+			name: "Content-Range mismatch",
+			get: func(wr http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("Range") == "" {
+					wr.Write([]byte(content)) //nolint:errcheck
+					return
+				}
+				// always the beginning of the file
+				wr.Header().Set("Content-Range", "bytes 0-999/4000")
+				wr.WriteHeader(http.StatusPartialContent)
+				wr.Write([]byte(content[:1000])) //nolint:errcheck
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gets atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodHead {
+					http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+					return
+				}
+				gets.Add(1)
+				tt.get(wr, req)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dm := NewDownloadManager(downloader, NewRetryPolicy(3))
+			_, err = dm.Download(context.Background(), WithNumberOfSegments(4))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got), "the file is not made of concatenated copies")
+			assert.LessOrEqual(t, gets.Load(), int64(4+1), "the ranges are not retried")
+			assert.Equal(t, int64(len(content)), dm.Progress.Snapshot().Downloaded)
+		})
+	}
+}
+
+func TestDownloadManager_NoRangeSupport(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+
+	for _, acceptRanges := range []string{"", "none"} {
+		t.Run("Accept-Ranges "+strconv.Quote(acceptRanges), func(t *testing.T) {
+			var gets atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+				if acceptRanges != "" {
+					wr.Header().Set("Accept-Ranges", acceptRanges)
+				}
+				wr.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				if req.Method == http.MethodGet {
+					gets.Add(1)
+					wr.Write([]byte(content)) //nolint:errcheck
+				}
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			downloader, err := NewDownloader(dir, server.URL+"/data.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = NewDownloadManager(downloader, NewRetryPolicy(1)).Download(context.Background(), WithNumberOfSegments(4))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+			assert.NoError(t, err)
+			assert.Len(t, got, len(content), "the file is not made of a copy per segment")
+			assert.Equal(t, content, string(got))
+			assert.LessOrEqual(t, gets.Load(), int64(2), "the file is requested once, besides the probe")
+		})
+	}
+}
+
+func TestDownloader_DownloadSegmentWithoutRanges(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte(content)) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	sm, err := NewSegmentManager(dir, int64(len(content)), WithNumberOfSegments(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl, err := NewDownloader(dir, server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole file is only accepted for the first segment
+	assert.NoError(t, dl.DownloadSegment(context.Background(), sm.Segments[0]))
+	assert.ErrorIs(t, dl.DownloadSegment(context.Background(), sm.Segments[1]), ErrRangeIgnored)
+	assert.Zero(t, sm.Segments[1].CurrentOffset)
+}
+
+func TestDownloadManager_RangeIgnoredMirrors(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+	probe := func(req *http.Request) bool {
+		return req.Method == http.MethodHead || req.Header.Get("Range") == "bytes=0-0"
+	}
+
+	var sourceStreams atomic.Int64
+	source := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if probe(req) {
+			http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+			return
+		}
+		if req.Header.Get("Range") == "" {
+			sourceStreams.Add(1)
+		}
+		http.Error(wr, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer source.Close()
+
+	// the mirror answers the range requests with the whole file
+	mirror := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if !probe(req) {
+			req.Header.Del("Range")
+		}
+		http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer mirror.Close()
+
+	dir := t.TempDir()
+	downloader, err := NewDownloader(dir, source.URL+"/data.txt", WithMirrors(mirror.URL+"/data.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewDownloadManager(downloader, NewRetryPolicy(2)).Download(context.Background(), WithNumberOfSegments(4))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(got))
+
+	if assert.Len(t, result.Mirrors, 2) {
+		assert.False(t, result.Mirrors[0].Healthy)
+		assert.Zero(t, result.Mirrors[0].Bytes)
+		assert.True(t, result.Mirrors[1].Healthy)
+		assert.Equal(t, int64(len(content)), result.Mirrors[1].Bytes, "the file is streamed from the mirror")
+	}
+	assert.LessOrEqual(t, sourceStreams.Load(), int64(2), "the excluded source isn't requested again")
+}
+
+func TestDownloader_DownloadStream(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte(content)) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	sm, err := NewSegmentManager(dir, int64(len(content)), WithNumberOfSegments(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data already written is kept
+	done, partial := sm.Segments[0], sm.Segments[2]
+	_, err = done.Write([]byte(content[:1000]))
+	assert.NoError(t, err)
+	assert.NoError(t, done.setDone(true))
+	_, err = partial.Write([]byte(content[2000:2300]))
+	assert.NoError(t, err)
+
+	dl, err := NewDownloader(dir, server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.NoError(t, dl.DownloadStream(context.Background(), sm.Segments)) {
+		for _, seg := range sm.Segments {
+			assert.True(t, seg.Done)
+		}
+
+		path, err := sm.MergeFiles("data.txt")
+		if assert.NoError(t, err) {
+			got, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got))
+		}
+	}
+}
+
+func TestDownloader_DownloadStreamTruncated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte("too short")) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	sm, err := NewSegmentManager(dir, 4000, WithNumberOfSegments(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl, err := NewDownloader(dir, server.URL+"/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dl.DownloadStream(context.Background(), sm.Segments)
+	assert.Error(t, err)
+	assert.False(t, sm.Segments[0].Done)
+}
+
+// newExportServer serves content as a stream of unknown length. The first GET request is dropped
+// after half of the content, the following ones are handled by resume.
+func newExportServer(t *testing.T, content string, resume func(wr http.ResponseWriter, req *http.Request)) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var ranges []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Accept-Ranges", "bytes")
+		if req.Method == http.MethodHead {
+			return
+		}
+
+		mu.Lock()
+		first := len(ranges) == 0
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+
+		if first {
+			wr.Write([]byte(content[:len(content)/2])) //nolint:errcheck
+			http.NewResponseController(wr).Flush()     //nolint:errcheck
+			panic(http.ErrAbortHandler)
+		}
+		resume(wr, req)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &ranges
+}
+
+func TestDownloadManager_UnknownLength(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	half := len(content) / 2
+
+	tests := []struct {
+		name   string
+		resume func(wr http.ResponseWriter, req *http.Request)
+	}{
+		{
+			name: "range honoured",
+			resume: func(wr http.ResponseWriter, req *http.Request) {
+				var start int
+				if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+					wr.Write([]byte(content)) //nolint:errcheck
+					return
+				}
+				wr.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, len(content)-1))
+				wr.WriteHeader(http.StatusPartialContent)
+				wr.Write([]byte(content[start:])) //nolint:errcheck
+			},
+		},
+		{
+			name: "range ignored",
+			resume: func(wr http.ResponseWriter, req *http.Request) {
+				wr.Write([]byte(content)) //nolint:errcheck
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, ranges := newExportServer(t, content, tt.resume)
+
+			dir := t.TempDir()
+			downloader, err := NewDownloader(dir, server.URL+"/export.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dm := NewDownloadManager(downloader, NewRetryPolicy(3))
+			result, err := dm.Download(context.Background())
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := os.ReadFile(result.Path)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(got))
+			assert.Equal(t, []string{"", "bytes=" + strconv.Itoa(half) + "-"}, *ranges)
+
+			assert.Equal(t, int64(len(content)), dm.Segm.FileSize)
+			progress := dm.Progress.Snapshot()
+			assert.Equal(t, int64(len(content)), progress.Downloaded)
+			assert.Equal(t, int64(len(content)), progress.Total)
+		})
+	}
+}
+
+func TestDownloadManager_UnknownLengthInvalidContentRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	server, _ := newExportServer(t, content, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Range", "bytes 0-99/*")
+		wr.WriteHeader(http.StatusPartialContent)
+		wr.Write([]byte(content[:100])) //nolint:errcheck
+	})
+
+	downloader, err := NewDownloader(t.TempDir(), server.URL+"/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDownloadManager(downloader, NewRetryPolicy(2)).Download(context.Background())
+	assert.ErrorIs(t, err, ErrInvalidContentRange)
+}
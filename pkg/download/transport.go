@@ -0,0 +1,403 @@
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReadTimeout      = errors.New("read timeout, no data received")
+	ErrInvalidTransport = errors.New("invalid transport configuration")
+)
+
+// HTTPVersion is the HTTP protocol version used by a Client, see WithHTTPVersion.
+type HTTPVersion string
+
+const (
+	// HTTPVersionAuto negotiates HTTP/2 with the servers that support it, it's the default.
+	HTTPVersionAuto HTTPVersion = ""
+	// HTTP1 restricts the requests to HTTP/1.1, e.g. for servers with a broken HTTP/2 support.
+	HTTP1 HTTPVersion = "1.1"
+	// HTTP2 attempts HTTP/2 even when the TLS configuration or the dialer is customized,
+	// servers that don't support it are still requested with HTTP/1.1.
+	HTTP2 HTTPVersion = "2"
+)
+
+// transportConfig is the configuration of the transport of a Client, see NewClient.
+type transportConfig struct {
+	connectTimeout        time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	readTimeout           time.Duration
+
+	proxy   string
+	noProxy []string
+
+	caFile            string
+	certFile, keyFile string
+
+	httpVersion HTTPVersion
+}
+
+// transportOption returns a ClientOption that modifies the transport configuration of the client.
+func transportOption(fn func(cfg *transportConfig)) ClientOption {
+	return func(client *Client) {
+		if client.transport == nil {
+			client.transport = &transportConfig{}
+		}
+		fn(client.transport)
+	}
+}
+
+// WithConnectTimeout is an option function that limits the time spent establishing a TCP connection.
+func WithConnectTimeout(timeout time.Duration) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.connectTimeout = timeout
+	})
+}
+
+// WithTLSHandshakeTimeout is an option function that limits the time spent on the TLS handshake.
+func WithTLSHandshakeTimeout(timeout time.Duration) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.tlsHandshakeTimeout = timeout
+	})
+}
+
+// WithResponseHeaderTimeout is an option function that limits the time spent waiting for the
+// response headers once the request is sent.
+func WithResponseHeaderTimeout(timeout time.Duration) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.responseHeaderTimeout = timeout
+	})
+}
+
+// WithIdleConnTimeout is an option function that sets how long an idle connection is kept open for reuse.
+func WithIdleConnTimeout(timeout time.Duration) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.idleConnTimeout = timeout
+	})
+}
+
+// WithReadTimeout is an option function that aborts a request when no data is received for the
+// given duration, be it the response headers or the body. The request fails with ErrReadTimeout,
+// which is retried like any other error by the RetryPolicy.
+func WithReadTimeout(timeout time.Duration) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.readTimeout = timeout
+	})
+}
+
+// WithProxy is an option function that sends the requests through the given proxy, an http, https,
+// socks5 or socks5h URL, instead of the one of the HTTP_PROXY and HTTPS_PROXY environment variables.
+// The requests to the hosts of the NO_PROXY environment variable are not proxied, see WithNoProxy.
+func WithProxy(proxyURL string) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.proxy = proxyURL
+	})
+}
+
+// WithNoProxy is an option function that sets the hosts that are not requested through the proxy given
+// with WithProxy, or through the one of the HTTP_PROXY and HTTPS_PROXY environment variables without it,
+// instead of the ones of the NO_PROXY environment variable. A host is a domain name, which matches its
+// subdomains too, an IP address or a CIDR range, optionally with a port, or * for all hosts.
+func WithNoProxy(hosts ...string) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.noProxy = append(cfg.noProxy, hosts...)
+	})
+}
+
+// WithCACertFile is an option function that trusts the certificates of the given PEM bundle,
+// in addition to the system ones, e.g. for servers with a certificate issued by a private CA.
+func WithCACertFile(path string) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.caFile = path
+	})
+}
+
+// WithClientCertificate is an option function that authenticates the client with the given PEM
+// certificate and key files to the servers requiring mutual TLS.
+func WithClientCertificate(certFile, keyFile string) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.certFile, cfg.keyFile = certFile, keyFile
+	})
+}
+
+// WithHTTPVersion is an option function that sets the HTTP protocol version of the requests.
+func WithHTTPVersion(version HTTPVersion) ClientOption {
+	return transportOption(func(cfg *transportConfig) {
+		cfg.httpVersion = version
+	})
+}
+
+// apply returns a copy of the given http.Client with a transport configured accordingly.
+// The transport of the given client, if any, must be an *http.Transport, it's cloned.
+func (cfg *transportConfig) apply(base *http.Client) (*http.Client, error) {
+	var t *http.Transport
+	switch rt := base.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return nil, fmt.Errorf("%w: the transport of the http client is a %T, not an *http.Transport", ErrInvalidTransport, rt)
+	}
+
+	if cfg.connectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: cfg.connectTimeout, KeepAlive: 30 * time.Second}
+		t.DialContext = dialer.DialContext
+	}
+	if cfg.tlsHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = cfg.tlsHandshakeTimeout
+	}
+	if cfg.responseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = cfg.responseHeaderTimeout
+	}
+	if cfg.idleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.idleConnTimeout
+	}
+
+	if cfg.proxy != "" || cfg.noProxy != nil {
+		proxy, err := cfg.proxyFunc(t.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = proxy
+	}
+
+	if err := cfg.configureTLS(t); err != nil {
+		return nil, err
+	}
+
+	switch cfg.httpVersion {
+	case HTTPVersionAuto:
+	case HTTP1:
+		// a non-nil empty map disables HTTP/2, which must not be offered during the TLS handshake either
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if t.TLSClientConfig != nil {
+			t.TLSClientConfig = t.TLSClientConfig.Clone()
+			t.TLSClientConfig.NextProtos = slices.DeleteFunc(t.TLSClientConfig.NextProtos, func(proto string) bool {
+				return proto == "h2"
+			})
+		}
+	case HTTP2:
+		t.ForceAttemptHTTP2 = true
+	default:
+		return nil, fmt.Errorf("%w: unsupported HTTP version %q", ErrInvalidTransport, cfg.httpVersion)
+	}
+
+	httpClient := *base
+	httpClient.Transport = t
+	if cfg.readTimeout > 0 {
+		httpClient.Transport = &readTimeoutTransport{base: t, timeout: cfg.readTimeout}
+	}
+
+	return &httpClient, nil
+}
+
+// proxyFunc returns the proxy function of the transport for the configured proxy URL and excluded hosts.
+// Without proxy URL, the requests to the hosts that are not excluded go through the given proxy function
+// of the transport, e.g. http.ProxyFromEnvironment.
+func (cfg *transportConfig) proxyFunc(base func(*http.Request) (*url.URL, error)) (func(*http.Request) (*url.URL, error), error) {
+	if cfg.proxy == "" {
+		return func(req *http.Request) (*url.URL, error) {
+			if base == nil || bypassProxy(req.URL, cfg.noProxy) {
+				return nil, nil
+			}
+			return base(req)
+		}, nil
+	}
+
+	proxyURL, err := url.Parse(cfg.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid proxy: %w", ErrInvalidTransport, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%w: unsupported proxy scheme %q", ErrInvalidTransport, proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("%w: proxy %q has no host", ErrInvalidTransport, cfg.proxy)
+	}
+
+	noProxy := cfg.noProxy
+	if noProxy == nil {
+		env := os.Getenv("NO_PROXY")
+		if env == "" {
+			env = os.Getenv("no_proxy")
+		}
+		noProxy = strings.Split(env, ",")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassProxy reports whether the URL matches one of the hosts not requested through a proxy.
+func bypassProxy(u *url.URL, noProxy []string) bool {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ip := net.ParseIP(host)
+
+	for _, pattern := range noProxy {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+			continue
+		case pattern == "*":
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		// an optional port restricts the pattern to that port
+		if h, p, err := net.SplitHostPort(pattern); err == nil {
+			if p != port {
+				continue
+			}
+			pattern = h
+		}
+
+		if patternIP := net.ParseIP(pattern); patternIP != nil {
+			if ip != nil && patternIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+		host := strings.ToLower(host)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configureTLS sets the CA bundle and the client certificate of the transport, if any.
+func (cfg *transportConfig) configureTLS(t *http.Transport) error {
+	if cfg.caFile == "" && cfg.certFile == "" && cfg.keyFile == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.TLSClientConfig != nil {
+		tlsConfig = t.TLSClientConfig.Clone()
+	}
+
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			return fmt.Errorf("%w: reading CA bundle: %w", ErrInvalidTransport, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: no certificate found in %s", ErrInvalidTransport, cfg.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.certFile != "" || cfg.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return fmt.Errorf("%w: loading client certificate: %w", ErrInvalidTransport, err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	t.TLSClientConfig = tlsConfig
+
+	return nil
+}
+
+// readTimeoutTransport is an http.RoundTripper that cancels the requests not receiving any data for a while.
+type readTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *readTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.timeout, func() { cancel(ErrReadTimeout) })
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		err = t.timeoutErr(ctx, err)
+		cancel(nil)
+		return nil, err
+	}
+
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, transport: t, ctx: ctx, cancel: cancel, timer: timer}
+
+	return resp, nil
+}
+
+// timeoutErr replaces the error caused by the read timeout with an ErrReadTimeout error.
+func (t *readTimeoutTransport) timeoutErr(ctx context.Context, err error) error {
+	if errors.Is(context.Cause(ctx), ErrReadTimeout) {
+		return fmt.Errorf("%w after %s", ErrReadTimeout, t.timeout)
+	}
+
+	return err
+}
+
+// timeoutBody is the body of a response of a readTimeoutTransport, every read extends the timeout.
+type timeoutBody struct {
+	io.ReadCloser
+	transport *readTimeoutTransport
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	timer     *time.Timer
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.transport.timeout)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = b.transport.timeoutErr(b.ctx, err)
+	}
+
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+
+	return err
+}
@@ -0,0 +1,284 @@
+package download
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_ReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/headers":
+			time.Sleep(500 * time.Millisecond)
+		case "/stall":
+			wr.Write([]byte("some data"))          //nolint:errcheck
+			http.NewResponseController(wr).Flush() //nolint:errcheck
+			<-req.Context().Done()
+		case "/slow":
+			// slow but never silent for long
+			for range 5 {
+				wr.Write([]byte("x"))                  //nolint:errcheck
+				http.NewResponseController(wr).Flush() //nolint:errcheck
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(WithReadTimeout(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		return io.ReadAll(resp.Body)
+	}
+
+	_, err = get("/headers")
+	assert.ErrorIs(t, err, ErrReadTimeout)
+
+	body, err := get("/stall")
+	assert.ErrorIs(t, err, ErrReadTimeout)
+	assert.Equal(t, "some data", string(body))
+
+	body, err = get("/slow")
+	assert.NoError(t, err)
+	assert.Equal(t, "xxxxx", string(body))
+}
+
+func TestClient_Proxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.String())
+		wr.Write([]byte("from proxy")) //nolint:errcheck
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(WithProxy(proxy.URL), WithNoProxy("internal.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.httpClient.Get("http://files.example/data.txt")
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close() //nolint:errcheck
+		assert.Equal(t, "from proxy", string(body))
+		assert.Equal(t, []string{"http://files.example/data.txt"}, proxied)
+	}
+
+	_, err = NewClient(WithProxy("ftp://proxy.example"))
+	assert.ErrorIs(t, err, ErrInvalidTransport)
+}
+
+func TestClient_NoProxyWithoutProxy(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.example:3128")
+	// the proxy of the environment, like http.ProxyFromEnvironment
+	base := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	httpClient, err := NewHTTPClient(WithHTTPClient(base), WithNoProxy("internal.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httpClient.Transport.(*http.Transport).Proxy
+
+	u, err := proxy(httptest.NewRequest(http.MethodGet, "http://files.example/data.txt", http.NoBody))
+	assert.NoError(t, err)
+	assert.Equal(t, proxyURL, u)
+
+	u, err = proxy(httptest.NewRequest(http.MethodGet, "http://mirror.internal.example/data.txt", http.NoBody))
+	assert.NoError(t, err)
+	assert.Nil(t, u, "the excluded hosts are requested directly")
+}
+
+func TestNewHTTPClient_OAuth2(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.String())
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write([]byte(`{"access_token": "tok", "token_type": "bearer", "expires_in": 3600}`)) //nolint:errcheck
+	}))
+	defer proxy.Close()
+
+	httpClient, err := NewHTTPClient(WithProxy(proxy.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := &OAuth2{TokenURL: "http://auth.example/token", ClientID: "client", HTTPClient: httpClient}
+	req := httptest.NewRequest(http.MethodGet, "http://files.example/data.txt", http.NoBody)
+	if assert.NoError(t, auth.Apply(context.Background(), req)) {
+		assert.Equal(t, "Bearer tok", req.Header.Get("Authorization"))
+		assert.Equal(t, []string{"http://auth.example/token"}, proxied, "the token is requested through the proxy")
+	}
+
+	_, err = NewHTTPClient(WithProxy("ftp://proxy.example"))
+	assert.ErrorIs(t, err, ErrInvalidTransport)
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := []string{"internal.example", ".corp.example", "10.0.0.0/8", "192.168.1.1", "api.example:8443"}
+
+	tests := []struct {
+		url    string
+		bypass bool
+	}{
+		{"http://internal.example/file", true},
+		{"http://files.internal.example/file", true},
+		{"https://www.corp.example/file", true},
+		{"http://10.1.2.3/file", true},
+		{"http://192.168.1.1:8080/file", true},
+		{"https://api.example:8443/file", true},
+		{"https://api.example/file", false},
+		{"http://notinternal.example/file", false},
+		{"http://11.0.0.1/file", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tt.bypass, bypassProxy(u, noProxy), tt.url)
+	}
+
+	u, _ := url.Parse("http://anything.example")
+	assert.True(t, bypassProxy(u, []string{"*"}))
+	assert.False(t, bypassProxy(u, []string{""}))
+}
+
+// writePEM writes the certificate and key to PEM files and returns their paths.
+func writePEM(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600))
+
+	return certFile, keyFile
+}
+
+// newClientCertificate returns a self-signed client certificate.
+func newClientCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dr client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestClient_TLS(t *testing.T) {
+	clientCert, clientX509 := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte(req.Proto)) //nolint:errcheck
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile, _ := writePEM(t, server.TLS.Certificates[0])
+	certFile, keyFile := writePEM(t, clientCert)
+
+	get := func(options ...ClientOption) (string, error) {
+		client, err := NewClient(options...)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.httpClient.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close() //nolint:errcheck
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	_, err := get(WithClientCertificate(certFile, keyFile))
+	assert.Error(t, err, "the server certificate is not trusted")
+
+	_, err = get(WithCACertFile(caFile))
+	assert.Error(t, err, "the client certificate is required")
+
+	proto, err := get(WithCACertFile(caFile), WithClientCertificate(certFile, keyFile))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "HTTP/2.0", proto)
+	}
+
+	proto, err = get(WithCACertFile(caFile), WithClientCertificate(certFile, keyFile), WithHTTPVersion(HTTP1))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "HTTP/1.1", proto)
+	}
+}
+
+func TestNewClient_InvalidTransport(t *testing.T) {
+	tests := map[string][]ClientOption{
+		"http version":     {WithHTTPVersion("3")},
+		"missing CA file":  {WithCACertFile(filepath.Join(t.TempDir(), "missing.pem"))},
+		"missing key file": {WithClientCertificate("cert.pem", "")},
+		"custom transport": {WithHTTPClient(&http.Client{Transport: roundTripperFunc(nil)}), WithConnectTimeout(time.Second)},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewClient(options...)
+			assert.ErrorIs(t, err, ErrInvalidTransport)
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package queue
+
+// lockFile is not supported on this platform, the state file is not locked.
+func lockFile(string) (func(), error) {
+	return func() {}, nil
+}
+
+// processAlive is not supported on this platform, the jobs running in other processes are not detected.
+func processAlive(int) bool {
+	return false
+}
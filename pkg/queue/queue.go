@@ -0,0 +1,735 @@
+// Package queue provides a persistent download queue on top of the download package.
+// Jobs are run by priority under a concurrency limit, and the state of the queue is
+// saved to disk so that it survives restarts.
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/azhovan/durable-resume/pkg/download"
+)
+
+var (
+	ErrJobNotFound       = errors.New("job not found")
+	ErrInvalidTransition = errors.New("invalid job state transition")
+	ErrRunningElsewhere  = errors.New("job is run by another process")
+)
+
+// Status represents the state of a job in the queue.
+type Status string
+
+const (
+	// Queued jobs are waiting to be run.
+	Queued Status = "queued"
+	// Running jobs are being downloaded.
+	Running Status = "running"
+	// Paused jobs are not run until they are resumed.
+	Paused Status = "paused"
+	// Completed jobs finished successfully.
+	Completed Status = "completed"
+	// Failed jobs exhausted their retry policy, they can be re-queued.
+	Failed Status = "failed"
+	// Canceled jobs were canceled by the user, they can be re-queued.
+	Canceled Status = "canceled"
+)
+
+// Job is a download in the queue.
+type Job struct {
+	// ID uniquely identifies the job.
+	ID string `json:"id"`
+
+	// Entry describes the file to download.
+	Entry download.BatchEntry `json:"entry"`
+
+	// Priority determines the order jobs are run in, higher priorities run first.
+	// Jobs with the same priority run in the order they were enqueued.
+	Priority int `json:"priority"`
+
+	// Status is the current state of the job.
+	Status Status `json:"status"`
+
+	// Path is the final path of the downloaded file, once completed.
+	Path string `json:"path,omitempty"`
+
+	// Error is the error message of a failed job.
+	Error string `json:"error,omitempty"`
+
+	// CreatedAt is the time the job was enqueued.
+	CreatedAt time.Time `json:"created_at"`
+
+	// UpdatedAt is the time of the last change of the job's state.
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Owner is the ID of the process running the job, or holding it paused in memory.
+	// Only that process can pause or cancel the job.
+	Owner int `json:"owner,omitempty"`
+
+	// seq orders the jobs with the same priority.
+	seq int64
+}
+
+// DefaultConcurrency is the default number of jobs that run at the same time.
+const DefaultConcurrency = 2
+
+// Queue runs download jobs by priority, with at most Concurrency jobs at the same time.
+// Every change of the queue is persisted to its state file, which can be shared by several
+// processes: it's locked while it's read, changed and written, see update.
+type Queue struct {
+	// path is the file the state of the queue is persisted to.
+	path string
+
+	// concurrency is the maximum number of jobs running at the same time.
+	concurrency int
+
+	// runner downloads the jobs, it carries the shared client and download settings.
+	runner *download.Batch
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	seq  int64
+
+	// cancels holds the cancel function of every running job, and intents the status
+	// a running job moves to once it's interrupted by the user.
+	cancels map[string]context.CancelFunc
+	intents map[string]Status
+
+	// progress tracks the download of every running job.
+	progress map[string]*download.Progress
+
+	// managers holds the DownloadManager of every running job once its download started. A paused job
+	// is paused through it, its download waits in memory to continue from where its segments stopped.
+	managers map[string]*download.DownloadManager
+
+	// wake notifies the scheduler that jobs may be started.
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Option defines a function type for configuring a Queue instance.
+type Option func(*Queue)
+
+// WithConcurrency is an option function that sets the maximum number of jobs running at the same time.
+func WithConcurrency(n int) Option {
+	return func(q *Queue) {
+		if n > 0 {
+			q.concurrency = n
+		}
+	}
+}
+
+// WithRunner is an option function that sets the Batch used to run the jobs,
+// it carries the client, the retry policy and the options shared by all downloads.
+func WithRunner(runner *download.Batch) Option {
+	return func(q *Queue) {
+		q.runner = runner
+	}
+}
+
+// DefaultPath returns the default location of the queue state file.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "durable-resume", "queue.json"), nil
+}
+
+// New creates a Queue persisted to the given path, loading the jobs saved there if any.
+// Jobs that were running when the state was saved are queued again.
+func New(path string, options ...Option) (*Queue, error) {
+	runner, err := download.NewBatch(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		path:        path,
+		concurrency: DefaultConcurrency,
+		runner:      runner,
+		jobs:        make(map[string]*Job),
+		cancels:     make(map[string]context.CancelFunc),
+		intents:     make(map[string]Status),
+		progress:    make(map[string]*download.Progress),
+		managers:    make(map[string]*download.DownloadManager),
+		wake:        make(chan struct{}, 1),
+	}
+	for _, opt := range options {
+		opt(q)
+	}
+
+	if err = q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Enqueue adds a new job for the given entry to the queue.
+func (q *Queue) Enqueue(entry download.BatchEntry, priority int) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var job *Job
+	err = q.update(func() error {
+		now := time.Now()
+		q.seq++
+		job = &Job{
+			ID:        id,
+			Entry:     entry,
+			Priority:  priority,
+			Status:    Queued,
+			CreatedAt: now,
+			UpdatedAt: now,
+			seq:       q.seq,
+		}
+		q.jobs[id] = job
+		return nil
+	})
+	if err != nil {
+		delete(q.jobs, id)
+		return Job{}, err
+	}
+	q.notify()
+
+	return *job, nil
+}
+
+// Job returns the job with the given ID.
+func (q *Queue) Job(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+
+	return *job, nil
+}
+
+// Jobs returns the jobs with any of the given statuses, or all jobs if none is given,
+// in the order they are run.
+func (q *Queue) Jobs(statuses ...Status) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var jobs []Job
+	for _, job := range q.sorted() {
+		if len(statuses) == 0 || contains(statuses, job.Status) {
+			jobs = append(jobs, *job)
+		}
+	}
+
+	return jobs
+}
+
+// Progress returns the progress of a running job, it reports false if the job isn't running.
+func (q *Queue) Progress(id string) (download.ProgressSnapshot, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	progress, ok := q.progress[id]
+	if !ok {
+		return download.ProgressSnapshot{}, false
+	}
+
+	return progress.Snapshot(), true
+}
+
+// Failed returns the jobs that exhausted their retry policy.
+func (q *Queue) Failed() []Job {
+	return q.Jobs(Failed)
+}
+
+// Pause pauses a queued or running job. A running job is paused in memory, it continues from
+// where it stopped once resumed, unless the queue stops in the meantime.
+func (q *Queue) Pause(id string) error {
+	return q.interrupt(id, Paused, Queued)
+}
+
+// Cancel cancels a queued, paused or running job, a running job is interrupted and its temporary files removed.
+func (q *Queue) Cancel(id string) error {
+	return q.interrupt(id, Canceled, Queued, Paused)
+}
+
+// Resume queues a paused job again.
+func (q *Queue) Resume(id string) error {
+	return q.transition(id, Queued, Paused)
+}
+
+// Requeue queues a failed or canceled job again.
+func (q *Queue) Requeue(id string) error {
+	return q.transition(id, Queued, Failed, Canceled)
+}
+
+// SetPriority changes the priority of a job, it takes effect the next time jobs are picked to run.
+func (q *Queue) SetPriority(id string, priority int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.update(func() error {
+		job, ok := q.jobs[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+		}
+
+		job.Priority = priority
+		job.UpdatedAt = time.Now()
+		q.notify()
+
+		return nil
+	})
+}
+
+// Remove removes a job that is not running from the queue.
+func (q *Queue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.update(func() error {
+		job, ok := q.jobs[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+		}
+		if job.Status == Running {
+			return fmt.Errorf("%w: can't remove running job %s", ErrInvalidTransition, id)
+		}
+		if err := q.checkOwner(job); err != nil {
+			return err
+		}
+		if dm, held := q.managers[id]; held {
+			// the download of a job paused in memory is canceled, it removes its temporary files
+			_ = dm.Cancel()
+		}
+
+		delete(q.jobs, id)
+		return nil
+	})
+}
+
+// Run runs the queued jobs until the context is done. Jobs running at that time
+// are interrupted and queued again, so they are picked up by the next run.
+func (q *Queue) Run(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		q.schedule(ctx, "")
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			q.wg.Wait()
+			return nil
+		case <-q.wake:
+		}
+	}
+}
+
+// RunJob runs the job of the given ID, leaving the other queued jobs aside, until it's neither queued
+// nor running anymore. When the context is done first, the job is interrupted and queued again.
+func (q *Queue) RunJob(ctx context.Context, id string) error {
+	if _, err := q.Job(id); err != nil {
+		return err
+	}
+
+	for {
+		q.mu.Lock()
+		q.schedule(ctx, id)
+		job, ok := q.jobs[id]
+		active := ok && (job.Status == Queued || job.Status == Running)
+
+		if !active {
+			// a job paused in memory can't be resumed once RunJob returns
+			if cancel, held := q.cancels[id]; held {
+				cancel()
+			}
+			q.mu.Unlock()
+			q.wg.Wait()
+			return nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			q.wg.Wait()
+			return nil
+		case <-q.wake:
+		}
+	}
+}
+
+// schedule starts the queued jobs with the highest priority, as long as the concurrency limit allows,
+// only the job of the given ID when it's not empty. It must be called with the lock held.
+func (q *Queue) schedule(ctx context.Context, only string) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	// the jobs queued by the other processes are picked up too
+	_ = q.update(func() error {
+		for _, job := range q.sorted() {
+			if q.running() >= q.concurrency {
+				break
+			}
+			if job.Status != Queued || (only != "" && job.ID != only) {
+				continue
+			}
+			if _, held := q.cancels[job.ID]; held {
+				// the job was paused in memory, its download continues from where it stopped
+				if q.managers[job.ID].Resume() == nil {
+					q.setStatus(job, Running, "")
+				}
+				continue
+			}
+
+			jobCtx, cancel := context.WithCancel(ctx)
+			q.cancels[job.ID] = cancel
+			q.progress[job.ID] = &download.Progress{}
+			q.setStatus(job, Running, "")
+
+			q.wg.Add(1)
+			go q.run(jobCtx, *job, q.progress[job.ID])
+		}
+		return nil
+	})
+}
+
+// running returns the number of jobs counting towards the concurrency limit, i.e. the running ones
+// but not the ones paused in memory. It must be called with the lock held.
+func (q *Queue) running() int {
+	n := 0
+	for id := range q.cancels {
+		if job, ok := q.jobs[id]; ok && job.Status == Running {
+			n++
+		}
+	}
+
+	return n
+}
+
+// run downloads the job and records its outcome.
+func (q *Queue) run(ctx context.Context, job Job, progress *download.Progress) {
+	defer q.wg.Done()
+
+	result := q.runner.Download(ctx, job.Entry,
+		download.WithProgress(progress),
+		download.WithManager(func(dm *download.DownloadManager) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.managers[job.ID] = dm
+		}),
+	)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stopped := ctx.Err() != nil
+	q.cancels[job.ID]()
+	delete(q.cancels, job.ID)
+	delete(q.progress, job.ID)
+	delete(q.managers, job.ID)
+	intent, interrupted := q.intents[job.ID]
+	delete(q.intents, job.ID)
+
+	_ = q.update(func() error {
+		current, ok := q.jobs[job.ID]
+		if !ok {
+			return nil
+		}
+
+		switch {
+		case interrupted:
+			q.setStatus(current, intent, "")
+		case stopped && current.Status == Paused:
+			// the queue is shutting down while the job is paused in memory, it starts over once resumed
+			q.setStatus(current, Paused, "")
+		case stopped:
+			// the queue is shutting down, the job runs again on the next start
+			q.setStatus(current, Queued, "")
+		case result.Status == download.BatchFailed:
+			q.setStatus(current, Failed, result.Err.Error())
+		default:
+			current.Path = result.Path
+			q.setStatus(current, Completed, "")
+		}
+		return nil
+	})
+	q.notify()
+}
+
+// interrupt moves a job to the given status, allowed from the given statuses or while running.
+// A running job is paused or canceled through its DownloadManager, see Pause and Cancel. When its
+// download didn't start yet, it's interrupted and moves to the status once its download returns.
+// A job run by another process can't be interrupted, it returns ErrRunningElsewhere.
+func (q *Queue) interrupt(id string, to Status, from ...Status) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.update(func() error {
+		job, ok := q.jobs[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+		}
+		if err := q.checkOwner(job); err != nil {
+			return err
+		}
+		if job.Status != Running && !contains(from, job.Status) {
+			return fmt.Errorf("%w: %s job %s can't be %s", ErrInvalidTransition, job.Status, id, to)
+		}
+
+		cancel, held := q.cancels[id]
+		if !held {
+			q.setStatus(job, to, "")
+			return nil
+		}
+
+		dm := q.managers[id]
+		switch {
+		case to == Paused && job.Status != Running:
+			// the job is paused in memory, and was to be resumed
+			q.setStatus(job, Paused, "")
+		case to == Paused && dm != nil && dm.Pause() == nil:
+			q.setStatus(job, Paused, "")
+			// the paused job no longer counts towards the concurrency limit
+			q.notify()
+		case to == Canceled && dm != nil && dm.Cancel() == nil:
+			q.intents[id] = to
+		default:
+			q.intents[id] = to
+			cancel()
+		}
+		return nil
+	})
+}
+
+// transition moves a job that isn't running to the given status, allowed from the given statuses.
+func (q *Queue) transition(id string, to Status, from ...Status) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.update(func() error {
+		job, ok := q.jobs[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+		}
+		if err := q.checkOwner(job); err != nil {
+			return err
+		}
+		if !contains(from, job.Status) {
+			return fmt.Errorf("%w: %s job %s can't be %s", ErrInvalidTransition, job.Status, id, to)
+		}
+
+		q.setStatus(job, to, "")
+		q.notify()
+		return nil
+	})
+}
+
+// checkOwner returns ErrRunningElsewhere if the job is run, or held paused in memory, by another process.
+func (q *Queue) checkOwner(job *Job) error {
+	if job.Owner == 0 || job.Owner == os.Getpid() {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s, %s in process %d", ErrRunningElsewhere, job.ID, job.Status, job.Owner)
+}
+
+// setStatus updates the status of the job, it must be called with the lock held.
+// The job is owned by the current process while it holds the job's download.
+func (q *Queue) setStatus(job *Job, status Status, errMsg string) {
+	job.Status = status
+	job.Error = errMsg
+	job.UpdatedAt = time.Now()
+
+	job.Owner = 0
+	if _, held := q.cancels[job.ID]; held {
+		job.Owner = os.Getpid()
+	}
+}
+
+// notify wakes the scheduler up without blocking.
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sorted returns the jobs in the order they are run, it must be called with the lock held.
+func (q *Queue) sorted() []*Job {
+	jobs := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority > jobs[j].Priority
+		}
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+		}
+		return jobs[i].seq < jobs[j].seq
+	})
+
+	return jobs
+}
+
+// load reads the jobs from the state file, a missing file is an empty queue.
+func (q *Queue) load() error {
+	jobs, err := q.read()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		q.seq++
+		job.seq = q.seq
+		q.jobs[job.ID] = job
+	}
+
+	return nil
+}
+
+// reload reads the jobs from the state file again, to take in the changes of the other processes.
+// The jobs whose download is held by the current process are kept as they are, they're only changed
+// by this process. It must be called with the lock held.
+func (q *Queue) reload() error {
+	jobs, err := q.read()
+	if err != nil {
+		return err
+	}
+
+	previous := q.jobs
+	q.jobs = make(map[string]*Job, len(jobs))
+	for _, job := range jobs {
+		if prev, ok := previous[job.ID]; ok {
+			job.seq = prev.seq
+		} else {
+			q.seq++
+			job.seq = q.seq
+		}
+		q.jobs[job.ID] = job
+	}
+	for id := range q.cancels {
+		if job, ok := previous[id]; ok {
+			q.jobs[id] = job
+		}
+	}
+
+	return nil
+}
+
+// read reads the jobs from the state file. The jobs of a process that is gone, e.g. stopped
+// while they were running, are released, the running ones are queued again.
+func (q *Queue) read() ([]*Job, error) {
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	if err = json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("reading queue state %s: %w", q.path, err)
+	}
+
+	for _, job := range jobs {
+		if job.Owner == os.Getpid() && q.cancels[job.ID] != nil {
+			continue
+		}
+		if job.Owner != 0 && job.Owner != os.Getpid() && processAlive(job.Owner) {
+			continue
+		}
+		job.Owner = 0
+		if job.Status == Running {
+			job.Status = Queued
+		}
+	}
+
+	return jobs, nil
+}
+
+// update reads the jobs again, applies fn and saves the jobs, while holding an exclusive lock of
+// the state file, so that the changes of the processes sharing it are not lost.
+// It must be called with the lock held.
+func (q *Queue) update(fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(q.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = q.reload(); err != nil {
+		return err
+	}
+	if err = fn(); err != nil {
+		return err
+	}
+
+	return q.save()
+}
+
+// save writes the jobs to the state file atomically, it must be called with the lock held, see update.
+func (q *Queue) save() error {
+	data, err := json.MarshalIndent(q.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), q.path)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func contains(statuses []Status, status Status) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
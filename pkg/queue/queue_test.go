@@ -0,0 +1,364 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azhovan/durable-resume/pkg/download"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer serves "hello world" for any path but /missing, and blocks the requests to /slow
+// until release is closed. The paths of the probing requests are recorded in order.
+func newTestServer(t *testing.T, release chan struct{}) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			mu.Lock()
+			paths = append(paths, req.URL.Path)
+			mu.Unlock()
+		}
+
+		switch req.URL.Path {
+		case "/missing":
+			http.NotFound(wr, req)
+			return
+		case "/slow":
+			select {
+			case <-release:
+			case <-req.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(wr, req, "hello.txt", time.Time{}, strings.NewReader("hello world"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func newTestQueue(t *testing.T, path string, options ...Option) *Queue {
+	runner, err := download.NewBatch(nil,
+		download.WithOutputDir(t.TempDir()),
+		download.WithBatchRetryPolicy(func() *download.RetryPolicy { return download.NewRetryPolicy(1) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := New(path, append([]Option{WithRunner(runner)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+// waitFor polls the job until it has the given status.
+func waitFor(t *testing.T, q *Queue, id string, status Status) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := q.Job(id)
+		if err == nil && job.Status == status {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	job, _ := q.Job(id)
+	t.Fatalf("job %s is %s, want %s", id, job.Status, status)
+	return job
+}
+
+func TestQueue_Priority(t *testing.T) {
+	server, paths := newTestServer(t, nil)
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"), WithConcurrency(1))
+
+	low, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/low"}, 0)
+	assert.NoError(t, err)
+	high, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/high"}, 10)
+	assert.NoError(t, err)
+	other, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/other"}, 0)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = q.Run(ctx) }()
+
+	waitFor(t, q, low.ID, Completed)
+	waitFor(t, q, other.ID, Completed)
+	job := waitFor(t, q, high.ID, Completed)
+	assert.NotEmpty(t, job.Path)
+
+	assert.Equal(t, []string{"/high", "/low", "/other"}, paths())
+}
+
+func TestQueue_RunJob(t *testing.T) {
+	server, paths := newTestServer(t, nil)
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"))
+
+	other, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/other"}, 10)
+	assert.NoError(t, err)
+	watched, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/watched"}, 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.RunJob(context.Background(), watched.ID))
+
+	job, err := q.Job(watched.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Completed, job.Status)
+	job, err = q.Job(other.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Queued, job.Status, "the other jobs are not run")
+	assert.Equal(t, []string{"/watched"}, paths())
+
+	assert.ErrorIs(t, q.RunJob(context.Background(), "unknown"), ErrJobNotFound)
+}
+
+func TestQueue_PauseResumeCancel(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := newTestServer(t, release)
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = q.Run(ctx) }()
+
+	slow, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/slow"}, 0)
+	assert.NoError(t, err)
+	waitFor(t, q, slow.ID, Running)
+
+	assert.NoError(t, q.Pause(slow.ID))
+	waitFor(t, q, slow.ID, Paused)
+	assert.ErrorIs(t, q.Requeue(slow.ID), ErrInvalidTransition)
+
+	assert.NoError(t, q.Resume(slow.ID))
+	waitFor(t, q, slow.ID, Running)
+
+	assert.NoError(t, q.Cancel(slow.ID))
+	waitFor(t, q, slow.ID, Canceled)
+
+	close(release)
+	assert.NoError(t, q.Requeue(slow.ID))
+	waitFor(t, q, slow.ID, Completed)
+
+	assert.NoError(t, q.Remove(slow.ID))
+	_, err = q.Job(slow.ID)
+	assert.ErrorIs(t, err, ErrJobNotFound)
+}
+
+func TestQueue_FailedAndRequeue(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = q.Run(ctx) }()
+
+	job, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/missing"}, 0)
+	assert.NoError(t, err)
+
+	job = waitFor(t, q, job.ID, Failed)
+	assert.NotEmpty(t, job.Error)
+	if assert.Len(t, q.Failed(), 1) {
+		assert.Equal(t, job.ID, q.Failed()[0].ID)
+	}
+
+	assert.NoError(t, q.Requeue(job.ID))
+	waitFor(t, q, job.ID, Failed)
+}
+
+func TestQueue_Persistence(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := newTestServer(t, release)
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	q := newTestQueue(t, path)
+	slow, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/slow"}, 5)
+	assert.NoError(t, err)
+	paused, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/paused"}, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, q.Pause(paused.ID))
+
+	// stop the queue while the job is running
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = q.Run(ctx)
+		close(done)
+	}()
+	waitFor(t, q, slow.ID, Running)
+	cancel()
+	<-done
+
+	restarted := newTestQueue(t, path)
+	jobs := restarted.Jobs()
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, slow.ID, jobs[0].ID)
+		assert.Equal(t, Queued, jobs[0].Status)
+		assert.Equal(t, 5, jobs[0].Priority)
+		assert.Equal(t, server.URL+"/slow", jobs[0].Entry.URL)
+		assert.Equal(t, Paused, jobs[1].Status)
+	}
+
+	close(release)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = restarted.Run(ctx) }()
+	waitFor(t, restarted, slow.ID, Completed)
+
+	assert.NoError(t, restarted.SetPriority(paused.ID, 7))
+	job, err := restarted.Job(paused.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, job.Priority)
+}
+
+func TestQueue_PauseResumesFromOffset(t *testing.T) {
+	content := strings.Repeat("0123456789", 400)
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var served int
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || req.Method == http.MethodHead {
+			http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+			return
+		}
+
+		select {
+		case <-release:
+			// serves the rest of the file
+			mu.Lock()
+			served += end - start + 1
+			mu.Unlock()
+			http.ServeContent(wr, req, "data.txt", time.Time{}, strings.NewReader(content))
+			return
+		default:
+		}
+
+		// serves the first half of the range, then hangs until the download is paused
+		half := (end - start + 1) / 2
+		wr.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		wr.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		wr.WriteHeader(http.StatusPartialContent)
+		_, _ = wr.Write([]byte(content[start : start+half]))
+		wr.(http.Flusher).Flush()
+		mu.Lock()
+		served += half
+		mu.Unlock()
+		<-req.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = q.Run(ctx) }()
+
+	job, err := q.Enqueue(download.BatchEntry{URL: server.URL + "/data.txt"}, 0)
+	assert.NoError(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if p, ok := q.Progress(job.ID); ok && p.Downloaded >= int64(len(content)/2)-10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the download didn't make progress")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	assert.NoError(t, q.Pause(job.ID))
+	waitFor(t, q, job.ID, Paused)
+
+	close(release)
+	assert.NoError(t, q.Resume(job.ID))
+	job = waitFor(t, q, job.ID, Completed)
+
+	data, err := os.ReadFile(job.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, len(content), served, "the resumed download doesn't request the downloaded bytes again")
+}
+
+func TestQueue_SharedStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	first := newTestQueue(t, path)
+	second := newTestQueue(t, path)
+
+	// the queues are changed concurrently, like by several processes sharing the state file
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := first
+			if i%2 == 1 {
+				q = second
+			}
+			_, err := q.Enqueue(download.BatchEntry{URL: fmt.Sprintf("http://localhost/%d", i)}, 0)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, newTestQueue(t, path).Jobs(), 10)
+
+	job := second.Jobs()[0]
+	assert.NoError(t, first.Pause(job.ID))
+	assert.NoError(t, second.SetPriority(job.ID, 3))
+	job, err := newTestQueue(t, path).Job(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Paused, job.Status, "the change of the other queue is kept")
+	assert.Equal(t, 3, job.Priority)
+}
+
+func TestQueue_RunningElsewhere(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q := newTestQueue(t, path)
+	alive, err := q.Enqueue(download.BatchEntry{URL: "http://localhost/alive"}, 0)
+	assert.NoError(t, err)
+	gone, err := q.Enqueue(download.BatchEntry{URL: "http://localhost/gone"}, 0)
+	assert.NoError(t, err)
+
+	// the jobs are running in the parent process, and in one that is gone
+	q.mu.Lock()
+	q.jobs[alive.ID].Status, q.jobs[alive.ID].Owner = Running, os.Getppid()
+	q.jobs[gone.ID].Status, q.jobs[gone.ID].Owner = Running, 1<<30
+	assert.NoError(t, q.save())
+	q.mu.Unlock()
+
+	other := newTestQueue(t, path)
+	assert.ErrorIs(t, other.Pause(alive.ID), ErrRunningElsewhere)
+	assert.ErrorIs(t, other.Cancel(alive.ID), ErrRunningElsewhere)
+	job, err := other.Job(alive.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Running, job.Status)
+
+	job, err = other.Job(gone.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Queued, job.Status, "the job of a process that is gone is queued again")
+	assert.NoError(t, other.Pause(gone.ID))
+}